@@ -3,8 +3,10 @@ module github.com/soulteary/herald-smtp
 go 1.25.4
 
 require (
+	github.com/alicebob/miniredis/v2 v2.36.1
 	github.com/gofiber/fiber/v2 v2.52.11
 	github.com/pterm/pterm v0.12.82
+	github.com/redis/go-redis/v9 v9.17.3
 	github.com/soulteary/cli-kit v1.3.1
 	github.com/soulteary/health-kit v1.0.0
 	github.com/soulteary/logger-kit v1.2.0
@@ -29,11 +31,11 @@ require (
 	github.com/mattn/go-colorable v0.1.14 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/mattn/go-runewidth v0.0.19 // indirect
-	github.com/redis/go-redis/v9 v9.17.3 // indirect
 	github.com/rs/zerolog v1.34.0 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	github.com/valyala/fasthttp v1.69.0 // indirect
 	github.com/xo/terminfo v0.0.0-20220910002029-abceb7e1c41e // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
 	golang.org/x/sys v0.40.0 // indirect
 	golang.org/x/term v0.39.0 // indirect
 	golang.org/x/text v0.33.0 // indirect
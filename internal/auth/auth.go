@@ -0,0 +1,205 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scopes a key can be granted.
+const (
+	ScopeSend   = "send"   // send, batch send, message status and cancel
+	ScopeRender = "render" // template rendering
+	ScopeAdmin  = "admin"  // /v1/admin endpoints
+)
+
+// AllScopes lists every scope.
+var AllScopes = []string{ScopeSend, ScopeRender, ScopeAdmin}
+
+var (
+	ErrMissing   = errors.New("missing API key")
+	ErrInvalid   = errors.New("invalid API key")
+	ErrExpired   = errors.New("API key expired")
+	ErrForbidden = errors.New("API key not allowed for this endpoint")
+)
+
+// Key is a named API key. Only the SHA-256 of the secret is kept: Hash is its hex form,
+// optionally prefixed with "sha256:". A zero ExpiresAt never expires. SigningKeyFile, when
+// set, holds the hex SigningKey of the secret, which lets the key sign requests; keep it
+// apart from the keys file, since it is enough to sign.
+type Key struct {
+	Name           string    `json:"name"`
+	Hash           string    `json:"hash"`
+	Scopes         []string  `json:"scopes"`
+	ExpiresAt      time.Time `json:"expires_at,omitzero"`
+	SigningKeyFile string    `json:"signing_key_file,omitempty"`
+
+	sum     [sha256.Size]byte
+	signing []byte // nil when the key cannot sign requests
+}
+
+// Allows reports whether k was granted scope.
+func (k *Key) Allows(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Hash returns the hex SHA-256 of secret, as stored in a keys file.
+func Hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// SharedKey returns the single shared secret of API_KEY as a key named "default" with
+// every scope, or nothing when secret is empty.
+func SharedKey(secret string) []Key {
+	if secret == "" {
+		return nil
+	}
+	return []Key{{Name: "default", Hash: Hash(secret), Scopes: AllScopes, signing: signingKey(secret)}}
+}
+
+// keysFile is the format of the keys file.
+type keysFile struct {
+	Keys []Key `json:"keys"`
+}
+
+// Registry holds the API keys accepted by the service. Several keys may share a name, so
+// a service can rotate its key with the old and new one valid at once. A nil or empty
+// Registry disables authentication.
+type Registry struct {
+	path  string
+	extra []Key
+
+	mu      sync.RWMutex
+	keys    []Key
+	maxSkew time.Duration
+	nonces  *nonceCache // nil unless signed requests are enabled
+}
+
+// Open builds a registry from the JSON keys file at path (none when empty) plus extra.
+func Open(path string, extra ...Key) (*Registry, error) {
+	r := &Registry{path: path, extra: extra}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload re-reads the keys file. On error the current keys are kept.
+func (r *Registry) Reload() error {
+	keys := append([]Key(nil), r.extra...)
+	if r.path != "" {
+		b, err := os.ReadFile(r.path)
+		if err != nil {
+			return err
+		}
+		var f keysFile
+		if err := json.Unmarshal(b, &f); err != nil {
+			return fmt.Errorf("%s: %w", r.path, err)
+		}
+		keys = append(keys, f.Keys...)
+	}
+	for i := range keys {
+		if err := keys[i].parse(); err != nil {
+			return fmt.Errorf("key %d (%q): %w", i, keys[i].Name, err)
+		}
+	}
+	r.mu.Lock()
+	r.keys = keys
+	r.mu.Unlock()
+	return nil
+}
+
+// Len returns the number of keys.
+func (r *Registry) Len() int {
+	if r == nil {
+		return 0
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.keys)
+}
+
+// Authorize checks secret against every key in constant time and returns the name of
+// the matching key if it is unexpired and holds scope. With no keys it returns "", nil.
+func (r *Registry) Authorize(secret, scope string, now time.Time) (string, error) {
+	if r.Len() == 0 {
+		return "", nil
+	}
+	if secret == "" {
+		return "", ErrMissing
+	}
+	sum := sha256.Sum256([]byte(secret))
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var found *Key
+	for i := range r.keys {
+		k := &r.keys[i]
+		// No early exit: every key is compared so timing does not depend on the match.
+		if subtle.ConstantTimeCompare(sum[:], k.sum[:]) == 1 && (found == nil || !k.expired(now)) {
+			found = k
+		}
+	}
+	switch {
+	case found == nil:
+		return "", ErrInvalid
+	case found.expired(now):
+		return found.Name, ErrExpired
+	case !found.Allows(scope):
+		return found.Name, ErrForbidden
+	}
+	return found.Name, nil
+}
+
+func (k *Key) expired(now time.Time) bool {
+	return !k.ExpiresAt.IsZero() && now.After(k.ExpiresAt)
+}
+
+// parse validates k, decodes its hash and reads its signing key.
+func (k *Key) parse() error {
+	if k.Name == "" {
+		return errors.New("name is required")
+	}
+	b, err := hex.DecodeString(strings.TrimPrefix(strings.ToLower(k.Hash), "sha256:"))
+	if err != nil || len(b) != sha256.Size {
+		return errors.New("hash must be a hex SHA-256")
+	}
+	copy(k.sum[:], b)
+	if k.SigningKeyFile != "" {
+		raw, err := os.ReadFile(k.SigningKeyFile)
+		if err != nil {
+			return err
+		}
+		b, err := hex.DecodeString(strings.TrimSpace(string(raw)))
+		if err != nil || len(b) != signingKeySize {
+			return fmt.Errorf("%s: signing key must be %d hex bytes", k.SigningKeyFile, signingKeySize)
+		}
+		k.signing = b
+	}
+	return checkScopes(k.Scopes)
+}
+
+// checkScopes validates the scopes of a key or identity.
+func checkScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return errors.New("at least one scope is required")
+	}
+	for _, s := range scopes {
+		if s != ScopeSend && s != ScopeRender && s != ScopeAdmin {
+			return fmt.Errorf("unknown scope %q", s)
+		}
+	}
+	return nil
+}
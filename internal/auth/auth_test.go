@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeKeys(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegistry_Authorize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	writeKeys(t, path, `{"keys":[
+		{"name":"herald","hash":"`+Hash("h-secret")+`","scopes":["send"]},
+		{"name":"ops","hash":"sha256:`+Hash("o-secret")+`","scopes":["admin","send"]},
+		{"name":"old","hash":"`+Hash("x-secret")+`","scopes":["send"],"expires_at":"2020-01-01T00:00:00Z"}
+	]}`)
+	r, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	cases := []struct {
+		secret, scope, name string
+		err                 error
+	}{
+		{"h-secret", ScopeSend, "herald", nil},
+		{"h-secret", ScopeAdmin, "herald", ErrForbidden},
+		{"o-secret", ScopeAdmin, "ops", nil},
+		{"x-secret", ScopeSend, "old", ErrExpired},
+		{"nope", ScopeSend, "", ErrInvalid},
+		{"", ScopeSend, "", ErrMissing},
+	}
+	for _, tc := range cases {
+		name, err := r.Authorize(tc.secret, tc.scope, now)
+		if name != tc.name || !errors.Is(err, tc.err) {
+			t.Errorf("Authorize(%q, %q) = %q, %v; want %q, %v", tc.secret, tc.scope, name, err, tc.name, tc.err)
+		}
+	}
+}
+
+func TestRegistry_RotationAndReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	writeKeys(t, path, `{"keys":[{"name":"herald","hash":"`+Hash("v1")+`","scopes":["send"]}]}`)
+	r, err := Open(path, SharedKey("shared")...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Rotation: both the old and the new secret are valid until the old one is removed.
+	writeKeys(t, path, `{"keys":[
+		{"name":"herald","hash":"`+Hash("v1")+`","scopes":["send"]},
+		{"name":"herald","hash":"`+Hash("v2")+`","scopes":["send"]}
+	]}`)
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"v1", "v2", "shared"} {
+		if _, err := r.Authorize(s, ScopeSend, time.Now()); err != nil {
+			t.Errorf("Authorize(%q) after rotation: %v", s, err)
+		}
+	}
+	// A broken file keeps the current keys.
+	writeKeys(t, path, `{"keys":[{"name":"herald","hash":"zz","scopes":["send"]}]}`)
+	if err := r.Reload(); err == nil {
+		t.Error("Reload accepted an invalid hash")
+	}
+	if _, err := r.Authorize("v2", ScopeSend, time.Now()); err != nil {
+		t.Errorf("keys lost after failed reload: %v", err)
+	}
+}
+
+func TestOpen_Invalid(t *testing.T) {
+	for _, k := range []Key{
+		{Hash: Hash("s"), Scopes: []string{ScopeSend}},
+		{Name: "a", Hash: "abc", Scopes: []string{ScopeSend}},
+		{Name: "a", Hash: Hash("s")},
+		{Name: "a", Hash: Hash("s"), Scopes: []string{"everything"}},
+	} {
+		if _, err := Open("", k); err == nil {
+			t.Errorf("Open accepted %+v", k)
+		}
+	}
+	if _, err := Open(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("Open accepted a missing keys file")
+	}
+}
+
+func TestRegistry_Disabled(t *testing.T) {
+	var nilReg *Registry
+	empty, _ := Open("", SharedKey("")...)
+	for _, r := range []*Registry{nilReg, empty} {
+		if name, err := r.Authorize("", ScopeAdmin, time.Now()); name != "" || err != nil {
+			t.Errorf("Authorize on empty registry = %q, %v; want \"\", nil", name, err)
+		}
+	}
+}
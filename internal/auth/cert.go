@@ -0,0 +1,150 @@
+package auth
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// ErrCertIdentity is returned for a client certificate that matches no identity.
+var ErrCertIdentity = errors.New("client certificate not allowed")
+
+// Identity maps client certificates to a caller. A certificate matches when its subject
+// (in RFC 2253 form, e.g. "CN=herald,O=Example") is one of Subjects or one of its SANs
+// (DNS name, email address, IP address or URI) is one of SANs.
+type Identity struct {
+	Name     string   `json:"name"`
+	Subjects []string `json:"subjects"`
+	SANs     []string `json:"sans"`
+	Scopes   []string `json:"scopes"`
+}
+
+// Allows reports whether id was granted scope.
+func (id *Identity) Allows(scope string) bool {
+	return contains(id.Scopes, scope)
+}
+
+func (id *Identity) matches(cert *x509.Certificate) bool {
+	if contains(id.Subjects, cert.Subject.String()) {
+		return true
+	}
+	for _, san := range certSANs(cert) {
+		if contains(id.SANs, san) {
+			return true
+		}
+	}
+	return false
+}
+
+// certSANs lists the subject alternative names of cert as strings.
+func certSANs(cert *x509.Certificate) []string {
+	sans := append([]string{}, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, u := range cert.URIs {
+		sans = append(sans, u.String())
+	}
+	return sans
+}
+
+// identitiesFile is the format of the client certificate identities file.
+type identitiesFile struct {
+	Identities []Identity `json:"identities"`
+}
+
+// CertIdentities holds the client certificate identities read from a JSON file. A nil or
+// empty CertIdentities allows every verified certificate and identifies none.
+type CertIdentities struct {
+	path string
+
+	mu         sync.RWMutex
+	identities []Identity
+}
+
+// OpenCertIdentities reads the identities file at path.
+func OpenCertIdentities(path string) (*CertIdentities, error) {
+	ci := &CertIdentities{path: path}
+	if err := ci.Reload(); err != nil {
+		return nil, err
+	}
+	return ci, nil
+}
+
+// Reload re-reads the identities file. On error the current identities are kept.
+func (ci *CertIdentities) Reload() error {
+	b, err := os.ReadFile(ci.path)
+	if err != nil {
+		return err
+	}
+	var f identitiesFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return fmt.Errorf("%s: %w", ci.path, err)
+	}
+	for i, id := range f.Identities {
+		switch {
+		case id.Name == "":
+			return fmt.Errorf("identity %d: name is required", i)
+		case len(id.Subjects) == 0 && len(id.SANs) == 0:
+			return fmt.Errorf("identity %d (%q): subjects or sans is required", i, id.Name)
+		}
+		if err := checkScopes(id.Scopes); err != nil {
+			return fmt.Errorf("identity %d (%q): %w", i, id.Name, err)
+		}
+	}
+	ci.mu.Lock()
+	ci.identities = f.Identities
+	ci.mu.Unlock()
+	return nil
+}
+
+// Len returns the number of identities.
+func (ci *CertIdentities) Len() int {
+	if ci == nil {
+		return 0
+	}
+	ci.mu.RLock()
+	defer ci.mu.RUnlock()
+	return len(ci.identities)
+}
+
+// Match returns the first identity cert matches, or nil.
+func (ci *CertIdentities) Match(cert *x509.Certificate) *Identity {
+	if ci == nil || cert == nil {
+		return nil
+	}
+	ci.mu.RLock()
+	defer ci.mu.RUnlock()
+	for i := range ci.identities {
+		if ci.identities[i].matches(cert) {
+			id := ci.identities[i]
+			return &id
+		}
+	}
+	return nil
+}
+
+// Verify is the TLS handshake allowlist: with identities configured, a certificate must
+// match one of them.
+func (ci *CertIdentities) Verify(cert *x509.Certificate) error {
+	if ci.Len() == 0 || ci.Match(cert) != nil {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrCertIdentity, cert.Subject)
+}
+
+// Authorize returns the name of the identity of cert if it holds scope.
+func (ci *CertIdentities) Authorize(cert *x509.Certificate, scope string) (string, error) {
+	id := ci.Match(cert)
+	switch {
+	case id == nil:
+		return "", ErrCertIdentity
+	case !id.Allows(scope):
+		return id.Name, ErrForbidden
+	}
+	return id.Name, nil
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net"
+	"net/url"
+	"path/filepath"
+	"testing"
+)
+
+func TestCertIdentities(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identities.json")
+	writeKeys(t, path, `{"identities":[
+		{"name":"herald","sans":["spiffe://example.org/herald","herald.internal"],"scopes":["send"]},
+		{"name":"ops","subjects":["CN=ops,O=Example"],"scopes":["admin","send"]}
+	]}`)
+	ci, err := OpenCertIdentities(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spiffe, _ := url.Parse("spiffe://example.org/herald")
+	cases := []struct {
+		name  string
+		cert  *x509.Certificate
+		scope string
+		want  string
+		err   error
+	}{
+		{"URI SAN", &x509.Certificate{URIs: []*url.URL{spiffe}}, ScopeSend, "herald", nil},
+		{"DNS SAN", &x509.Certificate{DNSNames: []string{"herald.internal"}}, ScopeSend, "herald", nil},
+		{"scope", &x509.Certificate{DNSNames: []string{"herald.internal"}}, ScopeAdmin, "herald", ErrForbidden},
+		{"subject", &x509.Certificate{Subject: pkix.Name{CommonName: "ops", Organization: []string{"Example"}}}, ScopeAdmin, "ops", nil},
+		{"unknown", &x509.Certificate{Subject: pkix.Name{CommonName: "ops"}, IPAddresses: []net.IP{net.IPv4(10, 0, 0, 1)}}, ScopeSend, "", ErrCertIdentity},
+	}
+	for _, tc := range cases {
+		name, err := ci.Authorize(tc.cert, tc.scope)
+		if name != tc.want || !errors.Is(err, tc.err) {
+			t.Errorf("%s: Authorize = %q, %v; want %q, %v", tc.name, name, err, tc.want, tc.err)
+		}
+		if verr := ci.Verify(tc.cert); (verr == nil) != (tc.want != "") {
+			t.Errorf("%s: Verify = %v", tc.name, verr)
+		}
+	}
+
+	// Without identities every verified certificate passes the handshake allowlist.
+	var none *CertIdentities
+	if err := none.Verify(&x509.Certificate{}); err != nil {
+		t.Errorf("Verify without identities = %v", err)
+	}
+
+	for _, bad := range []string{
+		`{"identities":[{"sans":["a"],"scopes":["send"]}]}`,
+		`{"identities":[{"name":"a","scopes":["send"]}]}`,
+		`{"identities":[{"name":"a","sans":["a"],"scopes":["everything"]}]}`,
+	} {
+		writeKeys(t, path, bad)
+		if err := ci.Reload(); err == nil {
+			t.Errorf("Reload accepted %s", bad)
+		}
+	}
+	if ci.Len() != 2 {
+		t.Errorf("identities lost after failed reload: Len = %d", ci.Len())
+	}
+}
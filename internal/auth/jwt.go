@@ -0,0 +1,511 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // SHA-256 for RS256, PS256 and ES256
+	_ "crypto/sha512" // SHA-384 and SHA-512 for the 384 and 512 variants
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net/mail"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrToken        = errors.New("invalid bearer token")
+	ErrTokenExpired = errors.New("bearer token expired")
+)
+
+// JWTConfig configures bearer token validation. Issuer and Audience are checked when set.
+// Subjects, when set, lists the sub claims accepted. TemplatesClaim names the claim that
+// lists the templates a token may send; tokens without it may send any template.
+// SendersClaim names the claim that lists the From addresses a token may send as; tokens
+// without it may use the configured sender.
+type JWTConfig struct {
+	JWKSFile       string
+	Issuer         string
+	Audience       string
+	Leeway         time.Duration
+	Subjects       []string
+	TemplatesClaim string
+	SendersClaim   string
+}
+
+// Claims are the claims of a validated bearer token that herald-smtp acts on. A nil
+// Templates allows every template and free-form content; a nil Senders allows every
+// sender.
+type Claims struct {
+	Subject   string
+	Templates []string
+	Senders   []string
+}
+
+// TemplatesOnly reports whether c restricts its sends to named templates, so a request
+// may not carry its own subject or body.
+func (c *Claims) TemplatesOnly() bool {
+	return c != nil && c.Templates != nil
+}
+
+// AllowsSender reports whether c may send as from, an address optionally with a display
+// name. Addresses compare case-insensitively.
+func (c *Claims) AllowsSender(from string) bool {
+	if c == nil || c.Senders == nil {
+		return true
+	}
+	for _, s := range c.Senders {
+		if strings.EqualFold(address(s), address(from)) {
+			return true
+		}
+	}
+	return false
+}
+
+// address returns the bare address of s ("Name <a@b>" or "a@b").
+func address(s string) string {
+	if a, err := mail.ParseAddress(s); err == nil {
+		return a.Address
+	}
+	return strings.TrimSpace(s)
+}
+
+// AllowsTemplate reports whether c may send template.
+func (c *Claims) AllowsTemplate(template string) bool {
+	if c == nil || c.Templates == nil {
+		return true
+	}
+	for _, t := range c.Templates {
+		if t == template {
+			return true
+		}
+	}
+	return false
+}
+
+// JWTVerifier validates bearer JWTs against the public keys of a local JWKS file. Tokens
+// only ever grant ScopeSend.
+type JWTVerifier struct {
+	cfg JWTConfig
+
+	mu   sync.RWMutex
+	keys []publicKey
+	stat fileStamp
+
+	stop      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+type publicKey struct {
+	kid string
+	alg string // empty when the JWK does not restrict it
+	key crypto.PublicKey
+}
+
+// fileStamp identifies a version of the JWKS file.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// OpenJWKS loads cfg.JWKSFile. A file without any usable signing key is an error.
+func OpenJWKS(cfg JWTConfig) (*JWTVerifier, error) {
+	v := &JWTVerifier{cfg: cfg, stop: make(chan struct{})}
+	if err := v.Reload(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Reload re-reads the JWKS file. On error the current keys are kept.
+func (v *JWTVerifier) Reload() error {
+	fi, err := os.Stat(v.cfg.JWKSFile)
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(v.cfg.JWKSFile)
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(b)
+	if err != nil {
+		return fmt.Errorf("%s: %w", v.cfg.JWKSFile, err)
+	}
+	v.mu.Lock()
+	v.keys = keys
+	v.stat = fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+	v.mu.Unlock()
+	return nil
+}
+
+// Len returns the number of signing keys.
+func (v *JWTVerifier) Len() int {
+	if v == nil {
+		return 0
+	}
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return len(v.keys)
+}
+
+// Watch reloads the JWKS file every interval when its modification time or size changed,
+// until Close. onReload, when set, receives the outcome of each reload.
+func (v *JWTVerifier) Watch(interval time.Duration, onReload func(error)) {
+	if v == nil || interval <= 0 {
+		return
+	}
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-v.stop:
+				return
+			case <-t.C:
+				fi, err := os.Stat(v.cfg.JWKSFile)
+				if err == nil {
+					v.mu.RLock()
+					same := v.stat == fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+					v.mu.RUnlock()
+					if same {
+						continue
+					}
+					err = v.Reload()
+				}
+				if onReload != nil {
+					onReload(err)
+				}
+			}
+		}
+	}()
+}
+
+// Close stops Watch.
+func (v *JWTVerifier) Close() {
+	if v == nil {
+		return
+	}
+	v.closeOnce.Do(func() { close(v.stop) })
+	v.wg.Wait()
+}
+
+// jwtHeader is the JOSE header of a token.
+type jwtHeader struct {
+	Alg  string   `json:"alg"`
+	Kid  string   `json:"kid"`
+	Crit []string `json:"crit"`
+}
+
+// Verify validates token (signature, exp, nbf, iss, aud and sub) for scope.
+func (v *JWTVerifier) Verify(token, scope string, now time.Time) (*Claims, error) {
+	if v == nil {
+		return nil, ErrToken
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed", ErrToken)
+	}
+	var hdr jwtHeader
+	if err := decodeSegment(parts[0], &hdr); err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrToken, err)
+	}
+	if len(hdr.Crit) > 0 {
+		return nil, fmt.Errorf("%w: unsupported critical header %q", ErrToken, hdr.Crit[0])
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature encoding", ErrToken)
+	}
+	if !v.verifySignature(hdr, parts[0]+"."+parts[1], sig) {
+		return nil, fmt.Errorf("%w: signature", ErrToken)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: claims encoding", ErrToken)
+	}
+	return v.checkClaims(payload, scope, now)
+}
+
+// verifySignature checks sig with the key named by the header kid or, without a kid,
+// every key usable with the header alg.
+func (v *JWTVerifier) verifySignature(hdr jwtHeader, signed string, sig []byte) bool {
+	hash, ok := algHash(hdr.Alg)
+	if !ok {
+		return false
+	}
+	var digest []byte
+	if hash != 0 {
+		h := hash.New()
+		h.Write([]byte(signed))
+		digest = h.Sum(nil)
+	}
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	for _, k := range v.keys {
+		if (hdr.Kid != "" && k.kid != hdr.Kid) || (k.alg != "" && k.alg != hdr.Alg) {
+			continue
+		}
+		if verifyAlg(hdr.Alg, hash, k.key, signed, digest, sig) {
+			return true
+		}
+	}
+	return false
+}
+
+// algHash returns the hash of a supported JWS algorithm; EdDSA signs the message itself.
+func algHash(alg string) (crypto.Hash, bool) {
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		return crypto.SHA256, true
+	case "RS384", "PS384", "ES384":
+		return crypto.SHA384, true
+	case "RS512", "PS512", "ES512":
+		return crypto.SHA512, true
+	case "EdDSA":
+		return 0, true
+	}
+	return 0, false
+}
+
+func verifyAlg(alg string, hash crypto.Hash, key crypto.PublicKey, signed string, digest, sig []byte) bool {
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(pub, hash, digest, sig) == nil
+		case "PS":
+			return rsa.VerifyPSS(pub, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+		}
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if alg[:2] != "ES" || curveAlg(pub.Curve) != alg || len(sig) != 2*size {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(pub, digest, r, s)
+	case ed25519.PublicKey:
+		return alg == "EdDSA" && ed25519.Verify(pub, []byte(signed), sig)
+	}
+	return false
+}
+
+func curveAlg(c elliptic.Curve) string {
+	switch c {
+	case elliptic.P256():
+		return "ES256"
+	case elliptic.P384():
+		return "ES384"
+	case elliptic.P521():
+		return "ES512"
+	}
+	return ""
+}
+
+// checkClaims validates the registered claims and extracts the ones herald-smtp uses.
+func (v *JWTVerifier) checkClaims(payload []byte, scope string, now time.Time) (*Claims, error) {
+	var std struct {
+		Iss string          `json:"iss"`
+		Sub string          `json:"sub"`
+		Aud json.RawMessage `json:"aud"`
+		Exp *float64        `json:"exp"`
+		Nbf *float64        `json:"nbf"`
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &std); err != nil {
+		return nil, fmt.Errorf("%w: claims: %v", ErrToken, err)
+	}
+	if err := json.Unmarshal(payload, &raw); err != nil {
+		return nil, fmt.Errorf("%w: claims: %v", ErrToken, err)
+	}
+	leeway := v.cfg.Leeway
+	switch {
+	case std.Exp == nil:
+		return nil, fmt.Errorf("%w: exp is required", ErrToken)
+	case !validUnixTime(*std.Exp) || std.Nbf != nil && !validUnixTime(*std.Nbf):
+		return nil, fmt.Errorf("%w: exp or nbf out of range", ErrToken)
+	case now.After(unixTime(*std.Exp).Add(leeway)):
+		return nil, ErrTokenExpired
+	case std.Nbf != nil && now.Add(leeway).Before(unixTime(*std.Nbf)):
+		return nil, fmt.Errorf("%w: not valid yet", ErrToken)
+	case v.cfg.Issuer != "" && std.Iss != v.cfg.Issuer:
+		return nil, fmt.Errorf("%w: issuer %q", ErrToken, std.Iss)
+	case v.cfg.Audience != "" && !hasAudience(std.Aud, v.cfg.Audience):
+		return nil, fmt.Errorf("%w: audience", ErrToken)
+	case std.Sub == "":
+		return nil, fmt.Errorf("%w: sub is required", ErrToken)
+	case len(v.cfg.Subjects) > 0 && !contains(v.cfg.Subjects, std.Sub):
+		return nil, fmt.Errorf("%w: subject %q not allowed", ErrForbidden, std.Sub)
+	case scope != ScopeSend:
+		return nil, ErrForbidden
+	}
+	claims := &Claims{Subject: std.Sub}
+	if t, ok := raw[v.cfg.TemplatesClaim]; ok && v.cfg.TemplatesClaim != "" {
+		list, err := stringList(t)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s claim: %v", ErrToken, v.cfg.TemplatesClaim, err)
+		}
+		claims.Templates = list
+	}
+	if s, ok := raw[v.cfg.SendersClaim]; ok && v.cfg.SendersClaim != "" {
+		list, err := stringList(s)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s claim: %v", ErrToken, v.cfg.SendersClaim, err)
+		}
+		claims.Senders = list
+	}
+	return claims, nil
+}
+
+// maxUnixTime is the latest exp or nbf, in seconds, that fits a time.Duration since 1970.
+const maxUnixTime = math.MaxInt64 / float64(time.Second)
+
+// validUnixTime reports whether sec is a NumericDate unixTime can convert without overflow.
+func validUnixTime(sec float64) bool {
+	return sec >= 0 && sec <= maxUnixTime
+}
+
+func unixTime(sec float64) time.Time {
+	return time.Unix(0, 0).Add(time.Duration(sec * float64(time.Second)))
+}
+
+// hasAudience reports whether the aud claim, a string or an array of strings, holds want.
+func hasAudience(aud json.RawMessage, want string) bool {
+	list, err := stringList(aud)
+	return err == nil && contains(list, want)
+}
+
+// stringList decodes an array of strings or a space-separated string. The result is
+// never nil, so an empty list still restricts.
+func stringList(raw json.RawMessage) ([]string, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return append([]string{}, strings.Fields(s)...), nil
+	}
+	list := []string{}
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, errors.New("must be a string or an array of strings")
+	}
+	return list, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeSegment(seg string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// minRSABits is the smallest RSA modulus accepted from a JWKS.
+const minRSABits = 2048
+
+// jwk is a JSON Web Key; only public signing keys are used.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS decodes a JWK Set. Keys for encryption and key types other than RSA, EC and
+// OKP (Ed25519) are skipped; malformed signing keys and RSA keys under 2048 bits are an error.
+func parseJWKS(b []byte) ([]publicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, err
+	}
+	var keys []publicKey
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %d (%q): %w", i, k.Kid, err)
+		}
+		if pub == nil {
+			continue
+		}
+		if _, ok := algHash(k.Alg); k.Alg != "" && !ok {
+			return nil, fmt.Errorf("key %d (%q): unsupported alg %q", i, k.Kid, k.Alg)
+		}
+		keys = append(keys, publicKey{kid: k.Kid, alg: k.Alg, key: pub})
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys")
+	}
+	return keys, nil
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA n or e")
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if pub.N.BitLen() < minRSABits {
+			return nil, fmt.Errorf("RSA modulus is %d bits, need at least %d", pub.N.BitLen(), minRSABits)
+		}
+		return pub, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+		y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+		size := (curve.Params().BitSize + 7) / 8
+		if err1 != nil || err2 != nil || len(x) != size || len(y) != size {
+			return nil, errors.New("invalid EC x or y")
+		}
+		pub, err := ecdsa.ParseUncompressedPublicKey(curve, append(append([]byte{4}, x...), y...))
+		if err != nil {
+			return nil, err
+		}
+		return pub, nil
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,269 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var b64 = base64.RawURLEncoding
+
+type testSigner struct {
+	kid, alg string
+	sign     func(signed []byte) []byte
+	jwk      map[string]string
+}
+
+func rsaSigner(t *testing.T, kid string) testSigner {
+	t.Helper()
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testSigner{kid: kid, alg: "RS256",
+		sign: func(signed []byte) []byte {
+			sum := sha256.Sum256(signed)
+			sig, _ := rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum[:])
+			return sig
+		},
+		jwk: map[string]string{"kty": "RSA", "kid": kid, "n": b64.EncodeToString(k.N.Bytes()), "e": "AQAB"},
+	}
+}
+
+func ecSigner(t *testing.T, kid string) testSigner {
+	t.Helper()
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pt, _ := k.PublicKey.Bytes()
+	return testSigner{kid: kid, alg: "ES256",
+		sign: func(signed []byte) []byte {
+			sum := sha256.Sum256(signed)
+			r, s, _ := ecdsa.Sign(rand.Reader, k, sum[:])
+			sig := make([]byte, 64)
+			r.FillBytes(sig[:32])
+			s.FillBytes(sig[32:])
+			return sig
+		},
+		jwk: map[string]string{"kty": "EC", "kid": kid, "crv": "P-256", "x": b64.EncodeToString(pt[1:33]), "y": b64.EncodeToString(pt[33:])},
+	}
+}
+
+func edSigner(t *testing.T, kid string) testSigner {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testSigner{kid: kid, alg: "EdDSA",
+		sign: func(signed []byte) []byte { return ed25519.Sign(priv, signed) },
+		jwk:  map[string]string{"kty": "OKP", "kid": kid, "crv": "Ed25519", "x": b64.EncodeToString(pub)},
+	}
+}
+
+func (s testSigner) token(claims map[string]any) string {
+	h, _ := json.Marshal(map[string]string{"alg": s.alg, "kid": s.kid, "typ": "JWT"})
+	c, _ := json.Marshal(claims)
+	signed := b64.EncodeToString(h) + "." + b64.EncodeToString(c)
+	return signed + "." + b64.EncodeToString(s.sign([]byte(signed)))
+}
+
+func writeJWKS(t *testing.T, path string, signers ...testSigner) {
+	t.Helper()
+	keys := []map[string]string{{"kty": "oct", "kid": "hmac", "k": "c2VjcmV0"}} // skipped
+	for _, s := range signers {
+		keys = append(keys, s.jwk)
+	}
+	b, _ := json.Marshal(map[string]any{"keys": keys})
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJWTVerifier_Verify(t *testing.T) {
+	rs, es, ed := rsaSigner(t, "rs"), ecSigner(t, "es"), edSigner(t, "ed")
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path, rs, es, ed)
+	v, err := OpenJWKS(JWTConfig{
+		JWKSFile: path, Issuer: "https://issuer", Audience: "herald-smtp", Leeway: time.Minute,
+		Subjects: []string{"herald", "billing"}, TemplatesClaim: "templates",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	claims := func(extra map[string]any) map[string]any {
+		c := map[string]any{"iss": "https://issuer", "aud": []string{"other", "herald-smtp"}, "sub": "herald", "exp": now.Add(time.Hour).Unix()}
+		for k, v := range extra {
+			c[k] = v
+		}
+		return c
+	}
+	other := edSigner(t, "ed")
+	cases := []struct {
+		name  string
+		token string
+		scope string
+		err   error
+	}{
+		{"RS256", rs.token(claims(nil)), ScopeSend, nil},
+		{"ES256", es.token(claims(nil)), ScopeSend, nil},
+		{"EdDSA", ed.token(claims(map[string]any{"aud": "herald-smtp"})), ScopeSend, nil},
+		{"unknown key", other.token(claims(nil)), ScopeSend, ErrToken},
+		{"expired", rs.token(claims(map[string]any{"exp": now.Add(-2 * time.Minute).Unix()})), ScopeSend, ErrTokenExpired},
+		{"within leeway", rs.token(claims(map[string]any{"exp": now.Add(-30 * time.Second).Unix()})), ScopeSend, nil},
+		{"no exp", rs.token(claims(map[string]any{"exp": nil})), ScopeSend, ErrToken},
+		{"not yet valid", rs.token(claims(map[string]any{"nbf": now.Add(time.Hour).Unix()})), ScopeSend, ErrToken},
+		{"huge nbf", rs.token(claims(map[string]any{"nbf": 1e19})), ScopeSend, ErrToken},
+		{"huge exp", rs.token(claims(map[string]any{"exp": 1e300})), ScopeSend, ErrToken},
+		{"issuer", rs.token(claims(map[string]any{"iss": "https://evil"})), ScopeSend, ErrToken},
+		{"audience", rs.token(claims(map[string]any{"aud": "other"})), ScopeSend, ErrToken},
+		{"subject", rs.token(claims(map[string]any{"sub": "marketing"})), ScopeSend, ErrForbidden},
+		{"admin scope", rs.token(claims(nil)), ScopeAdmin, ErrForbidden},
+		{"malformed", "not.a-token", ScopeSend, ErrToken},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := v.Verify(tc.token, tc.scope, now)
+			if !errors.Is(err, tc.err) {
+				t.Errorf("Verify = %v, want %v", err, tc.err)
+			}
+		})
+	}
+
+	// alg "none" and an algorithm that does not match the key are rejected.
+	h, _ := json.Marshal(map[string]string{"alg": "none", "kid": "rs"})
+	unsigned := b64.EncodeToString(h) + "." + b64.EncodeToString([]byte(`{"sub":"herald"}`)) + "."
+	if _, err := v.Verify(unsigned, ScopeSend, now); !errors.Is(err, ErrToken) {
+		t.Errorf("alg none accepted: %v", err)
+	}
+	confused := testSigner{kid: "es", alg: "RS256", sign: rs.sign}
+	if _, err := v.Verify(confused.token(claims(nil)), ScopeSend, now); !errors.Is(err, ErrToken) {
+		t.Errorf("RS256 token verified with an EC key: %v", err)
+	}
+}
+
+func TestJWTVerifier_Templates(t *testing.T) {
+	ed := edSigner(t, "ed")
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path, ed)
+	v, err := OpenJWKS(JWTConfig{JWKSFile: path, TemplatesClaim: "templates"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+	cases := []struct {
+		templates any
+		template  string
+		want      bool
+	}{
+		{nil, "anything", true},
+		{[]string{"login", "reset"}, "reset", true},
+		{[]string{"login", "reset"}, "welcome", false},
+		{"login reset", "login", true},
+		{[]string{}, "login", false},
+	}
+	for _, tc := range cases {
+		c := map[string]any{"sub": "herald", "exp": exp}
+		if tc.templates != nil {
+			c["templates"] = tc.templates
+		}
+		claims, err := v.Verify(ed.token(c), ScopeSend, time.Now())
+		if err != nil {
+			t.Fatalf("Verify(templates=%v): %v", tc.templates, err)
+		}
+		if got := claims.AllowsTemplate(tc.template); got != tc.want || claims.Subject != "herald" {
+			t.Errorf("templates=%v: AllowsTemplate(%q) = %v, want %v", tc.templates, tc.template, got, tc.want)
+		}
+	}
+}
+
+func TestClaims_AllowsSender(t *testing.T) {
+	cases := []struct {
+		claims *Claims
+		from   string
+		want   bool
+	}{
+		{nil, "a@example.com", true},
+		{&Claims{}, "a@example.com", true},
+		{&Claims{Senders: []string{"A@Example.com"}}, "Herald <a@example.com>", true},
+		{&Claims{Senders: []string{"a@example.com"}}, "b@example.com", false},
+		{&Claims{Senders: []string{}}, "a@example.com", false},
+	}
+	for _, tc := range cases {
+		if got := tc.claims.AllowsSender(tc.from); got != tc.want {
+			t.Errorf("%+v.AllowsSender(%q) = %v, want %v", tc.claims, tc.from, got, tc.want)
+		}
+	}
+}
+
+func TestJWTVerifier_Reload(t *testing.T) {
+	oldKey, newKey := edSigner(t, "k1"), edSigner(t, "k2")
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path, oldKey)
+	v, err := OpenJWKS(JWTConfig{JWKSFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded := make(chan error, 1)
+	v.Watch(10*time.Millisecond, func(err error) {
+		select {
+		case reloaded <- err:
+		default:
+		}
+	})
+	defer v.Close()
+
+	claims := map[string]any{"sub": "herald", "exp": time.Now().Add(time.Hour).Unix()}
+	writeJWKS(t, path, oldKey, newKey)
+	// Ensure the modification time moves even on coarse-grained file systems.
+	future := time.Now().Add(time.Second)
+	_ = os.Chtimes(path, future, future)
+	select {
+	case err := <-reloaded:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("JWKS change not picked up")
+	}
+	if _, err := v.Verify(newKey.token(claims), ScopeSend, time.Now()); err != nil {
+		t.Errorf("new key after reload: %v", err)
+	}
+
+	// A broken file keeps the current keys.
+	if err := os.WriteFile(path, []byte(`{"keys":[]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Reload(); err == nil {
+		t.Error("Reload accepted a JWKS without signing keys")
+	}
+	if _, err := v.Verify(oldKey.token(claims), ScopeSend, time.Now()); err != nil {
+		t.Errorf("keys lost after failed reload: %v", err)
+	}
+}
+
+func TestOpenJWKS_RejectsShortRSAKey(t *testing.T) {
+	k, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	short := testSigner{jwk: map[string]string{"kty": "RSA", "kid": "short", "n": b64.EncodeToString(k.N.Bytes()), "e": "AQAB"}}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path, rsaSigner(t, "ok"), short)
+	if _, err := OpenJWKS(JWTConfig{JWKSFile: path}); err == nil {
+		t.Error("OpenJWKS accepted a 1024-bit RSA key")
+	}
+}
@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"container/list"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Signed request headers.
+const (
+	HeaderKeyID     = "X-Key-Id"    // key name
+	HeaderTimestamp = "X-Timestamp" // Unix seconds
+	HeaderNonce     = "X-Nonce"     // unique per request
+	HeaderSignature = "X-Signature" // hex HMAC-SHA256 of the canonical request
+)
+
+var (
+	ErrSignature = errors.New("invalid request signature")
+	ErrStale     = errors.New("request timestamp outside the allowed window")
+	ErrReplay    = errors.New("request nonce already used")
+	ErrUnsigned  = errors.New("signed request required")
+	// ErrNoncesFull is returned while every remembered nonce is still live, so a new one
+	// cannot be recorded without forgetting one a replay could reuse.
+	ErrNoncesFull = errors.New("too many signed requests; try again later")
+)
+
+// Signature holds the signing headers of a request.
+type Signature struct {
+	KeyID     string
+	Timestamp string
+	Nonce     string
+	Signature string
+}
+
+// CanonicalRequest is the string a request signature covers: method, request URI (path
+// and query), timestamp, nonce and the hex SHA-256 of the body, joined by newlines.
+func CanonicalRequest(method, uri, timestamp, nonce string, body []byte) string {
+	sum := sha256.Sum256(body)
+	return strings.Join([]string{strings.ToUpper(method), uri, timestamp, nonce, hex.EncodeToString(sum[:])}, "\n")
+}
+
+// signingKeyInfo separates the signing key from other uses of the secret.
+const signingKeyInfo = "herald-smtp request signing"
+
+const signingKeySize = 32
+
+// signingKey derives the HMAC key of secret with HKDF-SHA256. The key hash in the keys
+// file reveals nothing about it, so reading that file is not enough to sign requests.
+func signingKey(secret string) []byte {
+	key, err := hkdf.Key(sha256.New, []byte(secret), nil, signingKeyInfo, signingKeySize)
+	if err != nil {
+		panic(err) // only for lengths HKDF-SHA256 cannot produce
+	}
+	return key
+}
+
+// SigningKey returns the hex HMAC key of secret, as stored in a key's signing_key_file.
+func SigningKey(secret string) string {
+	return hex.EncodeToString(signingKey(secret))
+}
+
+// Sign returns the X-Signature of a request sent with the API key secret.
+func Sign(secret, method, uri, timestamp, nonce string, body []byte) string {
+	return hex.EncodeToString(mac(signingKey(secret), CanonicalRequest(method, uri, timestamp, nonce, body)))
+}
+
+func mac(key []byte, canonical string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(canonical))
+	return m.Sum(nil)
+}
+
+// EnableSignatures accepts signed requests whose timestamp is within maxSkew of the server
+// clock. Nonces are remembered for twice that long, so a captured request cannot be
+// replayed. At most maxNonces are kept; while all of them are live, further signed
+// requests fail with ErrNoncesFull. Size maxNonces above the signed request rate times
+// twice maxSkew.
+func (r *Registry) EnableSignatures(maxSkew time.Duration, maxNonces int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.maxSkew = maxSkew
+	r.nonces = newNonceCache(2*maxSkew, maxNonces)
+}
+
+// Signatures reports whether signed requests are accepted.
+func (r *Registry) Signatures() bool {
+	if r == nil {
+		return false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.nonces != nil
+}
+
+// VerifySignature checks a signed request for scope with CheckSignature, records its
+// nonce and returns the key name.
+func (r *Registry) VerifySignature(sig Signature, method, uri string, body []byte, scope string, now time.Time) (string, error) {
+	name, err := r.CheckSignature(sig, method, uri, body, scope, now)
+	if err != nil {
+		return name, err
+	}
+	r.mu.RLock()
+	nonces := r.nonces
+	r.mu.RUnlock()
+	return name, nonces.add(name+"\n"+sig.Nonce, now)
+}
+
+// CheckSignature checks a signed request for scope without recording its nonce, e.g. to
+// check a request VerifySignature accepted against another scope. The signature is
+// compared in constant time against every key named sig.KeyID that has a signing key,
+// so keys being rotated can both sign.
+func (r *Registry) CheckSignature(sig Signature, method, uri string, body []byte, scope string, now time.Time) (string, error) {
+	if !r.Signatures() {
+		return "", ErrSignature
+	}
+	if sig.KeyID == "" || sig.Timestamp == "" || sig.Nonce == "" || sig.Signature == "" {
+		return "", ErrMissing
+	}
+	ts, err := strconv.ParseInt(sig.Timestamp, 10, 64)
+	if err != nil {
+		return sig.KeyID, ErrStale
+	}
+	r.mu.RLock()
+	maxSkew := r.maxSkew
+	if d := now.Sub(time.Unix(ts, 0)); d > maxSkew || d < -maxSkew {
+		r.mu.RUnlock()
+		return sig.KeyID, ErrStale
+	}
+	want, err := hex.DecodeString(sig.Signature)
+	canonical := CanonicalRequest(method, uri, sig.Timestamp, sig.Nonce, body)
+	var found *Key
+	for i := range r.keys {
+		k := &r.keys[i]
+		if k.Name != sig.KeyID || k.signing == nil {
+			continue
+		}
+		if err == nil && hmac.Equal(mac(k.signing, canonical), want) && (found == nil || !k.expired(now)) {
+			found = k
+		}
+	}
+	r.mu.RUnlock()
+	switch {
+	case found == nil:
+		return sig.KeyID, ErrSignature
+	case found.expired(now):
+		return found.Name, ErrExpired
+	case !found.Allows(scope):
+		return found.Name, ErrForbidden
+	}
+	return found.Name, nil
+}
+
+// nonceCache remembers the nonces of recent signed requests.
+type nonceCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	seen       map[string]*list.Element
+	order      *list.List // *nonce, oldest first
+}
+
+type nonce struct {
+	key       string
+	expiresAt time.Time
+}
+
+// newNonceCache creates a cache; maxEntries <= 0 means 100000.
+func newNonceCache(ttl time.Duration, maxEntries int) *nonceCache {
+	if maxEntries <= 0 {
+		maxEntries = 100000
+	}
+	return &nonceCache{ttl: ttl, maxEntries: maxEntries, seen: make(map[string]*list.Element), order: list.New()}
+}
+
+// add records key. It returns ErrReplay when key was seen and ErrNoncesFull when the
+// cache holds maxEntries live nonces; live nonces are never dropped to make room.
+func (c *nonceCache) add(key string, now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for el := c.order.Front(); el != nil && now.After(el.Value.(*nonce).expiresAt); el = c.order.Front() {
+		c.remove(el)
+	}
+	if _, ok := c.seen[key]; ok {
+		return ErrReplay
+	}
+	if c.order.Len() >= c.maxEntries {
+		return ErrNoncesFull
+	}
+	c.seen[key] = c.order.PushBack(&nonce{key: key, expiresAt: now.Add(c.ttl)})
+	return nil
+}
+
+func (c *nonceCache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.seen, el.Value.(*nonce).key)
+}
@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// signingKeyFile writes the signing key of secret to a file and returns its path.
+func signingKeyFile(t *testing.T, secret string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), secret+".key")
+	if err := os.WriteFile(path, []byte(SigningKey(secret)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func signedRegistry(t *testing.T) *Registry {
+	t.Helper()
+	r, err := Open("",
+		Key{Name: "herald", Hash: Hash("old"), Scopes: []string{ScopeSend}, SigningKeyFile: signingKeyFile(t, "old")},
+		Key{Name: "herald", Hash: Hash("new"), Scopes: []string{ScopeSend}, SigningKeyFile: signingKeyFile(t, "new")},
+		Key{Name: "ops", Hash: Hash("ops"), Scopes: []string{ScopeAdmin}, SigningKeyFile: signingKeyFile(t, "ops")},
+		Key{Name: "billing", Hash: Hash("billing"), Scopes: []string{ScopeSend}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.EnableSignatures(5*time.Minute, 0)
+	return r
+}
+
+func signed(secret, keyID, method, uri, nonce string, at time.Time, body []byte) Signature {
+	ts := strconv.FormatInt(at.Unix(), 10)
+	return Signature{KeyID: keyID, Timestamp: ts, Nonce: nonce, Signature: Sign(secret, method, uri, ts, nonce, body)}
+}
+
+func TestVerifySignature(t *testing.T) {
+	r := signedRegistry(t)
+	now := time.Now()
+	body := []byte(`{"to":"u@example.com"}`)
+	cases := []struct {
+		name string
+		sig  Signature
+		uri  string
+		body []byte
+		err  error
+	}{
+		{"valid", signed("new", "herald", "POST", "/v1/send", "n1", now, body), "/v1/send", body, nil},
+		{"rotated key", signed("old", "herald", "POST", "/v1/send", "n2", now, body), "/v1/send", body, nil},
+		{"replay", signed("new", "herald", "POST", "/v1/send", "n1", now, body), "/v1/send", body, ErrReplay},
+		{"tampered body", signed("new", "herald", "POST", "/v1/send", "n3", now, body), "/v1/send", []byte(`{"to":"x@example.com"}`), ErrSignature},
+		{"other path", signed("new", "herald", "POST", "/v1/send", "n4", now, body), "/v1/send/batch", body, ErrSignature},
+		{"wrong key id", signed("new", "ops", "POST", "/v1/send", "n5", now, body), "/v1/send", body, ErrSignature},
+		{"stale", signed("new", "herald", "POST", "/v1/send", "n6", now.Add(-10*time.Minute), body), "/v1/send", body, ErrStale},
+		{"future", signed("new", "herald", "POST", "/v1/send", "n7", now.Add(10*time.Minute), body), "/v1/send", body, ErrStale},
+		{"scope", signed("ops", "ops", "POST", "/v1/send", "n8", now, body), "/v1/send", body, ErrForbidden},
+		{"missing nonce", signed("new", "herald", "POST", "/v1/send", "", now, body), "/v1/send", body, ErrMissing},
+		{"no signing key", signed("billing", "billing", "POST", "/v1/send", "n9", now, body), "/v1/send", body, ErrSignature},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := r.VerifySignature(tc.sig, "POST", tc.uri, tc.body, ScopeSend, now)
+			if !errors.Is(err, tc.err) {
+				t.Errorf("VerifySignature = %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestCheckSignature_KeepsNonce(t *testing.T) {
+	r := signedRegistry(t)
+	now := time.Now()
+	sig := signed("ops", "ops", "GET", "/v1/messages/x", "n1", now, nil)
+	if _, err := r.CheckSignature(sig, "GET", "/v1/messages/x", nil, ScopeSend, now); !errors.Is(err, ErrForbidden) {
+		t.Errorf("CheckSignature(send) = %v, want ErrForbidden", err)
+	}
+	for range 2 {
+		if _, err := r.CheckSignature(sig, "GET", "/v1/messages/x", nil, ScopeAdmin, now); err != nil {
+			t.Errorf("CheckSignature(admin) = %v", err)
+		}
+	}
+	if _, err := r.VerifySignature(sig, "GET", "/v1/messages/x", nil, ScopeAdmin, now); err != nil {
+		t.Errorf("VerifySignature after CheckSignature = %v", err)
+	}
+}
+
+func TestVerifySignature_StoredHash(t *testing.T) {
+	r := signedRegistry(t)
+	now := time.Now()
+	body := []byte(`{"to":"u@example.com"}`)
+	ts := strconv.FormatInt(now.Unix(), 10)
+	// The hash in the keys file must not work as the HMAC key.
+	hash := sha256.Sum256([]byte("new"))
+	sig := Signature{KeyID: "herald", Timestamp: ts, Nonce: "n1",
+		Signature: hex.EncodeToString(mac(hash[:], CanonicalRequest("POST", "/v1/send", ts, "n1", body)))}
+	if _, err := r.VerifySignature(sig, "POST", "/v1/send", body, ScopeSend, now); !errors.Is(err, ErrSignature) {
+		t.Errorf("signature keyed with the stored hash = %v, want ErrSignature", err)
+	}
+}
+
+func TestSigningKey(t *testing.T) {
+	// Matches the openssl kdf command in the API docs.
+	const want = "3ade54f503d119ad1bd462b952217e6497dbbea060044eefb9e6f834caa3a219"
+	if got := SigningKey("s3cret"); got != want {
+		t.Errorf("SigningKey = %s, want %s", got, want)
+	}
+}
+
+func TestOpen_SigningKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.key")
+	if err := os.WriteFile(path, []byte("abcd"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{path, filepath.Join(t.TempDir(), "missing.key")} {
+		if _, err := Open("", Key{Name: "herald", Hash: Hash("s"), Scopes: []string{ScopeSend}, SigningKeyFile: file}); err == nil {
+			t.Errorf("Open accepted signing key file %s", file)
+		}
+	}
+}
+
+func TestVerifySignature_Disabled(t *testing.T) {
+	r, _ := Open("", SharedKey("secret")...)
+	now := time.Now()
+	sig := signed("secret", "default", "GET", "/v1/messages/x", "n", now, nil)
+	if _, err := r.VerifySignature(sig, "GET", "/v1/messages/x", nil, ScopeSend, now); !errors.Is(err, ErrSignature) {
+		t.Errorf("VerifySignature without EnableSignatures = %v, want ErrSignature", err)
+	}
+}
+
+func TestNonceCache(t *testing.T) {
+	c := newNonceCache(time.Minute, 2)
+	now := time.Now()
+	if c.add("a", now) != nil || !errors.Is(c.add("a", now), ErrReplay) {
+		t.Error("nonce a not recorded once")
+	}
+	_ = c.add("b", now)
+	if err := c.add("c", now); !errors.Is(err, ErrNoncesFull) {
+		t.Errorf("add to a cache full of live nonces = %v, want ErrNoncesFull", err)
+	}
+	if !errors.Is(c.add("a", now.Add(30*time.Second)), ErrReplay) {
+		t.Error("live nonce forgotten")
+	}
+	if err := c.add("c", now.Add(2*time.Minute)); err != nil {
+		t.Errorf("add after nonces expired = %v", err)
+	}
+	if c.add("a", now.Add(2*time.Minute)) != nil {
+		t.Error("expired nonce still remembered")
+	}
+}
@@ -0,0 +1,230 @@
+package breaker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrOpen is returned by Allow while the breaker rejects calls.
+var ErrOpen = errors.New("circuit breaker open: SMTP relay unavailable")
+
+// State is the breaker state.
+type State string
+
+const (
+	Closed   State = "closed"    // calls pass; outcomes are counted
+	Open     State = "open"      // calls fail fast until the cooldown ends
+	HalfOpen State = "half-open" // a few trial calls decide whether to close again
+)
+
+// Config configures a Breaker. Zero values get the defaults noted per field.
+type Config struct {
+	Window       int           // recent outcomes considered (20)
+	MinRequests  int           // outcomes needed before the breaker may open (10)
+	FailureRatio float64       // failure ratio in the window that opens the breaker (0.5)
+	OpenFor      time.Duration // cooldown before trying the relay again (30s)
+	HalfOpenMax  int           // trial calls in half-open; all must succeed to close (1)
+	// Probe, when set, checks the relay (e.g. connect and NOOP) at the end of each
+	// cooldown instead of letting a real send be the trial; success moves to half-open.
+	Probe        func(ctx context.Context) error
+	ProbeTimeout time.Duration // bound for one probe (10s)
+	// OnStateChange is called (outside the lock) after each transition.
+	OnStateChange func(from, to State)
+}
+
+// Breaker is a count-based circuit breaker around one SMTP relay.
+type Breaker struct {
+	cfg Config
+
+	mu       sync.Mutex
+	state    State
+	gen      uint64 // bumped on every transition; outcomes from older generations are ignored
+	outcomes []bool // ring buffer, true = failure
+	next     int
+	count    int
+	failures int
+	openedAt time.Time
+	trials   int // half-open: calls let through
+	passed   int // half-open: trials that succeeded
+	timer    *time.Timer
+	stopped  bool
+}
+
+// New creates a closed breaker.
+func New(cfg Config) *Breaker {
+	if cfg.Window <= 0 {
+		cfg.Window = 20
+	}
+	if cfg.MinRequests <= 0 {
+		cfg.MinRequests = 10
+	}
+	if cfg.MinRequests > cfg.Window {
+		cfg.MinRequests = cfg.Window
+	}
+	if cfg.FailureRatio <= 0 || cfg.FailureRatio > 1 {
+		cfg.FailureRatio = 0.5
+	}
+	if cfg.OpenFor <= 0 {
+		cfg.OpenFor = 30 * time.Second
+	}
+	if cfg.HalfOpenMax <= 0 {
+		cfg.HalfOpenMax = 1
+	}
+	if cfg.ProbeTimeout <= 0 {
+		cfg.ProbeTimeout = 10 * time.Second
+	}
+	return &Breaker{cfg: cfg, state: Closed, outcomes: make([]bool, cfg.Window)}
+}
+
+// Allow asks to make a call. On success the caller must report the outcome with done:
+// failure is true when the relay itself failed (connection errors, 4xx replies), not
+// when it rejected the message. While open it returns ErrOpen.
+func (b *Breaker) Allow() (done func(failure bool), err error) {
+	b.mu.Lock()
+	var changed func()
+	switch b.state {
+	case Open:
+		if b.cfg.Probe != nil || time.Since(b.openedAt) < b.cfg.OpenFor {
+			b.mu.Unlock()
+			return nil, ErrOpen
+		}
+		changed = b.setLocked(HalfOpen)
+		fallthrough
+	case HalfOpen:
+		if b.trials >= b.cfg.HalfOpenMax {
+			b.mu.Unlock()
+			notify(changed)
+			return nil, ErrOpen
+		}
+		b.trials++
+	}
+	gen := b.gen
+	b.mu.Unlock()
+	notify(changed)
+	var once sync.Once
+	return func(failure bool) {
+		once.Do(func() { b.record(gen, failure) })
+	}, nil
+}
+
+// State returns the current state.
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == Open && b.cfg.Probe == nil && time.Since(b.openedAt) >= b.cfg.OpenFor {
+		return HalfOpen
+	}
+	return b.state
+}
+
+// RetryAfter suggests how long callers should wait before trying again.
+func (b *Breaker) RetryAfter() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	wait := time.Second
+	if b.state == Open {
+		if left := b.cfg.OpenFor - time.Since(b.openedAt); left > wait {
+			wait = left
+		}
+	}
+	return wait
+}
+
+// Stop cancels a pending probe.
+func (b *Breaker) Stop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.stopped = true
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+}
+
+func (b *Breaker) record(gen uint64, failure bool) {
+	b.mu.Lock()
+	if gen != b.gen {
+		b.mu.Unlock()
+		return
+	}
+	var changed func()
+	switch b.state {
+	case Closed:
+		if b.count == len(b.outcomes) {
+			if b.outcomes[b.next] {
+				b.failures--
+			}
+		} else {
+			b.count++
+		}
+		b.outcomes[b.next] = failure
+		if failure {
+			b.failures++
+		}
+		b.next = (b.next + 1) % len(b.outcomes)
+		if b.count >= b.cfg.MinRequests && float64(b.failures)/float64(b.count) >= b.cfg.FailureRatio {
+			changed = b.setLocked(Open)
+		}
+	case HalfOpen:
+		if failure {
+			changed = b.setLocked(Open)
+		} else if b.passed++; b.passed >= b.cfg.HalfOpenMax {
+			changed = b.setLocked(Closed)
+		}
+	}
+	b.mu.Unlock()
+	notify(changed)
+}
+
+// probe runs cfg.Probe after a cooldown and moves to half-open on success.
+func (b *Breaker) probe() {
+	ctx, cancel := context.WithTimeout(context.Background(), b.cfg.ProbeTimeout)
+	err := b.cfg.Probe(ctx)
+	cancel()
+	b.mu.Lock()
+	if b.state != Open || b.stopped {
+		b.mu.Unlock()
+		return
+	}
+	var changed func()
+	if err == nil {
+		changed = b.setLocked(HalfOpen)
+	} else {
+		changed = b.setLocked(Open)
+	}
+	b.mu.Unlock()
+	notify(changed)
+}
+
+// setLocked moves to state and resets the counters of the new state. It returns the
+// state change notification to run once the lock is released.
+func (b *Breaker) setLocked(state State) func() {
+	from := b.state
+	b.state = state
+	b.gen++
+	b.trials, b.passed = 0, 0
+	switch state {
+	case Closed:
+		clear(b.outcomes)
+		b.next, b.count, b.failures = 0, 0, 0
+	case Open:
+		b.openedAt = time.Now()
+		if b.cfg.Probe != nil && !b.stopped {
+			if b.timer != nil {
+				b.timer.Stop()
+			}
+			b.timer = time.AfterFunc(b.cfg.OpenFor, b.probe)
+		}
+	}
+	if b.cfg.OnStateChange == nil {
+		return nil
+	}
+	return func() { b.cfg.OnStateChange(from, state) }
+}
+
+func notify(fn func()) {
+	if fn != nil {
+		fn()
+	}
+}
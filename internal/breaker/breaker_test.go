@@ -0,0 +1,118 @@
+package breaker
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func call(t *testing.T, b *Breaker, failure bool) error {
+	t.Helper()
+	done, err := b.Allow()
+	if err != nil {
+		return err
+	}
+	done(failure)
+	return nil
+}
+
+func TestBreaker_OpensOnFailureRatio(t *testing.T) {
+	b := New(Config{Window: 4, MinRequests: 4, FailureRatio: 0.5, OpenFor: time.Hour})
+	_ = call(t, b, false)
+	_ = call(t, b, false)
+	_ = call(t, b, true)
+	if b.State() != Closed {
+		t.Fatalf("state = %s before MinRequests, want closed", b.State())
+	}
+	_ = call(t, b, true)
+	if b.State() != Open {
+		t.Fatalf("state = %s at 2/4 failures, want open", b.State())
+	}
+	if err := call(t, b, false); !errors.Is(err, ErrOpen) {
+		t.Errorf("Allow while open err = %v, want ErrOpen", err)
+	}
+	if d := b.RetryAfter(); d < 59*time.Minute {
+		t.Errorf("RetryAfter = %s, want about the cooldown", d)
+	}
+}
+
+func TestBreaker_HalfOpenTrial(t *testing.T) {
+	var changes []State
+	b := New(Config{Window: 2, MinRequests: 2, OpenFor: 10 * time.Millisecond,
+		OnStateChange: func(from, to State) { changes = append(changes, to) }})
+	_ = call(t, b, true)
+	_ = call(t, b, true)
+	time.Sleep(20 * time.Millisecond)
+	if b.State() != HalfOpen {
+		t.Fatalf("state = %s after cooldown, want half-open", b.State())
+	}
+	done, err := b.Allow()
+	if err != nil {
+		t.Fatalf("trial Allow: %v", err)
+	}
+	if _, err := b.Allow(); !errors.Is(err, ErrOpen) {
+		t.Errorf("second concurrent trial err = %v, want ErrOpen", err)
+	}
+	done(true)
+	if b.State() != Open {
+		t.Fatalf("failed trial: state = %s, want open", b.State())
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := call(t, b, false); err != nil {
+		t.Fatalf("trial Allow: %v", err)
+	}
+	if b.State() != Closed {
+		t.Errorf("successful trial: state = %s, want closed", b.State())
+	}
+	want := []State{Open, HalfOpen, Open, HalfOpen, Closed}
+	if len(changes) != len(want) {
+		t.Fatalf("changes = %v, want %v", changes, want)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Errorf("change %d = %s, want %s", i, changes[i], want[i])
+		}
+	}
+}
+
+func TestBreaker_StaleOutcomeIgnored(t *testing.T) {
+	b := New(Config{Window: 1, MinRequests: 1, OpenFor: time.Hour})
+	stale, _ := b.Allow()
+	_ = call(t, b, true) // opens
+	stale(false)
+	if b.State() != Open {
+		t.Errorf("state = %s, outcome from before the transition must be ignored", b.State())
+	}
+}
+
+func TestBreaker_Probe(t *testing.T) {
+	var healthy atomic.Bool
+	var probes atomic.Int32
+	b := New(Config{Window: 1, MinRequests: 1, OpenFor: 10 * time.Millisecond,
+		Probe: func(ctx context.Context) error {
+			probes.Add(1)
+			if healthy.Load() {
+				return nil
+			}
+			return errors.New("connection refused")
+		}})
+	defer b.Stop()
+	_ = call(t, b, true)
+	time.Sleep(30 * time.Millisecond)
+	if b.State() != Open || probes.Load() == 0 {
+		t.Fatalf("state = %s probes = %d; failing probe should keep it open", b.State(), probes.Load())
+	}
+	if _, err := b.Allow(); !errors.Is(err, ErrOpen) {
+		t.Error("with a probe, cooldown alone must not let sends through")
+	}
+	healthy.Store(true)
+	deadline := time.Now().Add(2 * time.Second)
+	for b.State() != HalfOpen && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if b.State() != HalfOpen {
+		t.Fatalf("state = %s after successful probe, want half-open", b.State())
+	}
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"strings"
 	"time"
 
 	"github.com/soulteary/cli-kit/env"
@@ -17,6 +18,158 @@ var (
 	UseStartTLS = env.GetBool("SMTP_USE_STARTTLS", true)
 	LogLevel    = env.Get("LOG_LEVEL", "info")
 	IdemTTLSec  = env.GetInt("IDEMPOTENCY_TTL_SECONDS", 300)
+	// In-memory idempotency store bounds: entries beyond IdemMaxEntries evict the least
+	// recently used; expired entries are swept every IdemSweepSec seconds.
+	IdemMaxEntries = env.GetInt("IDEMPOTENCY_MAX_ENTRIES", 100000)
+	IdemSweepSec   = env.GetInt("IDEMPOTENCY_SWEEP_SECONDS", 60)
+	// IdemSnapshotFile keeps the in-memory store across restarts: it is loaded at startup
+	// and rewritten every IdemSnapshotSec seconds and on shutdown.
+	IdemSnapshotFile = env.Get("IDEMPOTENCY_SNAPSHOT_FILE", "")
+	IdemSnapshotSec  = env.GetInt("IDEMPOTENCY_SNAPSHOT_SECONDS", 30)
+	// IdemInProgress decides what a request does when another one with the same key is
+	// still running: "wait" (up to IdemWaitMs) for its result, or "reject" with 409.
+	IdemInProgress = env.Get("IDEMPOTENCY_IN_PROGRESS", "wait")
+	IdemWaitMs     = env.GetInt("IDEMPOTENCY_WAIT_MS", 35000)
+	// IdemCacheFailures selects which failed sends are cached under their idempotency key:
+	// "permanent" (a retry cannot succeed, e.g. 5xx replies), "all" or "none".
+	IdemCacheFailures = env.Get("IDEMPOTENCY_CACHE_FAILURES", "permanent")
+	// IdemDeriveKeys gives requests without an idempotency key one derived from their
+	// payload and the current IdemDeriveWindowSec window, suppressing double submits.
+	IdemDeriveKeys      = env.GetBool("IDEMPOTENCY_DERIVE_KEYS", false)
+	IdemDeriveWindowSec = env.GetInt("IDEMPOTENCY_DERIVE_WINDOW_SECONDS", 60)
+
+	// IdemStore selects the idempotency store: "memory" (per process) or "redis" (shared
+	// by replicas, at IdemRedisURL).
+	IdemStore          = env.Get("IDEMPOTENCY_STORE", "memory")
+	IdemRedisURL       = env.Get("IDEMPOTENCY_REDIS_URL", "redis://localhost:6379/0")
+	IdemRedisPrefix    = env.Get("IDEMPOTENCY_REDIS_PREFIX", "herald-smtp:idem:")
+	IdemRedisTimeoutMs = env.GetInt("IDEMPOTENCY_REDIS_TIMEOUT_MS", 500)
+
+	// APIKeysFile is a JSON file of named, hashed API keys with scopes; API_KEY, when set,
+	// is accepted as well as a key named "default" with every scope.
+	APIKeysFile = env.Get("API_KEYS_FILE", "")
+	// RequestSigning accepts HMAC-signed requests besides X-API-Key ("optional"), only
+	// signed requests ("required") or no signed requests ("off"). Signed timestamps may
+	// be SignatureMaxSkewSec off; up to SignatureMaxNonces nonces are remembered.
+	RequestSigning      = env.Get("REQUEST_SIGNING", "optional")
+	SignatureMaxSkewSec = env.GetInt("SIGNATURE_MAX_SKEW_SECONDS", 300)
+	SignatureMaxNonces  = env.GetInt("SIGNATURE_NONCE_MAX_ENTRIES", 100000)
+
+	// JWTJWKSFile enables "Authorization: Bearer" JWTs signed by a key of this local JWKS
+	// file, checked for JWTIssuer and JWTAudience when set and reloaded when it changes
+	// (checked every JWTJWKSReloadSec; 0 = only on SIGHUP). JWTAllowedSubjects is a
+	// comma-separated list of accepted sub claims (empty = any); JWTTemplatesClaim and
+	// JWTSendersClaim name the claims listing the templates and From addresses a token
+	// may send.
+	JWTJWKSFile        = env.Get("JWT_JWKS_FILE", "")
+	JWTIssuer          = env.Get("JWT_ISSUER", "")
+	JWTAudience        = env.Get("JWT_AUDIENCE", "")
+	JWTLeewaySec       = env.GetInt("JWT_LEEWAY_SECONDS", 60)
+	JWTAllowedSubjects = env.Get("JWT_ALLOWED_SUBJECTS", "")
+	JWTTemplatesClaim  = env.Get("JWT_TEMPLATES_CLAIM", "templates")
+	JWTSendersClaim    = env.Get("JWT_SENDERS_CLAIM", "senders")
+	JWTJWKSReloadSec   = env.GetInt("JWT_JWKS_RELOAD_SECONDS", 30)
+
+	// TLSCertFile and TLSKeyFile serve HTTPS instead of plain HTTP. TLSClientCAFile
+	// verifies client certificates (TLSClientAuth: "require", "optional" or "none");
+	// TLSClientIdentitiesFile allowlists them by subject or SAN and maps them to callers.
+	// The files are checked for changes every TLSReloadSec (0 = only on SIGHUP).
+	TLSCertFile             = env.Get("TLS_CERT_FILE", "")
+	TLSKeyFile              = env.Get("TLS_KEY_FILE", "")
+	TLSMinVersion           = env.Get("TLS_MIN_VERSION", "1.2")
+	TLSClientCAFile         = env.Get("TLS_CLIENT_CA_FILE", "")
+	TLSClientAuth           = env.Get("TLS_CLIENT_AUTH", "require")
+	TLSClientIdentitiesFile = env.Get("TLS_CLIENT_IDENTITIES_FILE", "")
+	TLSReloadSec            = env.GetInt("TLS_RELOAD_SECONDS", 30)
+
+	// AllowedCIDRs restricts /v1 to these comma-separated networks (empty = any).
+	// TrustedProxies lists the proxies whose X-Forwarded-For names the client.
+	AllowedCIDRs   = env.Get("ALLOWED_CIDRS", "")
+	TrustedProxies = env.Get("TRUSTED_PROXIES", "")
+
+	// SMTPProxyURL routes outbound SMTP connections through a proxy:
+	// socks5://[user:pass@]host:port or http://[user:pass@]host:port (HTTP CONNECT).
+	SMTPProxyURL = env.Get("SMTP_PROXY_URL", "")
+	// SMTPSourceIP binds outbound SMTP connections to this local address.
+	SMTPSourceIP = env.Get("SMTP_SOURCE_IP", "")
+
+	// SendAsync makes /v1/send queue messages and respond 202 unless the request opts out.
+	SendAsync    = env.GetBool("SEND_ASYNC", false)
+	QueueSize    = env.GetInt("QUEUE_SIZE", 1000)
+	QueueWorkers = env.GetInt("QUEUE_WORKERS", 4)
+
+	// Priority lanes: critical and bulk messages get their own queue and workers; QueueSize
+	// and QueueWorkers size the normal lane.
+	QueueSizeCritical    = env.GetInt("QUEUE_SIZE_CRITICAL", 1000)
+	QueueWorkersCritical = env.GetInt("QUEUE_WORKERS_CRITICAL", 2)
+	QueueSizeBulk        = env.GetInt("QUEUE_SIZE_BULK", 1000)
+	QueueWorkersBulk     = env.GetInt("QUEUE_WORKERS_BULK", 2)
+
+	// DedupWindowSec suppresses the same rendered content sent to the same recipient again
+	// within this many seconds, returning the original message ID (0 = off). At most
+	// DedupMaxEntries recent sends are remembered.
+	DedupWindowSec  = env.GetInt("DEDUP_WINDOW_SECONDS", 0)
+	DedupMaxEntries = env.GetInt("DEDUP_MAX_ENTRIES", 100000)
+
+	// OutboxDir enables the durable outbox for queued messages when set.
+	OutboxDir      = env.Get("OUTBOX_DIR", "")
+	OutboxMaxBytes = env.GetInt64("OUTBOX_MAX_BYTES", 64<<20)
+
+	// Retry policy for transient SMTP failures (421/450/451/452, dropped connections).
+	RetryMaxAttempts   = env.GetInt("RETRY_MAX_ATTEMPTS", 3)
+	RetryBaseDelayMs   = env.GetInt("RETRY_BASE_DELAY_MS", 500)
+	RetryMaxDelayMs    = env.GetInt("RETRY_MAX_DELAY_MS", 5000)
+	RetryJitter        = env.GetFloat64("RETRY_JITTER", 0.2)
+	RetryMaxElapsedSec = env.GetInt("RETRY_MAX_ELAPSED_SECONDS", 60)
+	// SendDeadlineSec bounds a synchronous /v1/send, including retries.
+	SendDeadlineSec = env.GetInt("SEND_DEADLINE_SECONDS", 30)
+
+	// DeadLetterDir persists dead letters (one JSON file each) when set; otherwise memory only.
+	DeadLetterDir        = env.Get("DEADLETTER_DIR", "")
+	DeadLetterMaxEntries = env.GetInt("DEADLETTER_MAX_ENTRIES", 10000)
+
+	// Scheduled sends (send_at): how far ahead they may be and how many are held at once.
+	ScheduleMaxAheadSec = env.GetInt("SCHEDULE_MAX_AHEAD_SECONDS", 30*24*3600)
+	ScheduleMaxJobs     = env.GetInt("SCHEDULE_MAX_JOBS", 10000)
+
+	// Message status records for GET /v1/messages/:id: how many are kept and for how long
+	// after a message reaches a final state.
+	StatusMaxEntries = env.GetInt("STATUS_MAX_ENTRIES", 10000)
+	StatusTTLSec     = env.GetInt("STATUS_TTL_SECONDS", 86400)
+
+	// Circuit breaker around the SMTP relay: it opens when BreakerFailureRatio of the last
+	// BreakerWindow sends (at least BreakerMinRequests) failed, and sends then fail fast.
+	BreakerEnabled      = env.GetBool("BREAKER_ENABLED", false)
+	BreakerWindow       = env.GetInt("BREAKER_WINDOW", 20)
+	BreakerMinRequests  = env.GetInt("BREAKER_MIN_REQUESTS", 10)
+	BreakerFailureRatio = env.GetFloat64("BREAKER_FAILURE_RATIO", 0.5)
+	BreakerOpenSec      = env.GetInt("BREAKER_OPEN_SECONDS", 30)
+	BreakerHalfOpenMax  = env.GetInt("BREAKER_HALF_OPEN_MAX", 1)
+	// BreakerProbe is "send" (half-open trial sends) or "noop" (connect and NOOP first).
+	BreakerProbe = env.Get("BREAKER_PROBE", "send")
+
+	// Concurrent outbound SMTP sessions (0 = unlimited). Sync sends beyond the limit wait
+	// up to SMTPSessionWaitMs in a queue of SMTPMaxSessionWaiters, then get 429.
+	SMTPMaxSessions       = env.GetInt("SMTP_MAX_SESSIONS", 0)
+	SMTPMaxSessionWaiters = env.GetInt("SMTP_MAX_SESSION_WAITERS", 100)
+	SMTPSessionWaitMs     = env.GetInt("SMTP_SESSION_WAIT_MS", 5000)
+	// Separate session budgets for critical and bulk messages (0 = share SMTPMaxSessions).
+	SMTPMaxSessionsCritical = env.GetInt("SMTP_MAX_SESSIONS_CRITICAL", 0)
+	SMTPMaxSessionsBulk     = env.GetInt("SMTP_MAX_SESSIONS_BULK", 0)
+
+	// Batch sends: at most BatchMaxItems messages per request, delivered by up to
+	// BatchConcurrency workers. With a custom dial (CustomDial), each reuses its SMTP
+	// connection for SMTPSessionMaxMessages messages. A batch request takes at most
+	// BatchDeadlineSec; items not sent by then fail.
+	BatchMaxItems          = env.GetInt("BATCH_MAX_ITEMS", 1000)
+	BatchConcurrency       = env.GetInt("BATCH_CONCURRENCY", 4)
+	SMTPSessionMaxMessages = env.GetInt("SMTP_SESSION_MAX_MESSAGES", 100)
+	BatchDeadlineSec       = env.GetInt("BATCH_DEADLINE_SECONDS", 60)
+
+	// Graceful shutdown: keep serving with readiness failing for ShutdownPreStopSec, then
+	// stop accepting sends and wait up to ShutdownTimeoutSec for in-flight work.
+	ShutdownPreStopSec = env.GetInt("SHUTDOWN_PRE_STOP_SECONDS", 0)
+	ShutdownTimeoutSec = env.GetInt("SHUTDOWN_TIMEOUT_SECONDS", 30)
 )
 
 // Valid returns true when SMTP is configured (host, from required for send).
@@ -24,7 +177,75 @@ func Valid() bool {
 	return SMTPHost != "" && SMTPFrom != ""
 }
 
+// TLSEnabled reports whether the HTTP listener serves HTTPS.
+func TLSEnabled() bool {
+	return TLSCertFile != "" || TLSKeyFile != ""
+}
+
+// CustomDial reports whether outbound SMTP needs a custom dialer (proxy or source IP).
+func CustomDial() bool {
+	return SMTPProxyURL != "" || SMTPSourceIP != ""
+}
+
+// BatchDeadline returns the time budget of a whole batch request (SendDeadline when unset).
+func BatchDeadline() time.Duration {
+	if BatchDeadlineSec <= 0 {
+		return SendDeadline()
+	}
+	return time.Duration(BatchDeadlineSec) * time.Second
+}
+
+// SendDeadline returns the time budget of a synchronous send, including retries.
+func SendDeadline() time.Duration {
+	if SendDeadlineSec <= 0 {
+		return SMTPTimeout()
+	}
+	return time.Duration(SendDeadlineSec) * time.Second
+}
+
+// ScheduleMaxAhead returns how far in the future send_at may be.
+func ScheduleMaxAhead() time.Duration {
+	return time.Duration(ScheduleMaxAheadSec) * time.Second
+}
+
 // SMTPTimeout returns a reasonable send timeout (used when building provider-kit SMTPConfig).
 func SMTPTimeout() time.Duration {
 	return 30 * time.Second
 }
+
+// JWTSubjects returns the sub claims of JWTAllowedSubjects; nil accepts any.
+func JWTSubjects() []string {
+	return splitList(JWTAllowedSubjects)
+}
+
+// AllowedNetworks returns the networks of AllowedCIDRs; nil allows any.
+func AllowedNetworks() []string {
+	return splitList(AllowedCIDRs)
+}
+
+// TrustedProxyNetworks returns the networks of TrustedProxies.
+func TrustedProxyNetworks() []string {
+	return splitList(TrustedProxies)
+}
+
+// splitList splits a comma-separated setting, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// IdemWait bounds how long a request waits for another one with the same idempotency key.
+func IdemWait() time.Duration {
+	return time.Duration(IdemWaitMs) * time.Millisecond
+}
+
+// IdemLockTTL is how long an in-progress idempotency marker lives, so a crashed replica
+// cannot hold a key forever: the sync send deadline plus a margin.
+func IdemLockTTL() time.Duration {
+	return SendDeadline() + 5*time.Second
+}
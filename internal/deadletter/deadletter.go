@@ -0,0 +1,201 @@
+package deadletter
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/soulteary/provider-kit"
+)
+
+// ErrNotFound is returned when no entry has the requested ID.
+var ErrNotFound = errors.New("dead letter not found")
+
+// Attempt records one delivery attempt.
+type Attempt struct {
+	At        time.Time `json:"at"`
+	Error     string    `json:"error,omitempty"`
+	ReplyCode int       `json:"reply_code,omitempty"`
+}
+
+// Entry is a message that could not be delivered.
+type Entry struct {
+	ID        string                   `json:"id"`
+	Request   provider.HTTPSendRequest `json:"request"`
+	Mode      string                   `json:"mode"` // "sync" or "async"; sync entries are not replayed
+	Priority  string                   `json:"priority,omitempty"`
+	APIKey    string                   `json:"api_key,omitempty"` // name of the key that sent it
+	LastError string                   `json:"last_error"`
+	LastReply int                      `json:"last_reply_code,omitempty"`
+	Attempts  []Attempt                `json:"attempts"`
+	FailedAt  time.Time                `json:"failed_at"`
+}
+
+// Store keeps dead letters in memory and, when dir is set, one JSON file per entry so they
+// survive restarts. At most maxEntries are kept; the oldest are dropped first.
+type Store struct {
+	mu         sync.RWMutex
+	dir        string
+	maxEntries int
+	entries    map[string]*Entry
+}
+
+// Open creates a store. dir may be empty for a memory-only store; maxEntries <= 0 means 10000.
+func Open(dir string, maxEntries int) (*Store, error) {
+	if maxEntries <= 0 {
+		maxEntries = 10000
+	}
+	s := &Store{dir: dir, maxEntries: maxEntries, entries: make(map[string]*Entry)}
+	if dir == "" {
+		return s, nil
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var e Entry
+		if err := json.Unmarshal(b, &e); err != nil || e.ID == "" {
+			continue
+		}
+		s.entries[e.ID] = &e
+	}
+	return s, nil
+}
+
+// Add stores e, replacing any entry with the same ID.
+func (s *Store) Add(e *Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dir != "" {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(s.path(e.ID), b, 0o600); err != nil {
+			return err
+		}
+	}
+	s.entries[e.ID] = e
+	for len(s.entries) > s.maxEntries {
+		s.removeLocked(s.oldestLocked())
+	}
+	return nil
+}
+
+// Get returns the entry with id.
+func (s *Store) Get(id string) (*Entry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.entries[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return e, nil
+}
+
+// List returns up to limit entries starting at offset, newest first, and the total count.
+func (s *Store) List(offset, limit int) ([]*Entry, int) {
+	s.mu.RLock()
+	all := make([]*Entry, 0, len(s.entries))
+	for _, e := range s.entries {
+		all = append(all, e)
+	}
+	s.mu.RUnlock()
+	sort.Slice(all, func(i, j int) bool { return all[i].FailedAt.After(all[j].FailedAt) })
+	total := len(all)
+	if offset > total {
+		offset = total
+	}
+	end := total
+	if limit > 0 && offset+limit < total {
+		end = offset + limit
+	}
+	return all[offset:end], total
+}
+
+// Remove deletes the entry with id.
+func (s *Store) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries[id]; !ok {
+		return ErrNotFound
+	}
+	s.removeLocked(id)
+	return nil
+}
+
+// Take removes the entry with id and returns it. Of concurrent calls for one id, only one
+// gets the entry; the others get ErrNotFound.
+func (s *Store) Take(id string) (*Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	s.removeLocked(id)
+	return e, nil
+}
+
+// Purge deletes entries that failed before the given time (all entries when before is zero)
+// and returns how many were removed.
+func (s *Store) Purge(before time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for id, e := range s.entries {
+		if before.IsZero() || e.FailedAt.Before(before) {
+			s.removeLocked(id)
+			n++
+		}
+	}
+	return n
+}
+
+// Len returns the number of entries.
+func (s *Store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.entries)
+}
+
+func (s *Store) removeLocked(id string) {
+	delete(s.entries, id)
+	if s.dir != "" {
+		_ = os.Remove(s.path(id))
+	}
+}
+
+func (s *Store) oldestLocked() string {
+	var oldest *Entry
+	for _, e := range s.entries {
+		if oldest == nil || e.FailedAt.Before(oldest.FailedAt) {
+			oldest = e
+		}
+	}
+	if oldest == nil {
+		return ""
+	}
+	return oldest.ID
+}
+
+// path maps an entry ID to its file; IDs are hex, but guard against path separators anyway.
+func (s *Store) path(id string) string {
+	return filepath.Join(s.dir, filepath.Base(filepath.Clean("/"+id))+".json")
+}
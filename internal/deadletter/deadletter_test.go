@@ -0,0 +1,107 @@
+package deadletter
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/soulteary/provider-kit"
+)
+
+func entry(id string, failedAt time.Time) *Entry {
+	return &Entry{
+		ID:        id,
+		Request:   provider.HTTPSendRequest{To: "u@example.com", Body: "code"},
+		Mode:      "async",
+		LastError: "550 5.1.1 no such user",
+		LastReply: 550,
+		Attempts:  []Attempt{{At: failedAt, Error: "550 5.1.1 no such user", ReplyCode: 550}},
+		FailedAt:  failedAt,
+	}
+}
+
+func TestStore_AddGetList(t *testing.T) {
+	s, err := Open("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	_ = s.Add(entry("old", now.Add(-time.Hour)))
+	_ = s.Add(entry("new", now))
+	items, total := s.List(0, 10)
+	if total != 2 || len(items) != 2 || items[0].ID != "new" {
+		t.Fatalf("List = %d items (total %d), first %q; want newest first", len(items), total, items[0].ID)
+	}
+	items, _ = s.List(1, 10)
+	if len(items) != 1 || items[0].ID != "old" {
+		t.Errorf("List(offset=1) = %v", items)
+	}
+	if _, err := s.Get("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get(missing) err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestStore_PersistsAcrossOpen(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := Open(dir, 0)
+	_ = s.Add(entry("a", time.Now()))
+	_ = s.Add(entry("b", time.Now()))
+	_ = s.Remove("b")
+
+	s2, err := Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s2.Len() != 1 {
+		t.Fatalf("Len after reopen = %d, want 1", s2.Len())
+	}
+	e, err := s2.Get("a")
+	if err != nil || e.LastReply != 550 || len(e.Attempts) != 1 {
+		t.Errorf("reloaded entry = %+v, err = %v", e, err)
+	}
+}
+
+func TestStore_MaxEntriesDropsOldest(t *testing.T) {
+	s, _ := Open("", 2)
+	now := time.Now()
+	_ = s.Add(entry("1", now.Add(-2*time.Minute)))
+	_ = s.Add(entry("2", now.Add(-time.Minute)))
+	_ = s.Add(entry("3", now))
+	if s.Len() != 2 {
+		t.Fatalf("Len = %d, want 2", s.Len())
+	}
+	if _, err := s.Get("1"); err == nil {
+		t.Error("oldest entry should have been dropped")
+	}
+}
+
+func TestStore_Purge(t *testing.T) {
+	s, _ := Open(t.TempDir(), 0)
+	now := time.Now()
+	_ = s.Add(entry("old", now.Add(-2*time.Hour)))
+	_ = s.Add(entry("new", now))
+	if n := s.Purge(now.Add(-time.Hour)); n != 1 {
+		t.Errorf("Purge(before 1h ago) = %d, want 1", n)
+	}
+	if n := s.Purge(time.Time{}); n != 1 {
+		t.Errorf("Purge(all) = %d, want 1", n)
+	}
+	if s.Len() != 0 {
+		t.Errorf("Len = %d after purge", s.Len())
+	}
+}
+
+func TestStore_Take(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := Open(dir, 0)
+	_ = s.Add(entry("a", time.Now()))
+	if e, err := s.Take("a"); err != nil || e.ID != "a" {
+		t.Fatalf("Take = %+v, %v", e, err)
+	}
+	if _, err := s.Take("a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("second Take err = %v, want ErrNotFound", err)
+	}
+	if s2, _ := Open(dir, 0); s2.Len() != 0 {
+		t.Errorf("taken entry still on disk")
+	}
+}
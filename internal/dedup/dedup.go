@@ -0,0 +1,151 @@
+package dedup
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Key identifies the rendered content sent to one recipient; the address is compared
+// case-insensitively.
+func Key(to, subject, body string) string {
+	raw, _ := json.Marshal([]string{strings.ToLower(strings.TrimSpace(to)), subject, body})
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+type entry struct {
+	key       string
+	messageID string // empty while the first send is in progress
+	expiresAt time.Time
+}
+
+// Store remembers which content was sent to which recipient for a window, independently
+// of idempotency keys. At most maxEntries are kept (oldest first out). A nil Store
+// suppresses nothing, so callers need not check whether suppression is enabled.
+type Store struct {
+	mu         sync.Mutex
+	window     time.Duration
+	maxEntries int
+	entries    map[string]*list.Element
+	byID       map[string]*list.Element // recorded entries by message ID
+	order      *list.List               // *entry, oldest first
+	suppressed int64
+}
+
+// New creates a store; maxEntries <= 0 means 100000.
+func New(window time.Duration, maxEntries int) *Store {
+	if maxEntries <= 0 {
+		maxEntries = 100000
+	}
+	return &Store{window: window, maxEntries: maxEntries, entries: make(map[string]*list.Element),
+		byID: make(map[string]*list.Element), order: list.New()}
+}
+
+// Claim reports whether key was already sent within the window, with the message ID of
+// that send ("" while it is still in progress). Otherwise it marks key in progress, and
+// the caller must Record or Release it.
+func (s *Store) Claim(key string) (messageID string, dup bool) {
+	if s == nil {
+		return "", false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.pruneLocked(now)
+	if el, ok := s.entries[key]; ok {
+		s.suppressed++
+		return el.Value.(*entry).messageID, true
+	}
+	s.entries[key] = s.order.PushBack(&entry{key: key, expiresAt: now.Add(s.window)})
+	for s.order.Len() > s.maxEntries {
+		s.removeLocked(s.order.Front())
+	}
+	return "", false
+}
+
+// Record stores the message ID sent for key; the window starts now.
+func (s *Store) Record(key, messageID string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.entries[key]; ok {
+		s.removeLocked(el)
+	}
+	el := s.order.PushBack(&entry{key: key, messageID: messageID, expiresAt: time.Now().Add(s.window)})
+	s.entries[key] = el
+	if messageID != "" {
+		s.byID[messageID] = el
+	}
+	for s.order.Len() > s.maxEntries {
+		s.removeLocked(s.order.Front())
+	}
+}
+
+// Release removes key if it is still in progress, so a failed send can be retried.
+func (s *Store) Release(key string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.entries[key]; ok && el.Value.(*entry).messageID == "" {
+		s.removeLocked(el)
+	}
+}
+
+// Forget removes the send recorded with messageID, e.g. after that message failed or was
+// cancelled, so the content can be sent again.
+func (s *Store) Forget(messageID string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.byID[messageID]; ok {
+		s.removeLocked(el)
+	}
+}
+
+// Len returns the number of remembered sends, including ones in progress.
+func (s *Store) Len() int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.order.Len()
+}
+
+// Suppressed returns how many duplicates Claim has reported.
+func (s *Store) Suppressed() int64 {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.suppressed
+}
+
+// pruneLocked drops expired entries. Entries share one window and are appended when
+// stored, so they expire oldest first.
+func (s *Store) pruneLocked(now time.Time) {
+	for el := s.order.Front(); el != nil && now.After(el.Value.(*entry).expiresAt); el = s.order.Front() {
+		s.removeLocked(el)
+	}
+}
+
+func (s *Store) removeLocked(el *list.Element) {
+	e := el.Value.(*entry)
+	s.order.Remove(el)
+	delete(s.entries, e.key)
+	if e.messageID != "" {
+		delete(s.byID, e.messageID)
+	}
+}
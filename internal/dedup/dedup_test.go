@@ -0,0 +1,86 @@
+package dedup
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKey(t *testing.T) {
+	if Key("U@Example.com ", "s", "b") != Key("u@example.com", "s", "b") {
+		t.Error("recipient case or spacing changes the key")
+	}
+	if Key("u@example.com", "s", "b1") == Key("u@example.com", "s", "b2") {
+		t.Error("different bodies share a key")
+	}
+	if Key("a@example.com", "s", "b") == Key("b@example.com", "s", "b") {
+		t.Error("different recipients share a key")
+	}
+}
+
+func TestStore_ClaimRecordRelease(t *testing.T) {
+	s := New(time.Minute, 0)
+	if _, dup := s.Claim("k"); dup {
+		t.Fatal("first claim reported a duplicate")
+	}
+	if id, dup := s.Claim("k"); !dup || id != "" {
+		t.Errorf("claim while in progress = %q, %v; want \"\", true", id, dup)
+	}
+	s.Record("k", "m-1")
+	s.Release("k") // no-op once recorded
+	if id, dup := s.Claim("k"); !dup || id != "m-1" {
+		t.Errorf("claim after record = %q, %v; want m-1, true", id, dup)
+	}
+	if n := s.Suppressed(); n != 2 {
+		t.Errorf("Suppressed = %d, want 2", n)
+	}
+
+	if _, dup := s.Claim("other"); dup {
+		t.Fatal("claim(other) reported a duplicate")
+	}
+	s.Release("other")
+	if _, dup := s.Claim("other"); dup {
+		t.Error("released key still claimed")
+	}
+}
+
+func TestStore_ForgetAndExpiry(t *testing.T) {
+	s := New(50*time.Millisecond, 0)
+	s.Claim("k")
+	s.Record("k", "m-1")
+	s.Forget("m-1")
+	if _, dup := s.Claim("k"); dup {
+		t.Error("forgotten send still suppressed")
+	}
+	s.Record("k", "m-2")
+	time.Sleep(80 * time.Millisecond)
+	if _, dup := s.Claim("k"); dup {
+		t.Error("send suppressed after the window")
+	}
+}
+
+func TestStore_Bounded(t *testing.T) {
+	s := New(time.Minute, 2)
+	for _, k := range []string{"a", "b", "c"} {
+		s.Claim(k)
+		s.Record(k, "m-"+k)
+	}
+	if n := s.Len(); n != 2 {
+		t.Errorf("Len = %d, want 2", n)
+	}
+	if _, dup := s.Claim("a"); dup {
+		t.Error("oldest entry kept beyond max entries")
+	}
+}
+
+func TestStore_Nil(t *testing.T) {
+	var s *Store
+	if _, dup := s.Claim("k"); dup {
+		t.Error("nil store reported a duplicate")
+	}
+	s.Record("k", "m")
+	s.Release("k")
+	s.Forget("m")
+	if s.Len() != 0 || s.Suppressed() != 0 {
+		t.Error("nil store not empty")
+	}
+}
@@ -0,0 +1,270 @@
+package handler
+
+import (
+	"crypto/x509"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/soulteary/herald-smtp/internal/auth"
+	"github.com/soulteary/herald-smtp/internal/config"
+	"github.com/soulteary/herald-smtp/internal/deadletter"
+	"github.com/soulteary/herald-smtp/internal/queue"
+	"github.com/soulteary/provider-kit"
+)
+
+// deadLetterList is the response of GET /v1/admin/dead-letters.
+type deadLetterList struct {
+	OK    bool                `json:"ok"`
+	Total int                 `json:"total"`
+	Items []*deadletter.Entry `json:"items"`
+}
+
+// purgeResult is the response of DELETE /v1/admin/dead-letters.
+type purgeResult struct {
+	OK     bool `json:"ok"`
+	Purged int  `json:"purged"`
+}
+
+// Fiber Locals keys: the name of the API key (or token subject) of a request and the
+// claims of its bearer token.
+const (
+	localAPIKey = "api_key"
+	localClaims = "jwt_claims"
+)
+
+// RequireScope rejects requests that authorize does not accept for scope (no-op when no
+// keys or JWKS are configured). The key name is kept for logging; see apiKeyName.
+func (h *Handler) RequireScope(scope string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		name, ok, err := h.authorize(c, scope)
+		if !ok {
+			return err
+		}
+		c.Locals(localAPIKey, name)
+		return c.Next()
+	}
+}
+
+// authorize checks a bearer JWT against h.JWT, the request signature (X-Signature and
+// its headers), the verified client certificate of a request without X-API-Key against
+// h.Certs or, unless config.RequestSigning is "required", the X-API-Key header for scope
+// and returns the key name, token subject or certificate identity. Token claims are kept in Locals; see
+// tokenClaims. When the request is rejected it writes the 401 (unknown, missing or
+// expired key or token, bad signature, stale timestamp or replayed nonce), 403 (scope
+// or subject not allowed) or 429 (nonce cache full) response and returns ok=false with the write error.
+func (h *Handler) authorize(c *fiber.Ctx, scope string) (name string, ok bool, err error) {
+	if !h.authEnabled() {
+		return "", true, nil
+	}
+	name, aerr := h.credentials(c, scope, true)
+	if aerr == nil {
+		return name, true, nil
+	}
+	status, code := fiber.StatusUnauthorized, "unauthorized"
+	switch {
+	case errors.Is(aerr, auth.ErrForbidden):
+		status, code = fiber.StatusForbidden, "forbidden"
+	case errors.Is(aerr, auth.ErrNoncesFull):
+		status, code = fiber.StatusTooManyRequests, "rate_limited"
+		c.Set(fiber.HeaderRetryAfter, "1")
+	}
+	h.Log.Warn().Err(aerr).Str("client_ip", clientIP(c)).Str("path", c.Path()).Str("api_key", name).Msg(code)
+	return name, false, c.Status(status).JSON(provider.HTTPSendResponse{
+		OK: false, ErrorCode: code, ErrorMessage: aerr.Error(),
+	})
+}
+
+// authEnabled reports whether requests need credentials.
+func (h *Handler) authEnabled() bool {
+	return h.Keys.Len() > 0 || h.JWT != nil || h.Certs.Len() > 0
+}
+
+// allows reports whether the credentials of a request that authorize accepted also grant
+// scope. It does not record the nonce of a signed request again.
+func (h *Handler) allows(c *fiber.Ctx, scope string) bool {
+	if !h.authEnabled() {
+		return true
+	}
+	_, err := h.credentials(c, scope, false)
+	return err == nil
+}
+
+// credentials checks the credentials of c for scope and returns the caller name; see
+// authorize. With record false the nonce of a signed request is not recorded.
+func (h *Handler) credentials(c *fiber.Ctx, scope string, record bool) (name string, aerr error) {
+	switch token := bearerToken(c); {
+	case token != "" && h.JWT != nil:
+		var claims *auth.Claims
+		if claims, aerr = h.JWT.Verify(token, scope, time.Now()); aerr == nil {
+			name = claims.Subject
+			c.Locals(localClaims, claims)
+		}
+	case c.Get(auth.HeaderSignature) != "":
+		sig := auth.Signature{
+			KeyID: c.Get(auth.HeaderKeyID), Timestamp: c.Get(auth.HeaderTimestamp),
+			Nonce: c.Get(auth.HeaderNonce), Signature: c.Get(auth.HeaderSignature),
+		}
+		verify := h.Keys.VerifySignature
+		if !record {
+			verify = h.Keys.CheckSignature
+		}
+		name, aerr = verify(sig, c.Method(), c.OriginalURL(), c.Body(), scope, time.Now())
+	case c.Get("X-API-Key") == "" && h.Certs.Len() > 0 && peerCert(c) != nil:
+		name, aerr = h.Certs.Authorize(peerCert(c), scope)
+	case config.RequestSigning == "required":
+		aerr = auth.ErrUnsigned
+	case h.Keys.Len() == 0:
+		aerr = auth.ErrMissing
+	default:
+		name, aerr = h.Keys.Authorize(c.Get("X-API-Key"), scope, time.Now())
+	}
+	return name, aerr
+}
+
+// apiKeyName returns the name of the API key that RequireScope accepted.
+func apiKeyName(c *fiber.Ctx) string {
+	name, _ := c.Locals(localAPIKey).(string)
+	return name
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header.
+func bearerToken(c *fiber.Ctx) string {
+	scheme, token, _ := strings.Cut(c.Get(fiber.HeaderAuthorization), " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// peerCert returns the verified client certificate of a mutual TLS connection, or nil.
+func peerCert(c *fiber.Ctx) *x509.Certificate {
+	cs := c.Context().TLSConnectionState()
+	if cs == nil || len(cs.VerifiedChains) == 0 {
+		return nil
+	}
+	return cs.PeerCertificates[0]
+}
+
+// tokenClaims returns the claims of the bearer token authorize accepted, or nil.
+func tokenClaims(c *fiber.Ctx) *auth.Claims {
+	claims, _ := c.Locals(localClaims).(*auth.Claims)
+	return claims
+}
+
+// ListDeadLetters handles GET /v1/admin/dead-letters?offset=&limit= (newest first).
+func (h *Handler) ListDeadLetters(c *fiber.Ctx) error {
+	if h.DeadLetters == nil {
+		return deadLettersDisabled(c)
+	}
+	limit := c.QueryInt("limit", 50)
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+	offset := c.QueryInt("offset", 0)
+	if offset < 0 {
+		offset = 0
+	}
+	items, total := h.DeadLetters.List(offset, limit)
+	return c.JSON(deadLetterList{OK: true, Total: total, Items: items})
+}
+
+// GetDeadLetter handles GET /v1/admin/dead-letters/:id.
+func (h *Handler) GetDeadLetter(c *fiber.Ctx) error {
+	if h.DeadLetters == nil {
+		return deadLettersDisabled(c)
+	}
+	e, err := h.DeadLetters.Get(c.Params("id"))
+	if err != nil {
+		return deadLetterNotFound(c)
+	}
+	return c.JSON(e)
+}
+
+// ReplayDeadLetter handles POST /v1/admin/dead-letters/:id/replay: the message is queued
+// again under its original ID and API key and removed from the dead letters once
+// accepted. Sync failures are not replayed: their caller got the error and may retry.
+func (h *Handler) ReplayDeadLetter(c *fiber.Ctx) error {
+	if h.DeadLetters == nil {
+		return deadLettersDisabled(c)
+	}
+	e, err := h.DeadLetters.Get(c.Params("id"))
+	if err != nil {
+		return deadLetterNotFound(c)
+	}
+	if e.Mode == "sync" {
+		return c.Status(fiber.StatusConflict).JSON(provider.HTTPSendResponse{
+			OK: false, MessageID: e.ID, ErrorCode: "not_replayable",
+			ErrorMessage: "synchronous failures were reported to the caller and are not replayed",
+		})
+	}
+	if h.Queue == nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(provider.HTTPSendResponse{
+			OK: false, ErrorCode: "provider_down", ErrorMessage: "SMTP not configured",
+		})
+	}
+	// Take the entry before queueing it, so concurrent replays of one entry send it once.
+	if e, err = h.DeadLetters.Take(e.ID); err != nil {
+		return deadLetterNotFound(c)
+	}
+	job := &queue.Job{ID: e.ID, Request: e.Request, EnqueuedAt: time.Now(), Priority: e.Priority, APIKey: e.APIKey}
+	h.Status.Begin(job.ID, job.Request.To, "async", e.APIKey)
+	if status, code, err := h.queueJob(job); err != nil {
+		h.Status.Forget(job.ID)
+		if aerr := h.DeadLetters.Add(e); aerr != nil {
+			h.Log.Error().Err(aerr).Str("message_id", e.ID).Msg("failed to restore dead letter after replay failed")
+		}
+		return c.Status(status).JSON(provider.HTTPSendResponse{
+			OK: false, ErrorCode: code, ErrorMessage: err.Error(),
+		})
+	}
+	h.Log.Info().Str("message_id", e.ID).Str("client_ip", clientIP(c)).Str("api_key", e.APIKey).
+		Str("replayed_by", apiKeyName(c)).Msg("dead letter replayed")
+	return c.Status(fiber.StatusAccepted).JSON(provider.HTTPSendResponse{
+		OK: true, MessageID: e.ID, Provider: "smtp",
+	})
+}
+
+// DeleteDeadLetter handles DELETE /v1/admin/dead-letters/:id.
+func (h *Handler) DeleteDeadLetter(c *fiber.Ctx) error {
+	if h.DeadLetters == nil {
+		return deadLettersDisabled(c)
+	}
+	if err := h.DeadLetters.Remove(c.Params("id")); err != nil {
+		return deadLetterNotFound(c)
+	}
+	return c.JSON(purgeResult{OK: true, Purged: 1})
+}
+
+// PurgeDeadLetters handles DELETE /v1/admin/dead-letters[?before=RFC3339].
+func (h *Handler) PurgeDeadLetters(c *fiber.Ctx) error {
+	if h.DeadLetters == nil {
+		return deadLettersDisabled(c)
+	}
+	var before time.Time
+	if v := c.Query("before"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(provider.HTTPSendResponse{
+				OK: false, ErrorCode: "invalid_request", ErrorMessage: "before must be an RFC 3339 timestamp",
+			})
+		}
+		before = t
+	}
+	n := h.DeadLetters.Purge(before)
+	h.Log.Info().Int("purged", n).Str("client_ip", clientIP(c)).Str("api_key", apiKeyName(c)).Msg("dead letters purged")
+	return c.JSON(purgeResult{OK: true, Purged: n})
+}
+
+func deadLettersDisabled(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusNotFound).JSON(provider.HTTPSendResponse{
+		OK: false, ErrorCode: "not_found", ErrorMessage: "dead letters are disabled",
+	})
+}
+
+func deadLetterNotFound(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusNotFound).JSON(provider.HTTPSendResponse{
+		OK: false, ErrorCode: "not_found", ErrorMessage: "dead letter not found",
+	})
+}
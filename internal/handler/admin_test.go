@@ -0,0 +1,621 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/soulteary/herald-smtp/internal/auth"
+	"github.com/soulteary/herald-smtp/internal/config"
+	"github.com/soulteary/herald-smtp/internal/deadletter"
+	"github.com/soulteary/herald-smtp/internal/idempotency"
+	"github.com/soulteary/herald-smtp/internal/ipallow"
+	"github.com/soulteary/herald-smtp/internal/queue"
+	"github.com/soulteary/herald-smtp/internal/status"
+	"github.com/soulteary/logger-kit"
+	"github.com/soulteary/provider-kit"
+)
+
+// adminApp mounts send and admin routes on a Handler with a dead letter store and queue.
+func adminApp(t *testing.T, mock smtpSender) (*fiber.App, *Handler) {
+	t.Helper()
+	log := logger.New(logger.Config{Level: logger.InfoLevel, ServiceName: "test"})
+	dl, _ := deadletter.Open("", 0)
+	h := &Handler{Sender: mock, Idem: idempotency.NewStore(300), DeadLetters: dl, Log: log}
+	h.Queue = queue.New(10, 1, h.Deliver)
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Post("/v1/send", h.Send)
+	admin := app.Group("/v1/admin", h.RequireScope(auth.ScopeAdmin))
+	admin.Get("/dead-letters", h.ListDeadLetters)
+	admin.Delete("/dead-letters", h.PurgeDeadLetters)
+	admin.Get("/dead-letters/:id", h.GetDeadLetter)
+	admin.Delete("/dead-letters/:id", h.DeleteDeadLetter)
+	admin.Post("/dead-letters/:id/replay", h.ReplayDeadLetter)
+	return app, h
+}
+
+func rejectingSender() *mockSender {
+	return &mockSender{
+		sendFunc: func(ctx context.Context, msg *provider.Message) (*provider.SendResult, error) {
+			return nil, &textproto.Error{Code: 550, Msg: "5.1.1 no such user"}
+		},
+	}
+}
+
+func TestDeadLetters_SyncFailureIsRecorded(t *testing.T) {
+	app, h := adminApp(t, rejectingSender())
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewReader([]byte(`{"to":"u@example.com","body":"123"}`)))
+	req.Header.Set("Content-Type", "application/json")
+	resp, _ := app.Test(req, -1)
+	var sent provider.HTTPSendResponse
+	_ = json.NewDecoder(resp.Body).Decode(&sent)
+	if resp.StatusCode != http.StatusInternalServerError || sent.MessageID == "" {
+		t.Fatalf("status = %d message_id = %q, want 500 with dead letter id", resp.StatusCode, sent.MessageID)
+	}
+
+	resp, _ = app.Test(httptest.NewRequest(http.MethodGet, "/v1/admin/dead-letters", nil), -1)
+	var list deadLetterList
+	_ = json.NewDecoder(resp.Body).Decode(&list)
+	if list.Total != 1 || list.Items[0].ID != sent.MessageID {
+		t.Fatalf("list = %+v, want the failed message", list)
+	}
+	e := list.Items[0]
+	if e.LastReply != 550 || len(e.Attempts) != 1 || e.Request.Body != "123" || e.Mode != "sync" {
+		t.Errorf("entry = %+v", e)
+	}
+	if h.DeadLetters.Len() != 1 {
+		t.Errorf("store Len = %d", h.DeadLetters.Len())
+	}
+
+	// The caller got the 500 and owns the retry; replaying would send twice.
+	resp, _ = app.Test(httptest.NewRequest(http.MethodPost, "/v1/admin/dead-letters/"+sent.MessageID+"/replay", nil), -1)
+	var replayed provider.HTTPSendResponse
+	_ = json.NewDecoder(resp.Body).Decode(&replayed)
+	if resp.StatusCode != http.StatusConflict || replayed.ErrorCode != "not_replayable" || h.DeadLetters.Len() != 1 {
+		t.Errorf("replay of a sync failure = %d %q, want 409 not_replayable", resp.StatusCode, replayed.ErrorCode)
+	}
+}
+
+func TestDeadLetters_AsyncFailureAndReplay(t *testing.T) {
+	fail := true
+	delivered := make(chan string, 1)
+	mock := &mockSender{
+		sendFunc: func(ctx context.Context, msg *provider.Message) (*provider.SendResult, error) {
+			if fail {
+				return nil, &textproto.Error{Code: 554, Msg: "5.7.1 relay denied"}
+			}
+			delivered <- msg.To
+			return provider.NewSuccessResult("smtp", provider.ChannelEmail, "relay-id"), nil
+		},
+	}
+	app, h := adminApp(t, mock)
+	h.Status = status.NewTracker(0, 0)
+	job := &queue.Job{ID: "job-1", Request: provider.HTTPSendRequest{To: "u@example.com"}, EnqueuedAt: time.Now(), APIKey: "billing"}
+	h.Deliver(context.Background(), job)
+	if e, err := h.DeadLetters.Get("job-1"); err != nil || e.APIKey != "billing" {
+		t.Fatalf("async failure not dead-lettered with its key: %+v, %v", e, err)
+	}
+
+	fail = false
+	h.Queue.Start()
+	defer func() { _ = h.Queue.Close(context.Background()) }()
+	resp, _ := app.Test(httptest.NewRequest(http.MethodPost, "/v1/admin/dead-letters/job-1/replay", nil), -1)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("replay status = %d, want 202", resp.StatusCode)
+	}
+	select {
+	case to := <-delivered:
+		if to != "u@example.com" {
+			t.Errorf("replayed to %q", to)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("replayed message was not delivered")
+	}
+	if h.DeadLetters.Len() != 0 {
+		t.Errorf("dead letters Len = %d after replay, want 0", h.DeadLetters.Len())
+	}
+	if r, _ := h.Status.Get("job-1"); r.APIKey != "billing" {
+		t.Errorf("replayed message api_key = %q, want the original sender", r.APIKey)
+	}
+}
+
+func TestDeadLetters_ReplayOnce(t *testing.T) {
+	app, h := adminApp(t, &mockSender{})
+	_ = h.DeadLetters.Add(&deadletter.Entry{ID: "job-1", Request: provider.HTTPSendRequest{To: "u@example.com"}, Mode: "async", FailedAt: time.Now()})
+	replay := func() int {
+		resp, err := app.Test(httptest.NewRequest(http.MethodPost, "/v1/admin/dead-letters/job-1/replay", nil), -1)
+		if err != nil {
+			t.Error(err)
+			return 0
+		}
+		return resp.StatusCode
+	}
+
+	codes := make(chan int, 4)
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- replay()
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	accepted := 0
+	for code := range codes {
+		if code == http.StatusAccepted {
+			accepted++
+		}
+	}
+	if accepted != 1 || h.Queue.Len() != 1 {
+		t.Errorf("concurrent replays: %d accepted, %d queued; want 1 and 1", accepted, h.Queue.Len())
+	}
+
+	// A replay that cannot be queued leaves the entry in place.
+	_ = h.DeadLetters.Add(&deadletter.Entry{ID: "job-1", Request: provider.HTTPSendRequest{To: "u@example.com"}, Mode: "async", FailedAt: time.Now()})
+	_ = h.Queue.Close(context.Background())
+	if code := replay(); code != http.StatusServiceUnavailable {
+		t.Errorf("replay on a closed queue = %d, want 503", code)
+	}
+	if _, err := h.DeadLetters.Get("job-1"); err != nil {
+		t.Errorf("dead letter lost after failed replay: %v", err)
+	}
+}
+
+func TestDeadLetters_NotFoundAndPurge(t *testing.T) {
+	app, h := adminApp(t, rejectingSender())
+	resp, _ := app.Test(httptest.NewRequest(http.MethodPost, "/v1/admin/dead-letters/nope/replay", nil), -1)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("replay unknown status = %d, want 404", resp.StatusCode)
+	}
+	_ = h.DeadLetters.Add(&deadletter.Entry{ID: "a", FailedAt: time.Now()})
+	_ = h.DeadLetters.Add(&deadletter.Entry{ID: "b", FailedAt: time.Now()})
+
+	resp, _ = app.Test(httptest.NewRequest(http.MethodDelete, "/v1/admin/dead-letters?before=not-a-time", nil), -1)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("purge bad before status = %d, want 400", resp.StatusCode)
+	}
+	resp, _ = app.Test(httptest.NewRequest(http.MethodDelete, "/v1/admin/dead-letters", nil), -1)
+	var out purgeResult
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	if out.Purged != 2 || h.DeadLetters.Len() != 0 {
+		t.Errorf("purged = %d, remaining = %d", out.Purged, h.DeadLetters.Len())
+	}
+}
+
+func TestDeadLetters_RequireAPIKey(t *testing.T) {
+	app, h := adminApp(t, rejectingSender())
+	h.Keys, _ = auth.Open("", auth.SharedKey("secret")...)
+	resp, _ := app.Test(httptest.NewRequest(http.MethodGet, "/v1/admin/dead-letters", nil), -1)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status without key = %d, want 401", resp.StatusCode)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/v1/admin/dead-letters", nil)
+	req.Header.Set("X-API-Key", "secret")
+	resp, _ = app.Test(req, -1)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status with key = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestAPIKeys_Scopes(t *testing.T) {
+	app, h := adminApp(t, &mockSender{
+		sendFunc: func(ctx context.Context, msg *provider.Message) (*provider.SendResult, error) {
+			return provider.NewSuccessResult("smtp", provider.ChannelEmail, "relay-id"), nil
+		},
+	})
+	h.Keys, _ = auth.Open("",
+		auth.Key{Name: "billing", Hash: auth.Hash("send-secret"), Scopes: []string{auth.ScopeSend}},
+		auth.Key{Name: "ops", Hash: auth.Hash("admin-secret"), Scopes: []string{auth.ScopeAdmin}},
+	)
+	do := func(method, path, key string) int {
+		t.Helper()
+		req := httptest.NewRequest(method, path, bytes.NewReader([]byte(`{"to":"u@example.com"}`)))
+		req.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+	cases := []struct {
+		method, path, key string
+		want              int
+	}{
+		{http.MethodPost, "/v1/send", "", http.StatusUnauthorized},
+		{http.MethodPost, "/v1/send", "wrong", http.StatusUnauthorized},
+		{http.MethodPost, "/v1/send", "send-secret", http.StatusOK},
+		{http.MethodPost, "/v1/send", "admin-secret", http.StatusForbidden},
+		{http.MethodGet, "/v1/admin/dead-letters", "send-secret", http.StatusForbidden},
+		{http.MethodGet, "/v1/admin/dead-letters", "admin-secret", http.StatusOK},
+	}
+	for _, tc := range cases {
+		if got := do(tc.method, tc.path, tc.key); got != tc.want {
+			t.Errorf("%s %s with %q = %d, want %d", tc.method, tc.path, tc.key, got, tc.want)
+		}
+	}
+}
+
+func TestMessages_OwnedByKey(t *testing.T) {
+	app, h := adminApp(t, &mockSender{})
+	h.Status = status.NewTracker(0, 0)
+	h.Scheduler = queue.NewScheduler(h.Queue, 10)
+	h.Keys, _ = auth.Open("",
+		auth.Key{Name: "billing", Hash: auth.Hash("billing-secret"), Scopes: []string{auth.ScopeSend}},
+		auth.Key{Name: "herald", Hash: auth.Hash("herald-secret"), Scopes: []string{auth.ScopeSend}},
+		auth.Key{Name: "ops", Hash: auth.Hash("ops-secret"), Scopes: []string{auth.ScopeSend, auth.ScopeAdmin}},
+	)
+	app.Get("/v1/messages/:id", h.RequireScope(auth.ScopeSend), h.GetMessage)
+	app.Delete("/v1/messages/:id", h.RequireScope(auth.ScopeSend), h.CancelMessage)
+	do := func(method, path, key string, body []byte) (int, provider.HTTPSendResponse) {
+		t.Helper()
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-Key", key)
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out provider.HTTPSendResponse
+		_ = json.NewDecoder(resp.Body).Decode(&out)
+		return resp.StatusCode, out
+	}
+	schedule := func() string {
+		t.Helper()
+		sendAt := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+		code, out := do(http.MethodPost, "/v1/send", "billing-secret", []byte(`{"to":"u@example.com","send_at":"`+sendAt+`"}`))
+		if code != http.StatusAccepted {
+			t.Fatalf("schedule = %d, want 202", code)
+		}
+		return out.MessageID
+	}
+
+	id := schedule()
+	path := "/v1/messages/" + id
+	if code, _ := do(http.MethodGet, path, "herald-secret", nil); code != http.StatusNotFound {
+		t.Errorf("GET by another key = %d, want 404", code)
+	}
+	if code, _ := do(http.MethodDelete, path, "herald-secret", nil); code != http.StatusNotFound || !h.Scheduler.Scheduled(id) {
+		t.Errorf("DELETE by another key = %d (scheduled %v), want 404 and still scheduled", code, h.Scheduler.Scheduled(id))
+	}
+	if code, _ := do(http.MethodGet, path, "billing-secret", nil); code != http.StatusOK {
+		t.Errorf("GET by the sending key = %d, want 200", code)
+	}
+	if code, _ := do(http.MethodGet, path, "ops-secret", nil); code != http.StatusOK {
+		t.Errorf("GET by an admin key = %d, want 200", code)
+	}
+	if code, _ := do(http.MethodDelete, path, "billing-secret", nil); code != http.StatusOK {
+		t.Errorf("DELETE by the sending key = %d, want 200", code)
+	}
+	if code, _ := do(http.MethodDelete, "/v1/messages/"+schedule(), "ops-secret", nil); code != http.StatusOK {
+		t.Errorf("DELETE by an admin key = %d, want 200", code)
+	}
+}
+
+func TestAPIKeys_IdempotencyKeysPerKey(t *testing.T) {
+	var calls atomic.Int32
+	app, h := adminApp(t, &mockSender{
+		sendFunc: func(ctx context.Context, msg *provider.Message) (*provider.SendResult, error) {
+			return provider.NewSuccessResult("smtp", provider.ChannelEmail, "relay-"+strconv.Itoa(int(calls.Add(1)))), nil
+		},
+	})
+	h.Keys, _ = auth.Open("",
+		auth.Key{Name: "billing", Hash: auth.Hash("billing-secret"), Scopes: []string{auth.ScopeSend}},
+		auth.Key{Name: "herald", Hash: auth.Hash("herald-secret"), Scopes: []string{auth.ScopeSend}},
+	)
+	send := func(key, body string) (int, provider.HTTPSendResponse) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-Key", key)
+		req.Header.Set("Idempotency-Key", "order-1")
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out provider.HTTPSendResponse
+		_ = json.NewDecoder(resp.Body).Decode(&out)
+		return resp.StatusCode, out
+	}
+
+	_, first := send("billing-secret", `{"to":"u@example.com","body":"a"}`)
+	if code, out := send("herald-secret", `{"to":"v@example.com","body":"b"}`); code != http.StatusOK || out.MessageID == first.MessageID {
+		t.Errorf("same key from another caller = %d %q, want 200 and its own message", code, out.MessageID)
+	}
+	if _, out := send("billing-secret", `{"to":"u@example.com","body":"a"}`); out.MessageID != first.MessageID || calls.Load() != 2 {
+		t.Errorf("retry by the same caller = %q (%d sends), want cached %q", out.MessageID, calls.Load(), first.MessageID)
+	}
+}
+
+func TestAPIKeys_SignedRequests(t *testing.T) {
+	old := config.RequestSigning
+	defer func() { config.RequestSigning = old }()
+	app, h := adminApp(t, &mockSender{
+		sendFunc: func(ctx context.Context, msg *provider.Message) (*provider.SendResult, error) {
+			return provider.NewSuccessResult("smtp", provider.ChannelEmail, "relay-id"), nil
+		},
+	})
+	signingKeyFile := filepath.Join(t.TempDir(), "herald.key")
+	if err := os.WriteFile(signingKeyFile, []byte(auth.SigningKey("s3cret")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	h.Keys, _ = auth.Open("", auth.Key{Name: "herald", Hash: auth.Hash("s3cret"), Scopes: []string{auth.ScopeSend}, SigningKeyFile: signingKeyFile})
+	h.Keys.EnableSignatures(time.Minute, 100)
+
+	body := []byte(`{"to":"u@example.com"}`)
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	signedReq := func(nonce string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(auth.HeaderKeyID, "herald")
+		req.Header.Set(auth.HeaderTimestamp, ts)
+		req.Header.Set(auth.HeaderNonce, nonce)
+		req.Header.Set(auth.HeaderSignature, auth.Sign("s3cret", http.MethodPost, "/v1/send", ts, nonce, body))
+		return req
+	}
+	status := func(req *http.Request) int {
+		t.Helper()
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	config.RequestSigning = "optional"
+	if got := status(signedReq("n1")); got != http.StatusOK {
+		t.Errorf("signed request = %d, want 200", got)
+	}
+	if got := status(signedReq("n1")); got != http.StatusUnauthorized {
+		t.Errorf("replayed request = %d, want 401", got)
+	}
+	plain := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewReader(body))
+	plain.Header.Set("Content-Type", "application/json")
+	plain.Header.Set("X-API-Key", "s3cret")
+	if got := status(plain); got != http.StatusOK {
+		t.Errorf("X-API-Key request with optional signing = %d, want 200", got)
+	}
+
+	config.RequestSigning = "required"
+	plain = httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewReader(body))
+	plain.Header.Set("Content-Type", "application/json")
+	plain.Header.Set("X-API-Key", "s3cret")
+	if got := status(plain); got != http.StatusUnauthorized {
+		t.Errorf("X-API-Key request with required signing = %d, want 401", got)
+	}
+	if got := status(signedReq("n2")); got != http.StatusOK {
+		t.Errorf("signed request with required signing = %d, want 200", got)
+	}
+
+	// A cache full of live nonces refuses new requests rather than forgetting n1.
+	h.Keys.EnableSignatures(time.Minute, 1)
+	if got := status(signedReq("n1")); got != http.StatusOK {
+		t.Fatalf("signed request = %d, want 200", got)
+	}
+	if got := status(signedReq("n3")); got != http.StatusTooManyRequests {
+		t.Errorf("signed request with a full nonce cache = %d, want 429", got)
+	}
+	if got := status(signedReq("n1")); got != http.StatusUnauthorized {
+		t.Errorf("replayed request with a full nonce cache = %d, want 401", got)
+	}
+}
+
+func TestJWT_BearerTokens(t *testing.T) {
+	app, h := adminApp(t, &mockSender{
+		sendFunc: func(ctx context.Context, msg *provider.Message) (*provider.SendResult, error) {
+			return provider.NewSuccessResult("smtp", provider.ChannelEmail, "relay-id"), nil
+		},
+	})
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	b64 := base64.RawURLEncoding
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	jwks := `{"keys":[{"kty":"OKP","crv":"Ed25519","kid":"k1","x":"` + b64.EncodeToString(pub) + `"}]}`
+	if err := os.WriteFile(path, []byte(jwks), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	h.JWT, err = auth.OpenJWKS(auth.JWTConfig{JWKSFile: path, Audience: "herald-smtp", TemplatesClaim: "templates", SendersClaim: "senders"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldFrom := config.SMTPFrom
+	defer func() { config.SMTPFrom = oldFrom }()
+	config.SMTPFrom = "Herald <no-reply@example.com>"
+	sign := func(claims map[string]any) string {
+		raw, _ := json.Marshal(claims)
+		signed := b64.EncodeToString([]byte(`{"alg":"EdDSA","kid":"k1"}`)) + "." + b64.EncodeToString(raw)
+		return signed + "." + b64.EncodeToString(ed25519.Sign(priv, []byte(signed)))
+	}
+	token := func(aud string) string {
+		return sign(map[string]any{
+			"sub": "herald", "aud": aud, "exp": time.Now().Add(time.Hour).Unix(), "templates": []string{"login"},
+			"senders": []string{"NO-REPLY@example.com"},
+		})
+	}
+	otherSender := sign(map[string]any{
+		"sub": "herald", "aud": "herald-smtp", "exp": time.Now().Add(time.Hour).Unix(), "senders": "billing@example.com",
+	})
+	do := func(method, path, bearer, body string) int {
+		t.Helper()
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	cases := []struct {
+		name, method, path, token, body string
+		want                            int
+	}{
+		{"allowed template", http.MethodPost, "/v1/send", token("herald-smtp"), `{"to":"u@example.com","template":"login"}`, http.StatusOK},
+		{"other template", http.MethodPost, "/v1/send", token("herald-smtp"), `{"to":"u@example.com","template":"welcome"}`, http.StatusForbidden},
+		{"raw body", http.MethodPost, "/v1/send", token("herald-smtp"), `{"to":"u@example.com","body":"hi"}`, http.StatusForbidden},
+		{"template with body", http.MethodPost, "/v1/send", token("herald-smtp"), `{"to":"u@example.com","template":"login","body":"click here"}`, http.StatusForbidden},
+		{"template with subject", http.MethodPost, "/v1/send", token("herald-smtp"), `{"to":"u@example.com","template":"login","subject":"Invoice"}`, http.StatusForbidden},
+		{"other sender", http.MethodPost, "/v1/send", otherSender, `{"to":"u@example.com","body":"hi"}`, http.StatusForbidden},
+		{"wrong audience", http.MethodPost, "/v1/send", token("other"), `{"to":"u@example.com","template":"login"}`, http.StatusUnauthorized},
+		{"no credentials", http.MethodPost, "/v1/send", "", `{"to":"u@example.com","template":"login"}`, http.StatusUnauthorized},
+		{"admin", http.MethodGet, "/v1/admin/dead-letters", token("herald-smtp"), "", http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		if got := do(tc.method, tc.path, tc.token, tc.body); got != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestClientCertIdentities(t *testing.T) {
+	app, h := adminApp(t, &mockSender{
+		sendFunc: func(ctx context.Context, msg *provider.Message) (*provider.SendResult, error) {
+			return provider.NewSuccessResult("smtp", provider.ChannelEmail, "relay-id"), nil
+		},
+	})
+	h.Keys, _ = auth.Open("", auth.SharedKey("s3cret")...)
+	path := filepath.Join(t.TempDir(), "identities.json")
+	if err := os.WriteFile(path, []byte(`{"identities":[{"name":"herald","sans":["herald.internal"],"scopes":["send"]}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if h.Certs, err = auth.OpenCertIdentities(path); err != nil {
+		t.Fatal(err)
+	}
+
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "test CA"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour),
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign,
+	}
+	caDER, _ := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	ca, _ := x509.ParseCertificate(caDER)
+	issue := func(serial int64, dnsName string, usage x509.ExtKeyUsage) tls.Certificate {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial), Subject: pkix.Name{CommonName: dnsName}, DNSNames: []string{dnsName},
+			NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour),
+			KeyUsage: x509.KeyUsageDigitalSignature, ExtKeyUsage: []x509.ExtKeyUsage{usage},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{issue(2, "localhost", x509.ExtKeyUsageServerAuth)},
+		ClientCAs:    pool, ClientAuth: tls.VerifyClientCertIfGiven,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = app.Listener(ln) }()
+	defer func() { _ = ln.Close() }()
+
+	send := func(cert *tls.Certificate, apiKey string) int {
+		t.Helper()
+		cfg := &tls.Config{RootCAs: pool, ServerName: "localhost"}
+		if cert != nil {
+			cfg.Certificates = []tls.Certificate{*cert}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}, Timeout: 5 * time.Second}
+		defer client.CloseIdleConnections()
+		req, _ := http.NewRequest(http.MethodPost, "https://"+ln.Addr().String()+"/v1/send", bytes.NewBufferString(`{"to":"u@example.com"}`))
+		req.Header.Set("Content-Type", "application/json")
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	herald := issue(3, "herald.internal", x509.ExtKeyUsageClientAuth)
+	other := issue(4, "other.internal", x509.ExtKeyUsageClientAuth)
+	if got := send(&herald, ""); got != http.StatusOK {
+		t.Errorf("mapped client certificate = %d, want 200", got)
+	}
+	if got := send(&other, ""); got != http.StatusUnauthorized {
+		t.Errorf("unmapped client certificate = %d, want 401", got)
+	}
+	if got := send(nil, ""); got != http.StatusUnauthorized {
+		t.Errorf("no credentials = %d, want 401", got)
+	}
+	if got := send(nil, "s3cret"); got != http.StatusOK {
+		t.Errorf("API key without client certificate = %d, want 200", got)
+	}
+}
+
+func TestRequireNetwork(t *testing.T) {
+	_, h := adminApp(t, &mockSender{
+		sendFunc: func(ctx context.Context, msg *provider.Message) (*provider.SendResult, error) {
+			return provider.NewSuccessResult("smtp", provider.ChannelEmail, "relay-id"), nil
+		},
+	})
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Group("/v1", h.RequireNetwork()).Post("/send", h.Send)
+	// app.Test connections come from 0.0.0.0, used here as the trusted proxy.
+	var err error
+	h.Networks, err = ipallow.New([]string{"10.0.0.0/8"}, []string{"0.0.0.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	do := func(forwarded string) (int, string) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewBufferString(`{"to":"u@example.com"}`))
+		req.Header.Set("Content-Type", "application/json")
+		if forwarded != "" {
+			req.Header.Set("X-Forwarded-For", forwarded)
+		}
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body provider.HTTPSendResponse
+		_ = json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body.ErrorCode
+	}
+	if status, _ := do("10.1.2.3"); status != http.StatusOK {
+		t.Errorf("allowed network = %d, want 200", status)
+	}
+	if status, code := do("10.1.2.3, 198.51.100.1"); status != http.StatusForbidden || code != "ip_not_allowed" {
+		t.Errorf("unknown network = %d %q, want 403 ip_not_allowed", status, code)
+	}
+	if status, _ := do(""); status != http.StatusForbidden {
+		t.Errorf("proxy itself = %d, want 403", status)
+	}
+}
@@ -0,0 +1,204 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/soulteary/herald-smtp/internal/auth"
+	"github.com/soulteary/herald-smtp/internal/config"
+	"github.com/soulteary/herald-smtp/internal/limiter"
+	"github.com/soulteary/herald-smtp/internal/smtp"
+	"github.com/soulteary/provider-kit"
+)
+
+// batchResult is the outcome of one batch item, in request order.
+type batchResult struct {
+	Index  int `json:"index"`
+	Status int `json:"status"`
+	sendResponse
+	RetryAfter     int    `json:"retry_after,omitempty"`     // seconds, for 429 and 503 items
+	IdempotencyKey string `json:"idempotency_key,omitempty"` // derived key, see deriveIdemKey
+}
+
+// batchResponse is the response of POST /v1/send/batch. OK is true when every item succeeded.
+type batchResponse struct {
+	OK      bool          `json:"ok"`
+	Results []batchResult `json:"results"`
+}
+
+// sessionOpener is implemented by *smtp.Client.
+type sessionOpener interface {
+	NewSession() *smtp.Session
+}
+
+// SendBatch handles POST /v1/send/batch. The body is a JSON array of send requests, or
+// one request per line with Content-Type application/x-ndjson. Each item is validated,
+// deduplicated by its own idempotency key and sent or queued exactly like POST /v1/send;
+// synchronous items are sent by up to config.BatchConcurrency workers, over reused SMTP
+// sessions when the sender supports them. The whole batch gets config.BatchDeadline;
+// items not started by then fail with 503 and the ones being sent are cut short.
+func (h *Handler) SendBatch(c *fiber.Ctx) error {
+	log := h.Log
+	keyName, ok, err := h.authorize(c, auth.ScopeSend)
+	if !ok {
+		return err
+	}
+	items, err := parseBatch(c)
+	if err != nil {
+		log.Warn().Err(err).Msg("batch invalid_request")
+		return c.Status(fiber.StatusBadRequest).JSON(provider.HTTPSendResponse{
+			OK: false, ErrorCode: "invalid_request", ErrorMessage: err.Error(),
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(c.Context(), config.BatchDeadline())
+	defer cancel()
+	prefer, claims := preferAsync(c), tokenClaims(c)
+	results := make([]batchResult, len(items))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(max(config.BatchConcurrency, 1), len(items)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			via, closeSession := h.batchSender()
+			defer closeSession()
+			for i := range next {
+				if ctx.Err() != nil {
+					results[i] = batchResult{Index: i, Status: fiber.StatusServiceUnavailable, RetryAfter: 1,
+						sendResponse: sendResponse{HTTPSendResponse: provider.HTTPSendResponse{
+							OK: false, ErrorCode: "provider_down", ErrorMessage: "batch deadline passed before the message was sent",
+						}}}
+					continue
+				}
+				results[i] = h.batchItem(ctx, prefer, via, keyName, claims, i, items[i])
+			}
+		}()
+	}
+	for i := range items {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	resp := batchResponse{OK: true, Results: results}
+	failed := 0
+	for _, r := range results {
+		if !r.OK {
+			resp.OK = false
+			failed++
+		}
+	}
+	log.Info().Int("items", len(items)).Int("failed", failed).Str("api_key", keyName).Msg("batch processed")
+	return c.JSON(resp)
+}
+
+// batchItem decodes and processes item i of a batch.
+func (h *Handler) batchItem(ctx context.Context, prefer bool, via smtpSender, keyName string, claims *auth.Claims, i int, raw json.RawMessage) batchResult {
+	req := sendRequest{apiKey: keyName, claims: claims}
+	var out outcome
+	var derived string
+	if err := json.Unmarshal(raw, &req); err != nil {
+		out = fail(fiber.StatusBadRequest, "invalid_request", err.Error())
+	} else {
+		derived = deriveIdemKey(&req, time.Now(), h.idemStored(req.apiKey))
+		out = h.process(ctx, prefer, via, &req)
+	}
+	r := batchResult{Index: i, Status: out.status, sendResponse: out.resp, IdempotencyKey: derived}
+	if out.retryAfter > 0 {
+		r.RetryAfter, _ = strconv.Atoi(retryAfter(out.retryAfter))
+	}
+	return r
+}
+
+// batchSender returns a reused SMTP session when the sender supports one, and the
+// function that ends it.
+func (h *Handler) batchSender() (smtpSender, func()) {
+	if o, ok := h.Sender.(sessionOpener); ok {
+		if s := o.NewSession(); s != nil {
+			b := &batchSession{session: s}
+			return b, b.end
+		}
+	}
+	return h.Sender, func() {}
+}
+
+// session is implemented by *smtp.Session.
+type session interface {
+	smtpSender
+	Connected() bool
+	Close() error
+}
+
+// batchSession is a reused SMTP session that holds a session slot for as long as its
+// connection is open, so the connection counts against the limit between items too.
+type batchSession struct {
+	session
+	slots   *limiter.Limiter // budget the held slot belongs to
+	release func()           // nil when no slot is held
+}
+
+// hold makes sure the session holds a slot of sessions (nil: no limit) before an attempt,
+// taking one with acquire when needed. An item of another priority ends the connection
+// and its slot first. The returned function, called after the attempt, gives the slot
+// back when the connection has closed.
+func (b *batchSession) hold(ctx context.Context, sessions *limiter.Limiter, acquire func(context.Context) (func(), error)) (func(), error) {
+	if b.release != nil && b.slots != sessions {
+		b.end()
+	}
+	if b.release == nil && sessions != nil {
+		release, err := acquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+		b.slots, b.release = sessions, release
+	}
+	return func() {
+		if !b.Connected() {
+			b.releaseSlot()
+		}
+	}, nil
+}
+
+// end closes the session and gives its slot back.
+func (b *batchSession) end() {
+	_ = b.Close()
+	b.releaseSlot()
+}
+
+func (b *batchSession) releaseSlot() {
+	if b.release != nil {
+		b.release()
+		b.slots, b.release = nil, nil
+	}
+}
+
+// parseBatch splits the request body into items: NDJSON lines (blank lines skipped) or
+// the elements of a JSON array.
+func parseBatch(c *fiber.Ctx) ([]json.RawMessage, error) {
+	var items []json.RawMessage
+	ct := strings.ToLower(c.Get(fiber.HeaderContentType))
+	if strings.Contains(ct, "ndjson") || strings.Contains(ct, "jsonl") {
+		for _, line := range bytes.Split(c.Body(), []byte("\n")) {
+			if line = bytes.TrimSpace(line); len(line) > 0 {
+				items = append(items, json.RawMessage(line))
+			}
+		}
+	} else if err := json.Unmarshal(c.Body(), &items); err != nil {
+		return nil, errors.New("body must be a JSON array of send requests or NDJSON")
+	}
+	if len(items) == 0 {
+		return nil, errors.New("batch is empty")
+	}
+	if config.BatchMaxItems > 0 && len(items) > config.BatchMaxItems {
+		return nil, errors.New("batch exceeds " + strconv.Itoa(config.BatchMaxItems) + " items")
+	}
+	return items, nil
+}
@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/soulteary/herald-smtp/internal/auth"
+	"github.com/soulteary/herald-smtp/internal/status"
+	"github.com/soulteary/provider-kit"
+)
+
+// cancelResult is the response of DELETE /v1/messages/:id.
+type cancelResult struct {
+	OK        bool   `json:"ok"`
+	MessageID string `json:"message_id"`
+	Status    string `json:"status"`
+}
+
+// messageStatus is the response of GET /v1/messages/:id.
+type messageStatus struct {
+	OK bool `json:"ok"`
+	status.Record
+}
+
+// visible returns the status of message id when the caller may see and cancel it: it was
+// sent with the caller's key, or the caller holds the admin scope. Other callers get the
+// same answer as for an unknown id, so message ids of other keys cannot be probed.
+func (h *Handler) visible(c *fiber.Ctx, id string) (status.Record, bool) {
+	r, ok := h.Status.Get(id)
+	if ok && r.APIKey == apiKeyName(c) || h.allows(c, auth.ScopeAdmin) {
+		return r, ok
+	}
+	return status.Record{}, false
+}
+
+// GetMessage handles GET /v1/messages/:id: the lifecycle of a message with its attempts.
+func (h *Handler) GetMessage(c *fiber.Ctx) error {
+	r, ok := h.visible(c, c.Params("id"))
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(provider.HTTPSendResponse{
+			OK: false, ErrorCode: "not_found", ErrorMessage: "message not found",
+		})
+	}
+	return c.JSON(messageStatus{OK: true, Record: r})
+}
+
+// CancelMessage handles DELETE /v1/messages/:id. Only messages that are scheduled or
+// still waiting in the queue can be cancelled; once an SMTP attempt starts it is too late.
+// Like GetMessage, it only sees messages of the caller's key unless the caller is admin.
+func (h *Handler) CancelMessage(c *fiber.Ctx) error {
+	id := c.Params("id")
+	r, ok := h.visible(c, id)
+	if !ok && !h.allows(c, auth.ScopeAdmin) {
+		return c.Status(fiber.StatusNotFound).JSON(provider.HTTPSendResponse{
+			OK: false, ErrorCode: "not_found", ErrorMessage: "message not found or no longer cancellable",
+		})
+	}
+	cancelled := (h.Scheduler != nil && h.Scheduler.Cancel(id)) || (h.Queue != nil && h.Queue.Cancel(id))
+	if !cancelled {
+		if ok {
+			return c.Status(fiber.StatusConflict).JSON(provider.HTTPSendResponse{
+				OK: false, MessageID: id, ErrorCode: "not_cancellable", ErrorMessage: "message is already " + string(r.Status),
+			})
+		}
+		return c.Status(fiber.StatusNotFound).JSON(provider.HTTPSendResponse{
+			OK: false, ErrorCode: "not_found", ErrorMessage: "message not found or no longer cancellable",
+		})
+	}
+	h.forget(id)
+	h.Dedup.Forget(id)
+	h.Status.Cancel(id)
+	h.Log.Info().Str("message_id", id).Str("client_ip", clientIP(c)).Str("api_key", apiKeyName(c)).Msg("message cancelled")
+	return c.JSON(cancelResult{OK: true, MessageID: id, Status: string(status.Cancelled)})
+}
@@ -0,0 +1,44 @@
+package handler
+
+import (
+	"net/netip"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/soulteary/provider-kit"
+)
+
+// localClientIP is the fiber Locals key holding the source address resolved by
+// RequireNetwork.
+const localClientIP = "client_ip"
+
+// RequireNetwork resolves the source address of a request, through X-Forwarded-For when
+// it comes from a trusted proxy of h.Networks, and rejects it with 403 ip_not_allowed
+// when it is outside the allowed networks (no-op when none are configured).
+func (h *Handler) RequireNetwork() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		remote, _ := netip.AddrFromSlice(c.Context().RemoteIP())
+		var forwarded []string
+		for _, v := range c.Request().Header.PeekAll(fiber.HeaderXForwardedFor) {
+			forwarded = append(forwarded, string(v))
+		}
+		ip := h.Networks.ClientIP(remote, forwarded)
+		c.Locals(localClientIP, ip.String())
+		if h.Networks.Allows(ip) {
+			return c.Next()
+		}
+		h.Log.Warn().Str("client_ip", ip.String()).Str("remote_addr", remote.Unmap().String()).
+			Str("forwarded_for", strings.Join(forwarded, ", ")).Str("path", c.Path()).Msg("ip_not_allowed")
+		return c.Status(fiber.StatusForbidden).JSON(provider.HTTPSendResponse{
+			OK: false, ErrorCode: "ip_not_allowed", ErrorMessage: "source address not allowed",
+		})
+	}
+}
+
+// clientIP returns the source address RequireNetwork resolved, or c.IP() without it.
+func clientIP(c *fiber.Ctx) string {
+	if ip, ok := c.Locals(localClientIP).(string); ok {
+		return ip
+	}
+	return c.IP()
+}
@@ -2,10 +2,30 @@ package handler
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/soulteary/herald-smtp/internal/auth"
+	"github.com/soulteary/herald-smtp/internal/breaker"
 	"github.com/soulteary/herald-smtp/internal/config"
+	"github.com/soulteary/herald-smtp/internal/deadletter"
+	"github.com/soulteary/herald-smtp/internal/dedup"
 	"github.com/soulteary/herald-smtp/internal/idempotency"
+	"github.com/soulteary/herald-smtp/internal/ipallow"
+	"github.com/soulteary/herald-smtp/internal/limiter"
+	"github.com/soulteary/herald-smtp/internal/outbox"
+	"github.com/soulteary/herald-smtp/internal/queue"
+	"github.com/soulteary/herald-smtp/internal/retry"
+	"github.com/soulteary/herald-smtp/internal/smtp"
+	"github.com/soulteary/herald-smtp/internal/status"
 	"github.com/soulteary/logger-kit"
 	"github.com/soulteary/provider-kit"
 )
@@ -15,38 +35,639 @@ type smtpSender interface {
 	Send(ctx context.Context, msg *provider.Message) (*provider.SendResult, error)
 }
 
-// SendHandler handles POST /v1/send from Herald.
-func SendHandler(c *fiber.Ctx, smtpClient smtpSender, idemStore *idempotency.Store, log *logger.Logger) error {
-	if config.APIKey != "" && c.Get("X-API-Key") != config.APIKey {
-		log.Warn().Str("client_ip", c.IP()).Msg("send unauthorized: invalid or missing API key")
-		return c.Status(fiber.StatusUnauthorized).JSON(provider.HTTPSendResponse{
-			OK: false, ErrorCode: "unauthorized", ErrorMessage: "invalid or missing API key",
-		})
+// sendRequest is provider-kit HTTPSendRequest plus herald-smtp specific options.
+type sendRequest struct {
+	provider.HTTPSendRequest
+	// Async overrides config.SendAsync for this request.
+	Async *bool `json:"async,omitempty"`
+	// SendAt schedules the message for later delivery (RFC 3339); implies async.
+	SendAt *time.Time `json:"send_at,omitempty"`
+	// Priority is critical, normal (default) or bulk.
+	Priority string `json:"priority,omitempty"`
+
+	apiKey string       // name of the API key (or token subject) that sent the request
+	claims *auth.Claims // bearer token claims; nil for API keys
+}
+
+// Message priorities. Each has its own queue lane and, when configured, its own SMTP
+// session budget, so verification codes never wait behind bulk mail.
+const (
+	PriorityCritical = "critical"
+	PriorityNormal   = "normal"
+	PriorityBulk     = "bulk"
+)
+
+// sendResponse is provider-kit HTTPSendResponse plus the number of SMTP attempts made.
+// Duplicate marks a response for content already sent to the recipient (see Dedup).
+type sendResponse struct {
+	provider.HTTPSendResponse
+	Attempts  int  `json:"attempts,omitempty"`
+	Duplicate bool `json:"duplicate,omitempty"`
+}
+
+// Handler serves the send endpoints. Queue is optional; without it every send is synchronous.
+// Outbox is optional; when set, queued jobs are persisted before they are acknowledged.
+// DeadLetters is optional; it receives messages that failed permanently or exhausted retries.
+// Scheduler is optional; it holds messages sent with send_at until they are due.
+// Status is optional; it records the lifecycle of each message for GET /v1/messages/:id.
+// Breaker is optional; while it is open sends fail fast instead of waiting on a dead relay.
+// Sessions is optional; it caps concurrent SMTP sessions. LaneSessions gives priorities
+// their own budget; priorities without one share Sessions.
+// Keys holds the accepted API keys, JWT, when set, validates bearer tokens and Certs maps
+// client certificates to callers; without any of them no authentication is required.
+// Networks is optional; it restricts the source networks of requests (see RequireNetwork).
+// Dedup is optional; it suppresses the same content sent to the same recipient again
+// within its window, whatever the idempotency key.
+type Handler struct {
+	Sender       smtpSender
+	Idem         idempotency.Store
+	Keys         *auth.Registry
+	JWT          *auth.JWTVerifier
+	Certs        *auth.CertIdentities
+	Queue        *queue.Queue
+	Scheduler    *queue.Scheduler
+	Outbox       *outbox.Outbox
+	Retry        retry.Policy
+	DeadLetters  *deadletter.Store
+	Status       *status.Tracker
+	Breaker      *breaker.Breaker
+	Sessions     *limiter.Limiter
+	LaneSessions map[string]*limiter.Limiter
+	Dedup        *dedup.Store
+	Networks     *ipallow.Policy
+	Log          *logger.Logger
+}
+
+// SendHandler handles POST /v1/send from Herald, authenticated by the shared API_KEY.
+func SendHandler(c *fiber.Ctx, smtpClient smtpSender, idemStore idempotency.Store, log *logger.Logger) error {
+	keys, _ := auth.Open("", auth.SharedKey(config.APIKey)...)
+	h := &Handler{Sender: smtpClient, Idem: idemStore, Keys: keys, Log: log}
+	return h.Send(c)
+}
+
+// outcome is the HTTP status and body for one send request.
+type outcome struct {
+	status     int
+	resp       sendResponse
+	retryAfter time.Duration // sets Retry-After when > 0
+}
+
+// fail builds an error outcome.
+func fail(status int, code, msg string) outcome {
+	return outcome{status: status, resp: sendResponse{HTTPSendResponse: provider.HTTPSendResponse{
+		OK: false, ErrorCode: code, ErrorMessage: msg,
+	}}}
+}
+
+// Send handles POST /v1/send. In async mode the request is validated, queued and
+// acknowledged with 202; otherwise the SMTP exchange completes before responding.
+func (h *Handler) Send(c *fiber.Ctx) error {
+	log := h.Log
+	keyName, ok, err := h.authorize(c, auth.ScopeSend)
+	if !ok {
+		return err
 	}
-	var req provider.HTTPSendRequest
+	var req sendRequest
 	if err := c.BodyParser(&req); err != nil {
 		log.Warn().Err(err).Msg("send invalid_request: body parse error")
 		return c.Status(fiber.StatusBadRequest).JSON(provider.HTTPSendResponse{
 			OK: false, ErrorCode: "invalid_request", ErrorMessage: err.Error(),
 		})
 	}
+	req.apiKey, req.claims = keyName, tokenClaims(c)
+	if req.IdempotencyKey == "" {
+		req.IdempotencyKey = c.Get("Idempotency-Key")
+	}
+	if key := deriveIdemKey(&req, time.Now(), h.idemStored(req.apiKey)); key != "" {
+		c.Set(HeaderDerivedIdemKey, key)
+	}
+	out := h.process(c.Context(), preferAsync(c), h.Sender, &req)
+	if out.retryAfter > 0 {
+		c.Set(fiber.HeaderRetryAfter, retryAfter(out.retryAfter))
+	}
+	return c.Status(out.status).JSON(out.resp)
+}
+
+// process validates, deduplicates and sends (or queues) one request, delivering
+// synchronous sends through via. prefer reports a "Prefer: respond-async" header.
+// It is shared by single and batch sends.
+func (h *Handler) process(ctx context.Context, prefer bool, via smtpSender, req *sendRequest) outcome {
+	log := h.Log
+	if req.apiKey != "" {
+		log = log.WithStr("api_key", req.apiKey)
+	}
 	if req.To == "" {
 		log.Warn().Msg("send invalid_destination: to is required")
-		return c.Status(fiber.StatusBadRequest).JSON(provider.HTTPSendResponse{
-			OK: false, ErrorCode: "invalid_destination", ErrorMessage: "to is required",
-		})
+		return fail(fiber.StatusBadRequest, "invalid_destination", "to is required")
 	}
-	if req.IdempotencyKey == "" {
-		req.IdempotencyKey = c.Get("Idempotency-Key")
+	switch req.Priority {
+	case "":
+		req.Priority = PriorityNormal
+	case PriorityCritical, PriorityNormal, PriorityBulk:
+	default:
+		log.Warn().Str("priority", req.Priority).Msg("send invalid_request: unknown priority")
+		return fail(fiber.StatusBadRequest, "invalid_request", "priority must be critical, normal or bulk")
+	}
+	if !req.claims.AllowsTemplate(req.Template) {
+		log.Warn().Str("template", req.Template).Msg("send forbidden: template not allowed for token")
+		return fail(fiber.StatusForbidden, "forbidden", "template not allowed for this token")
+	}
+	if req.claims.TemplatesOnly() && (req.Subject != "" || req.Body != "") {
+		log.Warn().Str("template", req.Template).Msg("send forbidden: free-form content for a template-only token")
+		return fail(fiber.StatusForbidden, "forbidden", "subject and body not allowed for this token")
+	}
+	if !req.claims.AllowsSender(config.SMTPFrom) {
+		log.Warn().Str("from", config.SMTPFrom).Msg("send forbidden: sender not allowed for token")
+		return fail(fiber.StatusForbidden, "forbidden", "sender not allowed for this token")
+	}
+	var fp, dupKey string
+	idemKey := idemStoreKey(req.apiKey, req.IdempotencyKey)
+	remember := func(out outcome) outcome {
+		if out.resp.OK && dupKey != "" {
+			h.Dedup.Record(dupKey, out.resp.MessageID)
+		}
+		if req.IdempotencyKey != "" {
+			h.Idem.Put(idemKey, idempotency.Cached{
+				OK: out.resp.OK, MessageID: out.resp.MessageID, Fingerprint: fp, Status: out.status,
+				Provider: out.resp.Provider, ErrorCode: out.resp.ErrorCode, ErrorMessage: out.resp.ErrorMessage,
+				Attempts: out.resp.Attempts,
+			})
+		}
+		return out
 	}
 	if req.IdempotencyKey != "" {
-		if cached, hit := idemStore.Get(req.IdempotencyKey); hit {
+		fp = fingerprint(req)
+		cached, hit, err := h.claim(ctx, idemKey, fp)
+		if errors.Is(err, errIdemConflict) {
+			log.Warn().Str("to", req.To).Msg("send idempotency_conflict: key reused with a different payload")
+			return fail(fiber.StatusConflict, "idempotency_conflict", err.Error())
+		}
+		if err != nil {
+			log.Warn().Str("to", req.To).Msg("send in_progress: idempotency key in use")
+			out := fail(fiber.StatusConflict, "in_progress", err.Error())
+			out.retryAfter = time.Second
+			return out
+		}
+		if hit {
 			log.Debug().Str("to", req.To).Bool("cached_ok", cached.OK).Str("message_id", cached.MessageID).Msg("send idempotent hit")
-			return c.JSON(provider.HTTPSendResponse{
-				OK: cached.OK, MessageID: cached.MessageID, Provider: "smtp",
-			})
+			return replay(cached)
+		}
+		// Drops the in-progress marker when no result was stored (e.g. 429, 503).
+		defer h.Idem.Release(idemKey)
+	}
+	if h.Dedup != nil {
+		msg := buildMessage(&req.HTTPSendRequest)
+		dupKey = dedup.Key(msg.To, msg.Subject, msg.Body)
+		if messageID, dup := h.Dedup.Claim(dupKey); dup {
+			if messageID == "" {
+				log.Warn().Str("to", req.To).Msg("send in_progress: same content being sent to recipient")
+				out := fail(fiber.StatusConflict, "in_progress", "the same content is being sent to this recipient")
+				out.retryAfter = time.Second
+				return out
+			}
+			log.Info().Str("to", req.To).Str("message_id", messageID).Msg("send duplicate suppressed")
+			return outcome{status: fiber.StatusOK, resp: sendResponse{HTTPSendResponse: provider.HTTPSendResponse{
+				OK: true, MessageID: messageID, Provider: "smtp",
+			}, Duplicate: true}}
+		}
+		defer h.Dedup.Release(dupKey)
+	}
+	if req.SendAt != nil {
+		if h.Scheduler == nil {
+			return fail(fiber.StatusBadRequest, "invalid_request", "scheduled sends are not available")
+		}
+		if max := config.ScheduleMaxAhead(); time.Until(*req.SendAt) > max {
+			return fail(fiber.StatusBadRequest, "invalid_request", "send_at is more than "+max.String()+" ahead")
+		}
+		return h.enqueue(req, remember)
+	}
+	if h.Queue != nil && wantAsync(req, prefer) {
+		return h.enqueue(req, remember)
+	}
+	id := newMessageID()
+	h.Status.Begin(id, req.To, "sync", req.apiKey)
+	ctx, cancel := context.WithTimeout(ctx, config.SendDeadline())
+	defer cancel()
+	result, history, err := h.sendVia(ctx, via, id, "sync", req.Priority, buildMessage(&req.HTTPSendRequest))
+	attempts := len(history)
+	var failedID string // reported so the caller can find the dead letter and status
+	if err != nil || result == nil || !result.OK {
+		if attempts == 0 {
+			h.Status.Forget(id) // rejected by the breaker or session limit before any attempt
+		} else {
+			h.finish(id, result, history)
+			if h.DeadLetters != nil || h.Status != nil {
+				failedID = id
+			}
+			h.deadLetter(id, "sync", req.Priority, req.apiKey, &req.HTTPSendRequest, history)
+		}
+	}
+	failed := func(status int, code, msg string) outcome {
+		return outcome{status: status, resp: sendResponse{
+			HTTPSendResponse: provider.HTTPSendResponse{OK: false, MessageID: failedID, ErrorCode: code, ErrorMessage: msg},
+			Attempts:         attempts,
+		}}
+	}
+	if errors.Is(err, breaker.ErrOpen) {
+		log.Warn().Str("to", req.To).Int("attempts", attempts).Msg("send provider_down: circuit breaker open")
+		out := failed(fiber.StatusServiceUnavailable, "provider_down", err.Error())
+		out.retryAfter = h.Breaker.RetryAfter()
+		return out
+	}
+	if errors.Is(err, limiter.ErrBusy) {
+		log.Warn().Str("to", req.To).Int("attempts", attempts).Msg("send rate_limited: SMTP session limit reached")
+		out := failed(fiber.StatusTooManyRequests, "rate_limited", err.Error())
+		out.retryAfter = h.sessions(req.Priority).RetryAfter()
+		return out
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("to", req.To).Int("attempts", attempts).Msg("send_failed: SMTP error")
+		out := failed(fiber.StatusInternalServerError, "send_failed", err.Error())
+		if cacheFailure(!smtp.IsTransient(err) && !errors.Is(err, context.Canceled)) {
+			remember(out)
+		}
+		return out
+	}
+	if result == nil || !result.OK {
+		errCode := "send_failed"
+		errMsg := ""
+		if result != nil && result.Error != nil {
+			errCode = string(result.Error.Reason)
+			errMsg = result.Error.Message
+		}
+		log.Warn().Str("to", req.To).Str("errmsg", errMsg).Int("attempts", attempts).Msg("send_failed")
+		out := failed(fiber.StatusInternalServerError, errCode, errMsg)
+		if cacheFailure(!smtp.IsTransientMessage(errMsg)) {
+			remember(out)
+		}
+		return out
+	}
+	messageID := result.MessageID
+	h.finish(id, result, history)
+	h.Status.Rename(id, messageID)
+	log.Info().Str("to", req.To).Str("message_id", messageID).Int("attempts", attempts).Msg("send ok")
+	return remember(outcome{status: fiber.StatusOK, resp: sendResponse{
+		HTTPSendResponse: provider.HTTPSendResponse{OK: true, MessageID: messageID, Provider: "smtp"},
+		Attempts:         attempts,
+	}})
+}
+
+// cacheFailure applies config.IdemCacheFailures to a failed send: "all" caches every
+// failure, "none" none, and "permanent" only those a retry cannot fix (e.g. 5xx replies).
+// Rejections before any attempt (rate_limited, provider_down) are never cached.
+func cacheFailure(permanent bool) bool {
+	switch config.IdemCacheFailures {
+	case "all":
+		return true
+	case "none":
+		return false
+	default:
+		return permanent
+	}
+}
+
+// replay rebuilds the response stored for an idempotency key. Entries stored before full
+// responses were kept carry no status and replay as 200.
+func replay(cached idempotency.Cached) outcome {
+	out := outcome{status: cached.Status, resp: sendResponse{HTTPSendResponse: provider.HTTPSendResponse{
+		OK: cached.OK, MessageID: cached.MessageID, Provider: cached.Provider,
+		ErrorCode: cached.ErrorCode, ErrorMessage: cached.ErrorMessage,
+	}, Attempts: cached.Attempts}}
+	if out.status == 0 {
+		out.status = fiber.StatusOK
+		out.resp.Provider = "smtp"
+	}
+	return out
+}
+
+var (
+	// errInProgress is returned by claim while another request holds the idempotency key.
+	errInProgress = errors.New("a request with this idempotency key is in progress")
+	// errIdemConflict is returned by claim when the key was used for a different payload.
+	errIdemConflict = errors.New("idempotency key was already used with a different request payload")
+)
+
+// idemPoll is how often claim checks whether the request holding a key has finished.
+const idemPoll = 25 * time.Millisecond
+
+// claim takes the idempotency key for this request, whose payload fingerprint is fp. It
+// returns the stored result when a request with the same key already finished, and
+// errIdemConflict when that request had a different payload. While another request
+// holds the key it waits for that result up to config.IdemWait, or fails right away
+// with errInProgress when config.IdemInProgress is "reject".
+func (h *Handler) claim(ctx context.Context, key, fp string) (idempotency.Cached, bool, error) {
+	var timeout <-chan time.Time
+	for {
+		cached, hit := h.Idem.Get(key)
+		if hit && cached.Conflicts(fp) {
+			return idempotency.Cached{}, false, errIdemConflict
+		}
+		if hit && !cached.Pending {
+			return cached, true, nil
+		}
+		if !hit && h.Idem.Reserve(key, fp, config.IdemLockTTL()) {
+			return idempotency.Cached{}, false, nil
+		}
+		if config.IdemInProgress == "reject" {
+			return idempotency.Cached{}, false, errInProgress
+		}
+		if timeout == nil {
+			t := time.NewTimer(config.IdemWait())
+			defer t.Stop()
+			timeout = t.C
+		}
+		select {
+		case <-ctx.Done():
+			return idempotency.Cached{}, false, errInProgress
+		case <-timeout:
+			return idempotency.Cached{}, false, errInProgress
+		case <-time.After(idemPoll):
+		}
+	}
+}
+
+// errResultNotOK marks an attempt whose SendResult reported failure without an error.
+var errResultNotOK = errors.New("send result not ok")
+
+// send delivers msg, retrying transient failures (421/450/451/452 replies, dropped
+// connections) according to h.Retry within ctx. Each attempt is bounded by the SMTP
+// timeout. It returns the last result, the history of failed attempts plus the final
+// one, and the last error; a failed SendResult is returned as-is with a nil error.
+// Attempts are recorded on the status of message id and reported to the breaker; while
+// the breaker is open no attempt is made and breaker.ErrOpen is returned. Each attempt
+// holds an SMTP session slot from the budget of priority: sync sends give up with
+// limiter.ErrBusy when the wait queue is full, async deliveries (mode "async") wait. A
+// batch session keeps its slot between attempts while its connection stays open.
+func (h *Handler) send(ctx context.Context, id, mode, priority string, msg *provider.Message) (*provider.SendResult, []deadletter.Attempt, error) {
+	return h.sendVia(ctx, h.Sender, id, mode, priority, msg)
+}
+
+// sendVia is send over via, e.g. a batch's reused SMTP session.
+func (h *Handler) sendVia(ctx context.Context, via smtpSender, id, mode, priority string, msg *provider.Message) (*provider.SendResult, []deadletter.Attempt, error) {
+	var result *provider.SendResult
+	var history []deadletter.Attempt
+	_, err := retry.Do(ctx, h.Retry, func(ctx context.Context, attempt int) (bool, error) {
+		actx, cancel := context.WithTimeout(ctx, config.SMTPTimeout())
+		defer cancel()
+		sessions := h.sessions(priority)
+		if b, ok := via.(*batchSession); ok {
+			release, err := b.hold(ctx, sessions, sessions.Acquire)
+			if err != nil {
+				return false, err
+			}
+			defer release()
+		} else if sessions != nil {
+			acquire := sessions.Acquire
+			if mode == "async" {
+				acquire = sessions.Wait
+			}
+			release, err := acquire(ctx)
+			if err != nil {
+				return false, err
+			}
+			defer release()
+		}
+		done := func(bool) {}
+		if h.Breaker != nil {
+			d, err := h.Breaker.Allow()
+			if err != nil {
+				return false, err
+			}
+			done = d
+		}
+		var err error
+		at := time.Now()
+		h.Status.Attempting(id)
+		result, err = via.Send(actx, msg)
+		if err == nil && (result == nil || !result.OK) {
+			err = errResultNotOK
+		}
+		if err == nil {
+			done(false)
+			history = append(history, deadletter.Attempt{At: at})
+			h.Status.Attempt(id, history[len(history)-1])
+			return false, nil
 		}
+		errMsg := err.Error()
+		transient := smtp.IsTransient(err)
+		code := smtp.ReplyCode(err)
+		if errors.Is(err, errResultNotOK) {
+			errMsg = ""
+			if result != nil && result.Error != nil {
+				errMsg = result.Error.Message
+			}
+			transient = smtp.IsTransientMessage(errMsg)
+			code = smtp.MessageReplyCode(errMsg)
+		}
+		// Only relay trouble counts against the breaker, not rejected recipients or cancellation.
+		done(transient && ctx.Err() == nil)
+		history = append(history, deadletter.Attempt{At: at, Error: errMsg, ReplyCode: code})
+		h.Status.Attempt(id, history[len(history)-1])
+		h.Log.Debug().Err(err).Str("to", msg.To).Int("attempt", attempt).Bool("transient", transient).Msg("send attempt failed")
+		return transient, err
+	}, func(attempt int, err error, wait time.Duration) {
+		h.Log.Warn().Err(err).Str("to", msg.To).Int("attempt", attempt).Dur("retry_in", wait).Msg("transient SMTP failure; retrying")
+	})
+	if errors.Is(err, errResultNotOK) {
+		err = nil
+	}
+	return result, history, err
+}
+
+// relayAccepted is the reply a relay gives when it accepts a message at the end of DATA.
+const relayAccepted = 250
+
+// finish records the outcome of a delivery on the status of message id.
+func (h *Handler) finish(id string, result *provider.SendResult, history []deadletter.Attempt) {
+	if result != nil && result.OK {
+		h.Status.Relay(id, result.MessageID, relayAccepted)
+		return
+	}
+	var last deadletter.Attempt
+	if n := len(history); n > 0 {
+		last = history[n-1]
+	}
+	h.Status.Fail(id, last.Error, last.ReplyCode)
+}
+
+// deadLetter records a message that could not be delivered.
+func (h *Handler) deadLetter(id, mode, priority, apiKey string, req *provider.HTTPSendRequest, history []deadletter.Attempt) {
+	if h.DeadLetters == nil {
+		return
+	}
+	e := &deadletter.Entry{ID: id, Request: *req, Mode: mode, Priority: priority, APIKey: apiKey, Attempts: history, FailedAt: time.Now()}
+	if n := len(history); n > 0 {
+		e.LastError = history[n-1].Error
+		e.LastReply = history[n-1].ReplyCode
+	}
+	if err := h.DeadLetters.Add(e); err != nil {
+		h.Log.Error().Err(err).Str("message_id", id).Msg("failed to store dead letter")
+		return
+	}
+	h.Log.Warn().Str("message_id", id).Str("to", req.To).Int("attempts", len(history)).Msg("message moved to dead letters")
+}
+
+// enqueue accepts req for background delivery; the outcome is 202 with the assigned message ID.
+// remember records the acceptance under the idempotency key so retries get the same message ID.
+func (h *Handler) enqueue(req *sendRequest, remember func(outcome) outcome) outcome {
+	job := &queue.Job{ID: newMessageID(), Request: req.HTTPSendRequest, EnqueuedAt: time.Now(), Priority: req.Priority,
+		APIKey: req.apiKey}
+	if req.SendAt != nil {
+		job.SendAt = req.SendAt.UTC()
+	}
+	h.Status.Begin(job.ID, req.To, "async", req.apiKey)
+	if status, code, err := h.queueJob(job); err != nil {
+		h.Status.Forget(job.ID)
+		return fail(status, code, err.Error())
+	}
+	return remember(outcome{status: fiber.StatusAccepted, resp: sendResponse{HTTPSendResponse: provider.HTTPSendResponse{
+		OK: true, MessageID: job.ID, Provider: "smtp",
+	}}})
+}
+
+// queueJob persists job to the outbox (when enabled) and queues it, or hands it to the
+// scheduler when SendAt is in the future. On failure it returns the HTTP status and
+// error code to report; the job is not kept.
+func (h *Handler) queueJob(job *queue.Job) (int, string, error) {
+	if h.Outbox != nil {
+		if err := h.Outbox.Put(job); err != nil {
+			if errors.Is(err, outbox.ErrFull) {
+				h.Log.Warn().Err(err).Str("to", job.Request.To).Msg("send rejected: outbox_full")
+				return fiber.StatusServiceUnavailable, "outbox_full", err
+			}
+			h.Log.Error().Err(err).Str("to", job.Request.To).Msg("send rejected: outbox write failed")
+			return fiber.StatusInternalServerError, "send_failed", errors.New("failed to persist message")
+		}
+	}
+	h.Status.Queue(job.ID, job.SendAt)
+	if h.Scheduler != nil && job.SendAt.After(time.Now()) {
+		if err := h.Scheduler.Schedule(job); err != nil {
+			h.forget(job.ID)
+			h.Log.Warn().Err(err).Str("to", job.Request.To).Msg("send rejected: schedule_full")
+			return fiber.StatusServiceUnavailable, "queue_full", errors.New("too many scheduled messages")
+		}
+		h.Log.Info().Str("to", job.Request.To).Str("message_id", job.ID).Str("priority", job.Priority).Time("send_at", job.SendAt).Msg("send scheduled")
+		return 0, "", nil
+	}
+	if err := h.Queue.Enqueue(job); err != nil {
+		h.forget(job.ID)
+		code := "queue_full"
+		if errors.Is(err, queue.ErrClosed) {
+			code = "provider_down"
+		}
+		h.Log.Warn().Err(err).Str("to", job.Request.To).Msg("send rejected: " + code)
+		return fiber.StatusServiceUnavailable, code, err
+	}
+	h.Log.Info().Str("to", job.Request.To).Str("message_id", job.ID).Str("priority", job.Priority).Int("lane_len", h.Queue.LaneLen(job.Priority)).Msg("send queued")
+	return 0, "", nil
+}
+
+// Deliver sends a queued job; it is the queue.DeliverFunc for async mode.
+// A job interrupted by shutdown stays in the outbox and is replayed on the next start.
+func (h *Handler) Deliver(ctx context.Context, job *queue.Job) {
+	log := h.Log
+	if job.APIKey != "" {
+		log = log.WithStr("api_key", job.APIKey)
+	}
+	result, history, err := h.send(ctx, job.ID, "async", job.Priority, buildMessage(&job.Request))
+	attempts := len(history)
+	if ctx.Err() != nil {
+		h.Shelve(job, history)
+		return
+	}
+	if errors.Is(err, breaker.ErrOpen) && h.Scheduler != nil {
+		job.SendAt = time.Now().Add(h.Breaker.RetryAfter())
+		if serr := h.Scheduler.Schedule(job); serr == nil {
+			h.Status.Queue(job.ID, job.SendAt)
+			log.Warn().Str("message_id", job.ID).Time("send_at", job.SendAt).Msg("circuit breaker open; delivery postponed (async)")
+			return
+		}
+	}
+	defer h.forget(job.ID)
+	h.finish(job.ID, result, history)
+	if err != nil || result == nil || !result.OK {
+		h.Dedup.Forget(job.ID) // not delivered: the same content may be sent again
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("to", job.Request.To).Str("message_id", job.ID).Int("attempts", attempts).Msg("send_failed: SMTP error (async)")
+		h.deadLetter(job.ID, "async", job.Priority, job.APIKey, &job.Request, history)
+		return
 	}
+	if result == nil || !result.OK {
+		errMsg := ""
+		if result != nil && result.Error != nil {
+			errMsg = result.Error.Message
+		}
+		log.Warn().Str("to", job.Request.To).Str("message_id", job.ID).Str("errmsg", errMsg).Int("attempts", attempts).Msg("send_failed (async)")
+		h.deadLetter(job.ID, "async", job.Priority, job.APIKey, &job.Request, history)
+		return
+	}
+	log.Info().Str("to", job.Request.To).Str("message_id", job.ID).Str("relay_message_id", result.MessageID).
+		Int("attempts", attempts).Dur("queued_for", time.Since(job.EnqueuedAt)).Msg("send ok (async)")
+}
+
+// Shelve keeps a job that could not be delivered before shutdown: with an outbox it stays
+// there and is replayed on the next start, otherwise it is moved to the dead letters.
+func (h *Handler) Shelve(job *queue.Job, history []deadletter.Attempt) {
+	if h.Outbox != nil {
+		h.Status.Queue(job.ID, job.SendAt)
+		h.Log.Warn().Str("message_id", job.ID).Msg("delivery interrupted by shutdown; kept for replay")
+		return
+	}
+	if h.DeadLetters == nil {
+		h.Log.Error().Str("message_id", job.ID).Str("to", job.Request.To).Msg("message not delivered before shutdown and lost")
+		return
+	}
+	e := &deadletter.Entry{ID: job.ID, Request: job.Request, Mode: "async", Priority: job.Priority, APIKey: job.APIKey,
+		Attempts: history, LastError: "not delivered before shutdown", FailedAt: time.Now()}
+	if err := h.DeadLetters.Add(e); err != nil {
+		h.Log.Error().Err(err).Str("message_id", job.ID).Msg("failed to store undelivered message")
+		return
+	}
+	h.Status.Fail(job.ID, e.LastError, 0)
+	h.Log.Warn().Str("message_id", job.ID).Msg("message not delivered before shutdown; moved to dead letters")
+}
+
+// sessions returns the SMTP session budget for priority.
+func (h *Handler) sessions(priority string) *limiter.Limiter {
+	if l, ok := h.LaneSessions[priority]; ok {
+		return l
+	}
+	return h.Sessions
+}
+
+// retryAfter formats d as a Retry-After value in whole seconds.
+func retryAfter(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// forget removes a job from the outbox once it needs no further delivery.
+func (h *Handler) forget(id string) {
+	if h.Outbox == nil {
+		return
+	}
+	if err := h.Outbox.Done(id); err != nil {
+		h.Log.Warn().Err(err).Str("message_id", id).Msg("outbox update failed")
+	}
+}
+
+// wantAsync reports whether req should be queued: the body "async" field wins, then
+// the "Prefer: respond-async" header (prefer), then config.SendAsync.
+func wantAsync(req *sendRequest, prefer bool) bool {
+	if req.Async != nil {
+		return *req.Async
+	}
+	return prefer || config.SendAsync
+}
+
+// preferAsync reports whether the request asks for an async response with
+// "Prefer: respond-async" (RFC 7240).
+func preferAsync(c *fiber.Ctx) bool {
+	return strings.Contains(strings.ToLower(c.Get("Prefer")), "respond-async")
+}
+
+// buildMessage resolves subject and body defaults and builds the provider-kit message.
+func buildMessage(req *provider.HTTPSendRequest) *provider.Message {
 	subject := req.Subject
 	if subject == "" {
 		subject = "Verification code"
@@ -68,36 +689,76 @@ func SendHandler(c *fiber.Ctx, smtpClient smtpSender, idemStore *idempotency.Sto
 	if len(req.Params) > 0 {
 		msg.WithParams(req.Params)
 	}
-	result, err := smtpClient.Send(c.Context(), msg)
-	if err != nil {
-		log.Warn().Err(err).Str("to", req.To).Msg("send_failed: SMTP error")
-		if req.IdempotencyKey != "" {
-			idemStore.Set(req.IdempotencyKey, false, "")
-		}
-		return c.Status(fiber.StatusInternalServerError).JSON(provider.HTTPSendResponse{
-			OK: false, ErrorCode: "send_failed", ErrorMessage: err.Error(),
-		})
+	return msg
+}
+
+// fingerprint identifies the payload of req for idempotency conflict detection: the
+// fields that decide what is sent, to whom and when, with channel and recipient
+// normalized. Transport options (async, priority) are not part of it.
+func fingerprint(req *sendRequest) string {
+	var sendAt string
+	if req.SendAt != nil {
+		sendAt = req.SendAt.UTC().Format(time.RFC3339Nano)
 	}
-	if result == nil || !result.OK {
-		errCode := "send_failed"
-		errMsg := ""
-		if result != nil && result.Error != nil {
-			errCode = string(result.Error.Reason)
-			errMsg = result.Error.Message
-		}
-		if req.IdempotencyKey != "" {
-			idemStore.Set(req.IdempotencyKey, false, "")
+	raw, _ := json.Marshal([]any{
+		strings.ToLower(strings.TrimSpace(req.Channel)),
+		strings.ToLower(strings.TrimSpace(req.To)),
+		req.Subject, req.Body, req.Template, req.Params, req.Locale, sendAt,
+	})
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// HeaderDerivedIdemKey echoes the idempotency key derived for a request that had none.
+const HeaderDerivedIdemKey = "X-Derived-Idempotency-Key"
+
+// deriveIdemKey sets an idempotency key on a request without one when config.IdemDeriveKeys
+// is on, and returns it ("" when none was derived). The key hashes the caller (API key
+// name, certificate identity or token subject), the request payload and the window of
+// config.IdemDeriveWindowSec seconds containing now. When stored reports the previous
+// window's key, that key is reused: the same message submitted twice less than a window
+// apart is always sent once, and resubmits up to two windows apart may be too.
+func deriveIdemKey(req *sendRequest, now time.Time, stored func(key string) bool) string {
+	if !config.IdemDeriveKeys || req.IdempotencyKey != "" {
+		return ""
+	}
+	fp := fingerprint(req)
+	key := func(bucket int64) string {
+		sum := sha256.Sum256([]byte(req.apiKey + ":" + fp + ":" + strconv.FormatInt(bucket, 10)))
+		return "derived-" + hex.EncodeToString(sum[:16])
+	}
+	bucket := now.Unix() / int64(max(config.IdemDeriveWindowSec, 1))
+	req.IdempotencyKey = key(bucket)
+	if prev := key(bucket - 1); stored != nil && stored(prev) {
+		req.IdempotencyKey = prev
+	}
+	return req.IdempotencyKey
+}
+
+// idemStored returns a function reporting whether the idempotency store holds a result
+// or an in-progress marker for a key of the caller apiKey.
+func (h *Handler) idemStored(apiKey string) func(key string) bool {
+	return func(key string) bool {
+		if h.Idem == nil {
+			return false
 		}
-		return c.Status(fiber.StatusInternalServerError).JSON(provider.HTTPSendResponse{
-			OK: false, ErrorCode: errCode, ErrorMessage: errMsg,
-		})
+		_, ok := h.Idem.Get(idemStoreKey(apiKey, key))
+		return ok
 	}
-	messageID := result.MessageID
-	if req.IdempotencyKey != "" {
-		idemStore.Set(req.IdempotencyKey, true, messageID)
+}
+
+// idemStoreKey is the store key for the idempotency key of the caller apiKey. Keys are
+// scoped to the caller, so one service never sees another's results or in-progress keys.
+func idemStoreKey(apiKey, key string) string {
+	if apiKey == "" || key == "" {
+		return key
 	}
-	log.Info().Str("to", req.To).Str("message_id", messageID).Msg("send ok")
-	return c.JSON(provider.HTTPSendResponse{
-		OK: true, MessageID: messageID, Provider: "smtp",
-	})
+	return apiKey + ":" + key
+}
+
+// newMessageID returns a random hex identifier for accepted messages.
+func newMessageID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
 }
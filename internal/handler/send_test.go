@@ -4,13 +4,27 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/soulteary/herald-smtp/internal/breaker"
 	"github.com/soulteary/herald-smtp/internal/config"
+	"github.com/soulteary/herald-smtp/internal/deadletter"
+	"github.com/soulteary/herald-smtp/internal/dedup"
 	"github.com/soulteary/herald-smtp/internal/idempotency"
+	"github.com/soulteary/herald-smtp/internal/limiter"
+	"github.com/soulteary/herald-smtp/internal/outbox"
+	"github.com/soulteary/herald-smtp/internal/queue"
+	"github.com/soulteary/herald-smtp/internal/retry"
+	"github.com/soulteary/herald-smtp/internal/status"
 	"github.com/soulteary/logger-kit"
 	"github.com/soulteary/provider-kit"
 )
@@ -144,36 +158,78 @@ func TestSendHandler_SendError(t *testing.T) {
 }
 
 func TestSendHandler_SendErrorWithIdempotencyKey(t *testing.T) {
-	// Error path with IdempotencyKey: idemStore.Set(key, false, "") is called
+	// A permanent failure is cached: the retry replays the original 500 without resending.
+	var calls atomic.Int32
 	mock := &mockSender{
 		sendFunc: func(ctx context.Context, msg *provider.Message) (*provider.SendResult, error) {
-			return nil, context.DeadlineExceeded
+			calls.Add(1)
+			return nil, &textproto.Error{Code: 550, Msg: "5.1.1 no such user"}
 		},
 	}
 	app := testApp(mock)
 
 	body, _ := json.Marshal(provider.HTTPSendRequest{To: "u@example.com", IdempotencyKey: "err-key"})
-	req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewReader(body))
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := app.Test(req, -1)
-	if err != nil {
-		t.Fatal(err)
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusInternalServerError {
+			t.Errorf("attempt %d: status = %d, want 500", i, resp.StatusCode)
+		}
+		var out provider.HTTPSendResponse
+		_ = json.NewDecoder(resp.Body).Decode(&out)
+		if out.OK || out.ErrorCode != "send_failed" || out.ErrorMessage == "" {
+			t.Errorf("attempt %d: response = %+v, want send_failed with message", i, out)
+		}
 	}
-	if resp.StatusCode != http.StatusInternalServerError {
-		t.Errorf("status = %d, want 500", resp.StatusCode)
+	if n := calls.Load(); n != 1 {
+		t.Errorf("sender called %d times, want 1", n)
 	}
-	// Retry with same key should get cached failure
-	req2 := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewReader(body))
-	req2.Header.Set("Content-Type", "application/json")
-	resp2, _ := app.Test(req2, -1)
-	if resp2.StatusCode != http.StatusOK {
-		t.Errorf("cached failure response status = %d (expect 200 with ok:false)", resp2.StatusCode)
+}
+
+func TestSendHandler_IdempotencyFailurePolicy(t *testing.T) {
+	cases := []struct {
+		policy string
+		err    error
+		calls  int32
+	}{
+		{"permanent", &textproto.Error{Code: 451, Msg: "4.3.0 try again"}, 2},
+		{"permanent", &textproto.Error{Code: 554, Msg: "5.7.1 rejected"}, 1},
+		{"all", &textproto.Error{Code: 451, Msg: "4.3.0 try again"}, 1},
+		{"none", &textproto.Error{Code: 554, Msg: "5.7.1 rejected"}, 2},
 	}
-	var out provider.HTTPSendResponse
-	_ = json.NewDecoder(resp2.Body).Decode(&out)
-	if out.OK {
-		t.Error("cached response should be ok=false")
+	for _, tc := range cases {
+		t.Run(tc.policy, func(t *testing.T) {
+			old, oldRetry := config.IdemCacheFailures, config.RetryMaxAttempts
+			defer func() { config.IdemCacheFailures, config.RetryMaxAttempts = old, oldRetry }()
+			config.IdemCacheFailures, config.RetryMaxAttempts = tc.policy, 1
+
+			var calls atomic.Int32
+			app := testApp(&mockSender{
+				sendFunc: func(ctx context.Context, msg *provider.Message) (*provider.SendResult, error) {
+					calls.Add(1)
+					return nil, tc.err
+				},
+			})
+			body, _ := json.Marshal(provider.HTTPSendRequest{To: "u@example.com", IdempotencyKey: "policy-key"})
+			for i := 0; i < 2; i++ {
+				req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewReader(body))
+				req.Header.Set("Content-Type", "application/json")
+				resp, err := app.Test(req, -1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if resp.StatusCode != http.StatusInternalServerError {
+					t.Errorf("attempt %d: status = %d, want 500", i, resp.StatusCode)
+				}
+			}
+			if n := calls.Load(); n != tc.calls {
+				t.Errorf("sender called %d times, want %d", n, tc.calls)
+			}
+		})
 	}
 }
 
@@ -362,3 +418,968 @@ func TestSendHandler_DefaultBodyWhenNoCode(t *testing.T) {
 		t.Errorf("body = %q, want %q", captured.Body, expectBody)
 	}
 }
+
+// asyncApp mounts a Handler with a started queue; deliveries are reported on the returned channel.
+func asyncApp(t *testing.T, mock smtpSender, queueSize int) (*fiber.App, *Handler, chan string) {
+	t.Helper()
+	log := logger.New(logger.Config{Level: logger.InfoLevel, ServiceName: "test"})
+	h := &Handler{Sender: mock, Idem: idempotency.NewStore(300), Log: log}
+	delivered := make(chan string, 10)
+	h.Queue = queue.New(queueSize, 1, func(ctx context.Context, job *queue.Job) {
+		h.Deliver(ctx, job)
+		delivered <- job.ID
+	})
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Post("/v1/send", h.Send)
+	return app, h, delivered
+}
+
+func TestSendHandler_AsyncAccepted(t *testing.T) {
+	var sentTo string
+	mock := &mockSender{
+		sendFunc: func(ctx context.Context, msg *provider.Message) (*provider.SendResult, error) {
+			sentTo = msg.To
+			return provider.NewSuccessResult("smtp", provider.ChannelEmail, "relay-id"), nil
+		},
+	}
+	app, h, delivered := asyncApp(t, mock, 10)
+	h.Queue.Start()
+	defer func() { _ = h.Queue.Close(context.Background()) }()
+
+	body := []byte(`{"to":"u@example.com","async":true}`)
+	req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202", resp.StatusCode)
+	}
+	var out provider.HTTPSendResponse
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	if !out.OK || out.MessageID == "" {
+		t.Fatalf("response OK=%v message_id=%q", out.OK, out.MessageID)
+	}
+	select {
+	case id := <-delivered:
+		if id != out.MessageID {
+			t.Errorf("delivered id = %q, want %q", id, out.MessageID)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("job was not delivered")
+	}
+	if sentTo != "u@example.com" {
+		t.Errorf("sent to %q", sentTo)
+	}
+}
+
+func TestSendHandler_AsyncPreferHeader(t *testing.T) {
+	app, _, _ := asyncApp(t, &mockSender{}, 10)
+
+	body, _ := json.Marshal(provider.HTTPSendRequest{To: "u@example.com", IdempotencyKey: "async-key"})
+	req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Prefer", "respond-async")
+	resp, _ := app.Test(req, -1)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202", resp.StatusCode)
+	}
+	var first provider.HTTPSendResponse
+	_ = json.NewDecoder(resp.Body).Decode(&first)
+
+	// A retry with the same key returns the accepted message ID without queueing again.
+	req2 := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewReader(body))
+	req2.Header.Set("Content-Type", "application/json")
+	req2.Header.Set("Prefer", "respond-async")
+	resp2, _ := app.Test(req2, -1)
+	var second provider.HTTPSendResponse
+	_ = json.NewDecoder(resp2.Body).Decode(&second)
+	if second.MessageID != first.MessageID {
+		t.Errorf("retry message_id = %q, want %q", second.MessageID, first.MessageID)
+	}
+}
+
+func TestSendHandler_AsyncQueueFull(t *testing.T) {
+	app, _, _ := asyncApp(t, &mockSender{}, 1) // workers not started
+
+	send := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewReader([]byte(`{"to":"u@example.com","async":true}`)))
+		req.Header.Set("Content-Type", "application/json")
+		resp, _ := app.Test(req, -1)
+		return resp.StatusCode
+	}
+	if got := send(); got != http.StatusAccepted {
+		t.Fatalf("first status = %d, want 202", got)
+	}
+	if got := send(); got != http.StatusServiceUnavailable {
+		t.Errorf("second status = %d, want 503 when queue is full", got)
+	}
+}
+
+func TestSendHandler_AsyncOptOut(t *testing.T) {
+	old := config.SendAsync
+	defer func() { config.SendAsync = old }()
+	config.SendAsync = true
+
+	mock := &mockSender{
+		sendFunc: func(ctx context.Context, msg *provider.Message) (*provider.SendResult, error) {
+			return provider.NewSuccessResult("smtp", provider.ChannelEmail, "sync-id"), nil
+		},
+	}
+	app, _, _ := asyncApp(t, mock, 10)
+	req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewReader([]byte(`{"to":"u@example.com","async":false}`)))
+	req.Header.Set("Content-Type", "application/json")
+	resp, _ := app.Test(req, -1)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200 for async:false", resp.StatusCode)
+	}
+	var out provider.HTTPSendResponse
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	if out.MessageID != "sync-id" {
+		t.Errorf("message_id = %q, want sync-id", out.MessageID)
+	}
+}
+
+func TestSendHandler_AsyncPersistsToOutbox(t *testing.T) {
+	app, h, delivered := asyncApp(t, &mockSender{
+		sendFunc: func(ctx context.Context, msg *provider.Message) (*provider.SendResult, error) {
+			return provider.NewSuccessResult("smtp", provider.ChannelEmail, "relay-id"), nil
+		},
+	}, 10)
+	ob, err := outbox.Open(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ob.Close() }()
+	h.Outbox = ob
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewReader([]byte(`{"to":"u@example.com","async":true}`)))
+	req.Header.Set("Content-Type", "application/json")
+	resp, _ := app.Test(req, -1)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202", resp.StatusCode)
+	}
+	if ob.Len() != 1 {
+		t.Fatalf("outbox Len = %d before delivery, want 1", ob.Len())
+	}
+	h.Queue.Start()
+	defer func() { _ = h.Queue.Close(context.Background()) }()
+	select {
+	case <-delivered:
+	case <-time.After(2 * time.Second):
+		t.Fatal("job was not delivered")
+	}
+	if ob.Len() != 0 {
+		t.Errorf("outbox Len = %d after delivery, want 0", ob.Len())
+	}
+}
+
+func TestSendHandler_AsyncOutboxFull(t *testing.T) {
+	app, h, _ := asyncApp(t, &mockSender{}, 10)
+	ob, err := outbox.Open(t.TempDir(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ob.Close() }()
+	h.Outbox = ob
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewReader([]byte(`{"to":"u@example.com","async":true}`)))
+	req.Header.Set("Content-Type", "application/json")
+	resp, _ := app.Test(req, -1)
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", resp.StatusCode)
+	}
+	var out provider.HTTPSendResponse
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	if out.ErrorCode != "outbox_full" {
+		t.Errorf("error_code = %q, want outbox_full", out.ErrorCode)
+	}
+	if h.Queue.Len() != 0 {
+		t.Errorf("queue Len = %d, rejected message must not be queued", h.Queue.Len())
+	}
+}
+
+func TestSendHandler_RetriesTransientFailure(t *testing.T) {
+	calls := 0
+	mock := &mockSender{
+		sendFunc: func(ctx context.Context, msg *provider.Message) (*provider.SendResult, error) {
+			calls++
+			if calls < 3 {
+				return nil, &textproto.Error{Code: 451, Msg: "4.3.0 try again later"}
+			}
+			return provider.NewSuccessResult("smtp", provider.ChannelEmail, "after-retry"), nil
+		},
+	}
+	log := logger.New(logger.Config{Level: logger.InfoLevel, ServiceName: "test"})
+	h := &Handler{Sender: mock, Idem: idempotency.NewStore(300), Log: log,
+		Retry: retry.Policy{MaxAttempts: 3, BaseDelay: time.Millisecond}}
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Post("/v1/send", h.Send)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewReader([]byte(`{"to":"u@example.com"}`)))
+	req.Header.Set("Content-Type", "application/json")
+	resp, _ := app.Test(req, -1)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	var out sendResponse
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	if !out.OK || out.MessageID != "after-retry" || out.Attempts != 3 {
+		t.Errorf("response OK=%v message_id=%q attempts=%d, want true/after-retry/3", out.OK, out.MessageID, out.Attempts)
+	}
+}
+
+func TestSendHandler_NoRetryOnPermanentFailure(t *testing.T) {
+	calls := 0
+	mock := &mockSender{
+		sendFunc: func(ctx context.Context, msg *provider.Message) (*provider.SendResult, error) {
+			calls++
+			return nil, &textproto.Error{Code: 550, Msg: "5.1.1 no such user"}
+		},
+	}
+	log := logger.New(logger.Config{Level: logger.InfoLevel, ServiceName: "test"})
+	h := &Handler{Sender: mock, Idem: idempotency.NewStore(300), Log: log,
+		Retry: retry.Policy{MaxAttempts: 3, BaseDelay: time.Millisecond}}
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Post("/v1/send", h.Send)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewReader([]byte(`{"to":"u@example.com"}`)))
+	req.Header.Set("Content-Type", "application/json")
+	resp, _ := app.Test(req, -1)
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500", resp.StatusCode)
+	}
+	var out sendResponse
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	if calls != 1 || out.Attempts != 1 {
+		t.Errorf("calls=%d attempts=%d, want 1/1", calls, out.Attempts)
+	}
+}
+
+func TestSendHandler_ScheduledSendAndCancel(t *testing.T) {
+	mock := &mockSender{
+		sendFunc: func(ctx context.Context, msg *provider.Message) (*provider.SendResult, error) {
+			t.Error("cancelled message must not be sent")
+			return provider.NewSuccessResult("smtp", provider.ChannelEmail, "x"), nil
+		},
+	}
+	app, h, _ := asyncApp(t, mock, 10)
+	h.Scheduler = queue.NewScheduler(h.Queue, 10)
+	h.Queue.Start()
+	h.Scheduler.Start()
+	defer func() {
+		h.Scheduler.Stop()
+		_ = h.Queue.Close(context.Background())
+	}()
+	app.Delete("/v1/messages/:id", h.CancelMessage)
+
+	sendAt := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	body := []byte(`{"to":"u@example.com","send_at":"` + sendAt + `"}`)
+	req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202", resp.StatusCode)
+	}
+	var out provider.HTTPSendResponse
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	if !h.Scheduler.Scheduled(out.MessageID) {
+		t.Fatalf("message %q not held by scheduler", out.MessageID)
+	}
+
+	resp, err = app.Test(httptest.NewRequest(http.MethodDelete, "/v1/messages/"+out.MessageID, nil), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("cancel status = %d, want 200", resp.StatusCode)
+	}
+	if h.Scheduler.Len() != 0 {
+		t.Errorf("scheduler Len = %d, want 0", h.Scheduler.Len())
+	}
+
+	resp, err = app.Test(httptest.NewRequest(http.MethodDelete, "/v1/messages/"+out.MessageID, nil), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("second cancel status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestSendHandler_ScheduledTooFarAhead(t *testing.T) {
+	app, h, _ := asyncApp(t, &mockSender{}, 10)
+	h.Scheduler = queue.NewScheduler(h.Queue, 10)
+	sendAt := time.Now().Add(config.ScheduleMaxAhead() + time.Hour).UTC().Format(time.RFC3339)
+	body := []byte(`{"to":"u@example.com","send_at":"` + sendAt + `"}`)
+	req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", resp.StatusCode)
+	}
+}
+
+func getStatus(t *testing.T, app *fiber.App, id string) (int, messageStatus) {
+	t.Helper()
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/v1/messages/"+id, nil), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out messageStatus
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	return resp.StatusCode, out
+}
+
+func TestSendHandler_StatusSyncRelayed(t *testing.T) {
+	mock := &mockSender{
+		sendFunc: func(ctx context.Context, msg *provider.Message) (*provider.SendResult, error) {
+			return provider.NewSuccessResult("smtp", provider.ChannelEmail, "relay-1"), nil
+		},
+	}
+	log := logger.New(logger.Config{Level: logger.InfoLevel, ServiceName: "test"})
+	h := &Handler{Sender: mock, Idem: idempotency.NewStore(300), Status: status.NewTracker(0, 0), Log: log}
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Post("/v1/send", h.Send)
+	app.Get("/v1/messages/:id", h.GetMessage)
+	app.Delete("/v1/messages/:id", h.CancelMessage)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewReader([]byte(`{"to":"u@example.com"}`)))
+	req.Header.Set("Content-Type", "application/json")
+	if _, err := app.Test(req, -1); err != nil {
+		t.Fatal(err)
+	}
+	code, out := getStatus(t, app, "relay-1")
+	if code != http.StatusOK {
+		t.Fatalf("status lookup = %d, want 200", code)
+	}
+	if out.Status != status.Relayed || out.Mode != "sync" || out.RelayReply != 250 || len(out.Attempts) != 1 {
+		t.Errorf("record = %+v", out.Record)
+	}
+	if code, _ := getStatus(t, app, "missing"); code != http.StatusNotFound {
+		t.Errorf("unknown lookup = %d, want 404", code)
+	}
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodDelete, "/v1/messages/relay-1", nil), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("cancel after relay = %d, want 409", resp.StatusCode)
+	}
+}
+
+func TestSendHandler_StatusAsyncBounced(t *testing.T) {
+	mock := &mockSender{
+		sendFunc: func(ctx context.Context, msg *provider.Message) (*provider.SendResult, error) {
+			return nil, &textproto.Error{Code: 550, Msg: "5.1.1 no such user"}
+		},
+	}
+	app, h, delivered := asyncApp(t, mock, 10)
+	h.Status = status.NewTracker(0, 0)
+	app.Get("/v1/messages/:id", h.GetMessage)
+	h.Queue.Start()
+	defer func() { _ = h.Queue.Close(context.Background()) }()
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewReader([]byte(`{"to":"u@example.com","async":true}`)))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var accepted provider.HTTPSendResponse
+	_ = json.NewDecoder(resp.Body).Decode(&accepted)
+	select {
+	case <-delivered:
+	case <-time.After(2 * time.Second):
+		t.Fatal("message not delivered")
+	}
+	code, out := getStatus(t, app, accepted.MessageID)
+	if code != http.StatusOK || out.Status != status.Bounced || out.RelayReply != 550 || out.LastError == "" {
+		t.Fatalf("lookup = %d %+v, want bounced with 550", code, out.Record)
+	}
+	want := []status.Status{status.Accepted, status.Queued, status.Attempting, status.Bounced}
+	if len(out.Events) != len(want) {
+		t.Fatalf("events = %+v", out.Events)
+	}
+	for i, st := range want {
+		if out.Events[i].Status != st {
+			t.Errorf("event %d = %s, want %s", i, out.Events[i].Status, st)
+		}
+	}
+}
+
+func TestSendHandler_BreakerOpenFailsFast(t *testing.T) {
+	calls := 0
+	mock := &mockSender{
+		sendFunc: func(ctx context.Context, msg *provider.Message) (*provider.SendResult, error) {
+			calls++
+			return nil, &textproto.Error{Code: 421, Msg: "4.4.2 service not available"}
+		},
+	}
+	log := logger.New(logger.Config{Level: logger.InfoLevel, ServiceName: "test"})
+	h := &Handler{Sender: mock, Idem: idempotency.NewStore(300), Log: log,
+		Breaker: breaker.New(breaker.Config{Window: 1, MinRequests: 1, OpenFor: time.Minute})}
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Post("/v1/send", h.Send)
+	post := func() *http.Response {
+		req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewReader([]byte(`{"to":"u@example.com"}`)))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if resp := post(); resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("first send status = %d, want 500", resp.StatusCode)
+	}
+	resp := post()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("send with open breaker status = %d, want 503", resp.StatusCode)
+	}
+	var out sendResponse
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	if out.ErrorCode != "provider_down" || out.Attempts != 0 {
+		t.Errorf("response = %+v, want provider_down without attempts", out)
+	}
+	if ra := resp.Header.Get("Retry-After"); ra == "" || ra == "0" {
+		t.Errorf("Retry-After = %q", ra)
+	}
+	if calls != 1 {
+		t.Errorf("relay calls = %d, want 1 (open breaker must not call the relay)", calls)
+	}
+}
+
+func TestSendHandler_SessionLimit429(t *testing.T) {
+	mock := &mockSender{
+		sendFunc: func(ctx context.Context, msg *provider.Message) (*provider.SendResult, error) {
+			return provider.NewSuccessResult("smtp", provider.ChannelEmail, "id"), nil
+		},
+	}
+	log := logger.New(logger.Config{Level: logger.InfoLevel, ServiceName: "test"})
+	h := &Handler{Sender: mock, Idem: idempotency.NewStore(300), Log: log, Sessions: limiter.New(1, 0, 0)}
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Post("/v1/send", h.Send)
+
+	release, _ := h.Sessions.Acquire(context.Background()) // the only session is busy
+	req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewReader([]byte(`{"to":"u@example.com"}`)))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want 429", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("Retry-After missing")
+	}
+	var out sendResponse
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	if out.ErrorCode != "rate_limited" {
+		t.Errorf("error_code = %q, want rate_limited", out.ErrorCode)
+	}
+
+	release()
+	req = httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewReader([]byte(`{"to":"u@example.com"}`)))
+	req.Header.Set("Content-Type", "application/json")
+	if resp, _ := app.Test(req, -1); resp.StatusCode != http.StatusOK {
+		t.Errorf("status after release = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestHandler_ShelveWithoutOutbox(t *testing.T) {
+	log := logger.New(logger.Config{Level: logger.InfoLevel, ServiceName: "test"})
+	dl, _ := deadletter.Open("", 0)
+	h := &Handler{Idem: idempotency.NewStore(300), DeadLetters: dl, Log: log}
+	job := &queue.Job{ID: "j1", Request: provider.HTTPSendRequest{To: "u@example.com"}, EnqueuedAt: time.Now()}
+	h.Shelve(job, nil)
+	e, err := dl.Get("j1")
+	if err != nil {
+		t.Fatalf("undelivered job not in dead letters: %v", err)
+	}
+	if e.Mode != "async" || e.LastError == "" {
+		t.Errorf("entry = %+v", e)
+	}
+}
+
+func TestSendHandler_PriorityLanes(t *testing.T) {
+	mock := &mockSender{
+		sendFunc: func(ctx context.Context, msg *provider.Message) (*provider.SendResult, error) {
+			return provider.NewSuccessResult("smtp", provider.ChannelEmail, "id"), nil
+		},
+	}
+	log := logger.New(logger.Config{Level: logger.InfoLevel, ServiceName: "test"})
+	h := &Handler{Sender: mock, Idem: idempotency.NewStore(300), Log: log, Sessions: limiter.New(1, 0, 0),
+		LaneSessions: map[string]*limiter.Limiter{PriorityCritical: limiter.New(1, 0, 0)}}
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Post("/v1/send", h.Send)
+
+	release, _ := h.Sessions.Acquire(context.Background()) // normal and bulk are saturated
+	defer release()
+	for _, tc := range []struct {
+		body string
+		want int
+	}{
+		{`{"to":"u@example.com","priority":"urgent"}`, http.StatusBadRequest},
+		{`{"to":"u@example.com","priority":"bulk"}`, http.StatusTooManyRequests},
+		{`{"to":"u@example.com"}`, http.StatusTooManyRequests},
+		{`{"to":"u@example.com","priority":"critical"}`, http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewReader([]byte(tc.body)))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.body, resp.StatusCode, tc.want)
+		}
+	}
+}
+
+func TestSendBatch(t *testing.T) {
+	var mu sync.Mutex
+	sent := map[string]int{}
+	mock := &mockSender{
+		sendFunc: func(ctx context.Context, msg *provider.Message) (*provider.SendResult, error) {
+			mu.Lock()
+			sent[msg.To]++
+			mu.Unlock()
+			if msg.To == "bad@example.com" {
+				return nil, &textproto.Error{Code: 550, Msg: "5.1.1 no such user"}
+			}
+			return provider.NewSuccessResult("smtp", provider.ChannelEmail, "relay-"+msg.To), nil
+		},
+	}
+	log := logger.New(logger.Config{Level: logger.InfoLevel, ServiceName: "test"})
+	h := &Handler{Sender: mock, Idem: idempotency.NewStore(300), Log: log}
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Post("/v1/send/batch", h.SendBatch)
+	post := func(contentType, body string) (int, batchResponse) {
+		req := httptest.NewRequest(http.MethodPost, "/v1/send/batch", bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", contentType)
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out batchResponse
+		_ = json.NewDecoder(resp.Body).Decode(&out)
+		return resp.StatusCode, out
+	}
+
+	code, out := post("application/json", `[
+		{"to":"a@example.com","idempotency_key":"k-a"},
+		{"subject":"no recipient"},
+		{"to":"bad@example.com"},
+		{"to":"c@example.com","priority":"bulk"}
+	]`)
+	if code != http.StatusOK || out.OK || len(out.Results) != 4 {
+		t.Fatalf("status=%d ok=%v results=%d", code, out.OK, len(out.Results))
+	}
+	want := []struct {
+		status int
+		code   string
+	}{{200, ""}, {400, "invalid_destination"}, {500, "send_failed"}, {200, ""}}
+	for i, w := range want {
+		r := out.Results[i]
+		if r.Index != i || r.Status != w.status || r.ErrorCode != w.code {
+			t.Errorf("result %d = %+v, want status %d code %q", i, r, w.status, w.code)
+		}
+	}
+	if out.Results[0].MessageID != "relay-a@example.com" {
+		t.Errorf("message_id = %q", out.Results[0].MessageID)
+	}
+
+	// NDJSON, with a malformed line and an idempotent retry of a@example.com.
+	code, out = post("application/x-ndjson", "{\"to\":\"a@example.com\",\"idempotency_key\":\"k-a\"}\n\nnot json\n{\"to\":\"d@example.com\"}\n")
+	if code != http.StatusOK || len(out.Results) != 3 {
+		t.Fatalf("ndjson status=%d results=%d", code, len(out.Results))
+	}
+	if r := out.Results[0]; !r.OK || r.MessageID != "relay-a@example.com" {
+		t.Errorf("idempotent item = %+v", r)
+	}
+	if out.Results[1].Status != http.StatusBadRequest || !out.Results[2].OK {
+		t.Errorf("results = %+v", out.Results)
+	}
+	if sent["a@example.com"] != 1 {
+		t.Errorf("a@example.com sent %d times, want 1", sent["a@example.com"])
+	}
+
+	for _, body := range []string{`[]`, `{"to":"a@example.com"}`} {
+		if code, _ := post("application/json", body); code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", body, code)
+		}
+	}
+	old := config.BatchMaxItems
+	defer func() { config.BatchMaxItems = old }()
+	config.BatchMaxItems = 1
+	if code, _ := post("application/json", `[{"to":"a@example.com"},{"to":"b@example.com"}]`); code != http.StatusBadRequest {
+		t.Errorf("oversized batch status = %d, want 400", code)
+	}
+}
+
+func TestSendBatch_Deadline(t *testing.T) {
+	oldDeadline, oldConcurrency := config.BatchDeadlineSec, config.BatchConcurrency
+	defer func() { config.BatchDeadlineSec, config.BatchConcurrency = oldDeadline, oldConcurrency }()
+	config.BatchDeadlineSec, config.BatchConcurrency = 1, 1
+
+	var calls atomic.Int32
+	mock := &mockSender{
+		sendFunc: func(ctx context.Context, msg *provider.Message) (*provider.SendResult, error) {
+			calls.Add(1)
+			<-ctx.Done() // a relay slower than the batch deadline
+			return nil, ctx.Err()
+		},
+	}
+	log := logger.New(logger.Config{Level: logger.InfoLevel, ServiceName: "test"})
+	h := &Handler{Sender: mock, Idem: idempotency.NewStore(300), Log: log}
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Post("/v1/send/batch", h.SendBatch)
+
+	body := `[{"to":"a@example.com"},{"to":"b@example.com"},{"to":"c@example.com"}]`
+	req := httptest.NewRequest(http.MethodPost, "/v1/send/batch", bytes.NewReader([]byte(body)))
+	req.Header.Set("Content-Type", "application/json")
+	start := time.Now()
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("batch took %v, want about the 1s deadline", elapsed)
+	}
+	var out batchResponse
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	if out.OK || len(out.Results) != 3 || calls.Load() != 1 {
+		t.Fatalf("ok=%v results=%d relay calls=%d; want a failed batch of 3 with 1 call", out.OK, len(out.Results), calls.Load())
+	}
+	for _, r := range out.Results[1:] {
+		if r.Status != http.StatusServiceUnavailable || r.ErrorCode != "provider_down" || r.RetryAfter == 0 {
+			t.Errorf("unsent item = %+v, want 503 provider_down with retry_after", r)
+		}
+	}
+}
+
+// fakeSession is a reused connection that drops after a failed send.
+type fakeSession struct {
+	mockSender
+	connected bool
+}
+
+func (s *fakeSession) Send(ctx context.Context, msg *provider.Message) (*provider.SendResult, error) {
+	result, err := s.mockSender.Send(ctx, msg)
+	s.connected = err == nil
+	return result, err
+}
+
+func (s *fakeSession) Connected() bool { return s.connected }
+
+func (s *fakeSession) Close() error {
+	s.connected = false
+	return nil
+}
+
+func TestBatchSession_HoldsSlotWhileConnected(t *testing.T) {
+	log := logger.New(logger.Config{Level: logger.InfoLevel, ServiceName: "test"})
+	h := &Handler{Idem: idempotency.NewStore(300), Log: log, Sessions: limiter.New(2, 0, 0),
+		LaneSessions: map[string]*limiter.Limiter{PriorityBulk: limiter.New(1, 0, 0)}}
+	fs := &fakeSession{mockSender: mockSender{
+		sendFunc: func(ctx context.Context, msg *provider.Message) (*provider.SendResult, error) {
+			if msg.To == "drop@example.com" {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return provider.NewSuccessResult("smtp", provider.ChannelEmail, "id"), nil
+		},
+	}}
+	b := &batchSession{session: fs}
+	send := func(to, priority string) {
+		t.Helper()
+		_, _, _ = h.sendVia(context.Background(), b, "", "sync", priority, provider.NewMessage(to))
+	}
+	inUse := func(l *limiter.Limiter) int { return l.Stats().InUse }
+
+	send("a@example.com", PriorityNormal)
+	send("b@example.com", PriorityNormal)
+	if got := inUse(h.Sessions); got != 1 {
+		t.Errorf("open session holds %d slots between items, want 1", got)
+	}
+	send("c@example.com", PriorityBulk)
+	if n, bulk := inUse(h.Sessions), inUse(h.LaneSessions[PriorityBulk]); n != 0 || bulk != 1 {
+		t.Errorf("after a bulk item: normal slots %d, bulk slots %d, want 0 and 1", n, bulk)
+	}
+	send("drop@example.com", PriorityBulk)
+	if got := inUse(h.LaneSessions[PriorityBulk]); got != 0 {
+		t.Errorf("dropped session still holds %d slots", got)
+	}
+	send("d@example.com", PriorityNormal)
+	b.end()
+	if got := inUse(h.Sessions); got != 0 || fs.connected {
+		t.Errorf("ended session holds %d slots, connected=%v", got, fs.connected)
+	}
+}
+
+func TestSendHandler_ConcurrentSameKey(t *testing.T) {
+	for _, mode := range []string{"wait", "reject"} {
+		t.Run(mode, func(t *testing.T) {
+			old := config.IdemInProgress
+			defer func() { config.IdemInProgress = old }()
+			config.IdemInProgress = mode
+
+			started, release := make(chan struct{}), make(chan struct{})
+			var calls int32
+			mock := &mockSender{
+				sendFunc: func(ctx context.Context, msg *provider.Message) (*provider.SendResult, error) {
+					if atomic.AddInt32(&calls, 1) == 1 {
+						close(started)
+					}
+					<-release
+					return provider.NewSuccessResult("smtp", provider.ChannelEmail, "relay-1"), nil
+				},
+			}
+			app := testApp(mock)
+			post := func() (*http.Response, sendResponse) {
+				req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewReader([]byte(`{"to":"u@example.com"}`)))
+				req.Header.Set("Content-Type", "application/json")
+				req.Header.Set("Idempotency-Key", "same")
+				resp, err := app.Test(req, -1)
+				if err != nil {
+					t.Error(err)
+					return nil, sendResponse{}
+				}
+				var out sendResponse
+				_ = json.NewDecoder(resp.Body).Decode(&out)
+				return resp, out
+			}
+			first := make(chan sendResponse, 1)
+			go func() {
+				_, out := post()
+				first <- out
+			}()
+			<-started
+			second := make(chan *http.Response, 1)
+			var secondOut sendResponse
+			go func() {
+				resp, out := post()
+				secondOut = out
+				second <- resp
+			}()
+			if mode == "wait" {
+				time.Sleep(50 * time.Millisecond) // the second request is waiting
+				close(release)
+			}
+			resp := <-second
+			if mode == "reject" {
+				close(release)
+			}
+			out := <-first
+			if !out.OK || out.MessageID != "relay-1" {
+				t.Fatalf("first = %+v", out)
+			}
+			if mode == "wait" && (resp.StatusCode != http.StatusOK || secondOut.MessageID != "relay-1") {
+				t.Errorf("second = %d %+v, want the first result", resp.StatusCode, secondOut)
+			}
+			if mode == "reject" && (resp.StatusCode != http.StatusConflict || secondOut.ErrorCode != "in_progress") {
+				t.Errorf("second = %d %+v, want 409 in_progress", resp.StatusCode, secondOut)
+			}
+			if n := atomic.LoadInt32(&calls); n != 1 {
+				t.Errorf("relay calls = %d, want 1", n)
+			}
+		})
+	}
+}
+
+func TestSendHandler_IdempotencyConflict(t *testing.T) {
+	var calls int32
+	mock := &mockSender{
+		sendFunc: func(ctx context.Context, msg *provider.Message) (*provider.SendResult, error) {
+			atomic.AddInt32(&calls, 1)
+			return provider.NewSuccessResult("smtp", provider.ChannelEmail, "relay-1"), nil
+		},
+	}
+	app := testApp(mock)
+	post := func(body string) (int, sendResponse) {
+		req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out sendResponse
+		_ = json.NewDecoder(resp.Body).Decode(&out)
+		return resp.StatusCode, out
+	}
+	first := `{"to":"u@example.com","params":{"code":"123456","name":"U"},"idempotency_key":"k1"}`
+	if code, out := post(first); code != http.StatusOK || !out.OK {
+		t.Fatalf("first = %d %+v", code, out)
+	}
+	// Same payload, normalized recipient and reordered params: a replay, not a conflict.
+	if code, out := post(`{"idempotency_key":"k1","to":" U@Example.com","params":{"name":"U","code":"123456"}}`); code != http.StatusOK || out.MessageID != "relay-1" {
+		t.Errorf("replay = %d %+v", code, out)
+	}
+	for _, body := range []string{
+		`{"to":"other@example.com","params":{"code":"123456","name":"U"},"idempotency_key":"k1"}`,
+		`{"to":"u@example.com","params":{"code":"654321","name":"U"},"idempotency_key":"k1"}`,
+		`{"to":"u@example.com","subject":"Hi","params":{"code":"123456","name":"U"},"idempotency_key":"k1"}`,
+	} {
+		code, out := post(body)
+		if code != http.StatusConflict || out.ErrorCode != "idempotency_conflict" {
+			t.Errorf("%s: %d %+v, want 409 idempotency_conflict", body, code, out)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("relay calls = %d, want 1", n)
+	}
+}
+
+func TestSendHandler_DerivedIdempotencyKey(t *testing.T) {
+	old := config.IdemDeriveKeys
+	defer func() { config.IdemDeriveKeys = old }()
+
+	var calls atomic.Int32
+	app := testApp(&mockSender{
+		sendFunc: func(ctx context.Context, msg *provider.Message) (*provider.SendResult, error) {
+			calls.Add(1)
+			return &provider.SendResult{OK: true, MessageID: "relay-" + strconv.Itoa(int(calls.Load()))}, nil
+		},
+	})
+	post := func(payload provider.HTTPSendRequest) (*http.Response, provider.HTTPSendResponse) {
+		t.Helper()
+		body, _ := json.Marshal(payload)
+		req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out provider.HTTPSendResponse
+		_ = json.NewDecoder(resp.Body).Decode(&out)
+		return resp, out
+	}
+	code := provider.HTTPSendRequest{To: "u@example.com", Subject: "Code", Body: "123456"}
+
+	config.IdemDeriveKeys = false
+	post(code)
+	if resp, _ := post(code); resp.Header.Get(HeaderDerivedIdemKey) != "" || calls.Load() != 2 {
+		t.Fatalf("derivation off: header %q, %d sends; want none, 2", resp.Header.Get(HeaderDerivedIdemKey), calls.Load())
+	}
+
+	config.IdemDeriveKeys = true
+	calls.Store(0)
+	r1, o1 := post(code)
+	r2, o2 := post(code)
+	k1, k2 := r1.Header.Get(HeaderDerivedIdemKey), r2.Header.Get(HeaderDerivedIdemKey)
+	if k1 == "" || k1 != k2 {
+		t.Errorf("derived keys = %q, %q; want the same non-empty key", k1, k2)
+	}
+	if calls.Load() != 1 || o1.MessageID != o2.MessageID {
+		t.Errorf("double submit: %d sends, ids %q %q; want 1 send, same id", calls.Load(), o1.MessageID, o2.MessageID)
+	}
+
+	other := code
+	other.Body = "654321"
+	if r, _ := post(other); r.Header.Get(HeaderDerivedIdemKey) == k1 || calls.Load() != 2 {
+		t.Errorf("different body: key %q, %d sends; want a new key and a second send", r.Header.Get(HeaderDerivedIdemKey), calls.Load())
+	}
+
+	explicit := code
+	explicit.IdempotencyKey = "caller-key"
+	if r, _ := post(explicit); r.Header.Get(HeaderDerivedIdemKey) != "" {
+		t.Error("key derived for a request that has one")
+	}
+}
+
+func TestDeriveIdemKey_Window(t *testing.T) {
+	oldOn, oldWindow := config.IdemDeriveKeys, config.IdemDeriveWindowSec
+	defer func() { config.IdemDeriveKeys, config.IdemDeriveWindowSec = oldOn, oldWindow }()
+	config.IdemDeriveKeys, config.IdemDeriveWindowSec = true, 60
+
+	base := time.Unix(1_800_000_000, 0) // a window boundary
+	key := func(now time.Time) string {
+		req := sendRequest{HTTPSendRequest: provider.HTTPSendRequest{To: "U@Example.com", Subject: "s", Body: "b"}}
+		return deriveIdemKey(&req, now, nil)
+	}
+	if key(base) != key(base.Add(59*time.Second)) {
+		t.Error("keys differ within one window")
+	}
+	if key(base) == key(base.Add(60*time.Second)) {
+		t.Error("keys equal across windows")
+	}
+
+	// A stored key of the previous window is reused across the boundary.
+	stored := map[string]bool{key(base.Add(59 * time.Second)): true}
+	req := sendRequest{HTTPSendRequest: provider.HTTPSendRequest{To: "U@Example.com", Subject: "s", Body: "b"}}
+	if got := deriveIdemKey(&req, base.Add(61*time.Second), func(k string) bool { return stored[k] }); got != key(base) {
+		t.Errorf("key after boundary = %q, want the previous window's %q", got, key(base))
+	}
+
+	billing := sendRequest{HTTPSendRequest: provider.HTTPSendRequest{To: "U@Example.com", Subject: "s", Body: "b"}, apiKey: "billing"}
+	if deriveIdemKey(&billing, base, nil) == key(base) {
+		t.Error("callers with the same payload share a derived key")
+	}
+}
+
+func TestSendHandler_DuplicateContentSuppressed(t *testing.T) {
+	var calls atomic.Int32
+	var fail atomic.Bool
+	mock := &mockSender{
+		sendFunc: func(ctx context.Context, msg *provider.Message) (*provider.SendResult, error) {
+			n := calls.Add(1)
+			if fail.Load() {
+				return nil, &textproto.Error{Code: 550, Msg: "5.1.1 no such user"}
+			}
+			return provider.NewSuccessResult("smtp", provider.ChannelEmail, "relay-"+strconv.Itoa(int(n))), nil
+		},
+	}
+	app, h, delivered := asyncApp(t, mock, 10)
+	h.Dedup = dedup.New(time.Minute, 100)
+	h.Queue.Start()
+	defer func() { _ = h.Queue.Close(context.Background()) }()
+
+	post := func(body string) (int, sendResponse) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out sendResponse
+		_ = json.NewDecoder(resp.Body).Decode(&out)
+		return resp.StatusCode, out
+	}
+
+	// A client minting a fresh idempotency key per retry still sends once.
+	_, first := post(`{"to":"u@example.com","params":{"code":"123456"},"idempotency_key":"k1"}`)
+	status, again := post(`{"to":"U@example.com","params":{"code":"123456"},"idempotency_key":"k2"}`)
+	if status != http.StatusOK || !again.OK || !again.Duplicate || again.MessageID != first.MessageID {
+		t.Errorf("duplicate = %d %+v; want 200 duplicate of %q", status, again, first.MessageID)
+	}
+	if _, other := post(`{"to":"u@example.com","params":{"code":"654321"}}`); other.Duplicate {
+		t.Error("different content suppressed")
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("sender called %d times, want 2", n)
+	}
+
+	// An async message that fails is forgotten, so the content can be sent again.
+	fail.Store(true)
+	_, queued := post(`{"to":"v@example.com","body":"hello","async":true}`)
+	select {
+	case <-delivered:
+	case <-time.After(2 * time.Second):
+		t.Fatal("job was not delivered")
+	}
+	fail.Store(false)
+	if _, retried := post(`{"to":"v@example.com","body":"hello"}`); retried.Duplicate || retried.MessageID == queued.MessageID {
+		t.Errorf("resend after failure = %+v; want a new send", retried)
+	}
+}
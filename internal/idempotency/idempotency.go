@@ -1,55 +1,235 @@
 package idempotency
 
 import (
+	"container/list"
 	"sync"
 	"time"
 )
 
+// Store caches send results by idempotency key for a TTL. MemoryStore is the default;
+// RedisStore shares results between replicas.
+type Store interface {
+	// Get returns the cached result for key; ok=false means miss.
+	Get(key string) (Cached, bool)
+	// Put stores the result for key with the store TTL.
+	Put(key string, c Cached)
+	// Reserve marks key in progress for up to ttl, recording the request fingerprint,
+	// unless it is already present. It reports whether the caller now holds key and
+	// must Put or Release it.
+	Reserve(key, fingerprint string, ttl time.Duration) bool
+	// Release removes the in-progress marker of key, leaving stored results alone.
+	Release(key string)
+}
+
+// Cached is a stored send response, replayed for retries with the same key. Pending marks
+// a key whose request is still in progress. Fingerprint identifies the request payload,
+// so a key reused for a different request can be detected.
+type Cached struct {
+	OK           bool   `json:"ok"`
+	MessageID    string `json:"message_id,omitempty"`
+	Pending      bool   `json:"pending,omitempty"`
+	Fingerprint  string `json:"fingerprint,omitempty"`
+	Status       int    `json:"status,omitempty"` // HTTP status of the response
+	Provider     string `json:"provider,omitempty"`
+	ErrorCode    string `json:"error_code,omitempty"`
+	ErrorMessage string `json:"error_message,omitempty"`
+	Attempts     int    `json:"attempts,omitempty"`
+}
+
+// Conflicts reports whether a request with fingerprint reuses a key stored for a
+// different payload. Entries without a fingerprint never conflict.
+func (c Cached) Conflicts(fingerprint string) bool {
+	return c.Fingerprint != "" && fingerprint != "" && c.Fingerprint != fingerprint
+}
+
 type entry struct {
-	ok        bool
-	messageID string
+	key       string
+	c         Cached
 	expiresAt time.Time
 }
 
-// Store is an in-memory idempotency store. Same key within TTL returns cached response.
-type Store struct {
-	mu     sync.RWMutex
-	m      map[string]entry
-	ttlSec int
+// Stats reports the size of a MemoryStore and how many entries it has dropped.
+type Stats struct {
+	Entries    int   `json:"entries"`
+	MaxEntries int   `json:"max_entries"`
+	Expired    int64 `json:"expired"` // removed by the janitor after their TTL
+	Evicted    int64 `json:"evicted"` // least recently used, removed to stay under MaxEntries
 }
 
-// NewStore creates a store with the given TTL in seconds.
-func NewStore(ttlSec int) *Store {
-	s := &Store{m: make(map[string]entry), ttlSec: ttlSec}
+// MemoryStore is an in-memory idempotency store. Same key within TTL returns cached response.
+// With a maximum entry count the least recently used entries are evicted; a janitor
+// started with StartJanitor removes expired ones. StartSnapshots and Load keep results
+// across restarts in a file.
+type MemoryStore struct {
+	mu         sync.Mutex
+	m          map[string]*list.Element
+	lru        *list.List // *entry, most recently used first
+	ttlSec     int
+	maxEntries int
+	expired    int64
+	evicted    int64
+
+	snapshotPath string
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	wg       sync.WaitGroup // background goroutines
+}
+
+// NewStore creates an unbounded in-memory store with the given TTL in seconds.
+func NewStore(ttlSec int) *MemoryStore {
+	return NewMemoryStore(ttlSec, 0)
+}
+
+// NewMemoryStore creates an in-memory store holding at most maxEntries entries
+// (0 = unbounded) for ttlSec seconds each (300 when <= 0).
+func NewMemoryStore(ttlSec, maxEntries int) *MemoryStore {
+	s := &MemoryStore{m: make(map[string]*list.Element), lru: list.New(), ttlSec: ttlSec, maxEntries: maxEntries,
+		stop: make(chan struct{})}
 	if s.ttlSec <= 0 {
 		s.ttlSec = 300
 	}
+	if s.maxEntries < 0 {
+		s.maxEntries = 0
+	}
 	return s
 }
 
-type cached struct {
-	OK        bool
-	MessageID string
+// Get returns cached result for key if not expired. ok=false means miss.
+func (s *MemoryStore) Get(key string) (Cached, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.m[key]
+	if !ok {
+		return Cached{}, false
+	}
+	e := el.Value.(*entry)
+	if time.Now().After(e.expiresAt) {
+		return Cached{}, false
+	}
+	s.lru.MoveToFront(el)
+	return e.c, true
 }
 
-// Get returns cached result for key if not expired. ok=false means miss.
-func (s *Store) Get(key string) (cached, bool) {
-	s.mu.RLock()
-	e, ok := s.m[key]
-	s.mu.RUnlock()
-	if !ok || time.Now().After(e.expiresAt) {
-		return cached{}, false
+// Set stores a result without fingerprint; see Put.
+func (s *MemoryStore) Set(key string, ok bool, messageID string) {
+	s.Put(key, Cached{OK: ok, MessageID: messageID})
+}
+
+// Put stores the result for key with TTL, evicting the least recently used entries
+// when the store is full.
+func (s *MemoryStore) Put(key string, c Cached) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c.Pending = false
+	s.put(&entry{key: key, c: c, expiresAt: time.Now().Add(time.Duration(s.ttlSec) * time.Second)})
+}
+
+// Reserve marks key in progress for ttl unless an unexpired entry exists.
+func (s *MemoryStore) Reserve(key, fingerprint string, ttl time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.m[key]; ok && !time.Now().After(el.Value.(*entry).expiresAt) {
+		return false
 	}
-	return cached{OK: e.ok, MessageID: e.messageID}, true
+	s.put(&entry{key: key, c: Cached{Pending: true, Fingerprint: fingerprint}, expiresAt: time.Now().Add(ttl)})
+	return true
 }
 
-// Set stores the result for key with TTL.
-func (s *Store) Set(key string, ok bool, messageID string) {
+// Release removes key if it is still marked in progress.
+func (s *MemoryStore) Release(key string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.m[key] = entry{
-		ok:        ok,
-		messageID: messageID,
-		expiresAt: time.Now().Add(time.Duration(s.ttlSec) * time.Second),
+	if el, ok := s.m[key]; ok && el.Value.(*entry).c.Pending {
+		s.remove(el)
+	}
+}
+
+// put stores e as the most recently used entry; s.mu must be held.
+func (s *MemoryStore) put(e *entry) {
+	if el, found := s.m[e.key]; found {
+		el.Value = e
+		s.lru.MoveToFront(el)
+		return
 	}
+	s.m[e.key] = s.lru.PushFront(e)
+	for s.maxEntries > 0 && s.lru.Len() > s.maxEntries {
+		s.remove(s.lru.Back())
+		s.evicted++
+	}
+}
+
+// Len returns the number of stored entries, including expired ones not yet swept.
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Len()
+}
+
+// Stats returns the current size and eviction counters.
+func (s *MemoryStore) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Stats{Entries: s.lru.Len(), MaxEntries: s.maxEntries, Expired: s.expired, Evicted: s.evicted}
+}
+
+// Sweep removes expired entries and returns how many it removed.
+func (s *MemoryStore) Sweep() int {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for el := s.lru.Back(); el != nil; {
+		prev := el.Prev()
+		if now.After(el.Value.(*entry).expiresAt) {
+			s.remove(el)
+			n++
+		}
+		el = prev
+	}
+	s.expired += int64(n)
+	return n
+}
+
+// StartJanitor sweeps expired entries every interval until Close.
+func (s *MemoryStore) StartJanitor(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-t.C:
+				s.Sweep()
+			}
+		}
+	}()
+}
+
+// Close stops the janitor and periodic snapshots, then writes a final snapshot when
+// StartSnapshots was called.
+func (s *MemoryStore) Close() error {
+	var err error
+	s.stopOnce.Do(func() {
+		close(s.stop)
+		s.wg.Wait()
+		s.mu.Lock()
+		path := s.snapshotPath
+		s.mu.Unlock()
+		if path != "" {
+			err = s.Snapshot(path)
+		}
+	})
+	return err
+}
+
+func (s *MemoryStore) remove(el *list.Element) {
+	s.lru.Remove(el)
+	delete(s.m, el.Value.(*entry).key)
 }
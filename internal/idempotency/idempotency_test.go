@@ -63,3 +63,108 @@ func TestStore_SetFailureThenGet(t *testing.T) {
 		t.Errorf("got OK=%v MessageID=%q, want OK=false MessageID=", c.OK, c.MessageID)
 	}
 }
+
+func TestMemoryStore_EvictsLeastRecentlyUsed(t *testing.T) {
+	s := NewMemoryStore(300, 2)
+	s.Set("a", true, "1")
+	s.Set("b", true, "2")
+	s.Get("a") // a is now more recent than b
+	s.Set("c", true, "3")
+	if _, hit := s.Get("b"); hit {
+		t.Error("b should have been evicted")
+	}
+	for _, k := range []string{"a", "c"} {
+		if _, hit := s.Get(k); !hit {
+			t.Errorf("%s should still be cached", k)
+		}
+	}
+	s.Set("a", false, "") // overwrite does not grow the store
+	if st := s.Stats(); st.Entries != 2 || st.MaxEntries != 2 || st.Evicted != 1 {
+		t.Errorf("Stats = %+v", st)
+	}
+}
+
+func TestMemoryStore_Sweep(t *testing.T) {
+	s := NewMemoryStore(1, 0)
+	s.Set("old", true, "1")
+	time.Sleep(1100 * time.Millisecond)
+	s.Set("new", true, "2")
+	if n := s.Sweep(); n != 1 {
+		t.Errorf("Sweep removed %d, want 1", n)
+	}
+	if st := s.Stats(); st.Entries != 1 || st.Expired != 1 {
+		t.Errorf("Stats = %+v", st)
+	}
+	if _, hit := s.Get("new"); !hit {
+		t.Error("unexpired entry swept")
+	}
+}
+
+func TestMemoryStore_Janitor(t *testing.T) {
+	s := NewMemoryStore(1, 0)
+	s.Set("k", true, "1")
+	s.StartJanitor(50 * time.Millisecond)
+	defer func() { _ = s.Close() }()
+	deadline := time.Now().Add(3 * time.Second)
+	for s.Len() != 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if s.Len() != 0 {
+		t.Errorf("Len = %d, janitor did not remove the expired entry", s.Len())
+	}
+	if err := s.Close(); err != nil { // Close is idempotent
+		t.Errorf("second Close: %v", err)
+	}
+}
+
+func TestMemoryStore_ReserveAndRelease(t *testing.T) {
+	s := NewStore(300)
+	if !s.Reserve("k", "", time.Minute) {
+		t.Fatal("first Reserve should succeed")
+	}
+	if s.Reserve("k", "", time.Minute) {
+		t.Error("second Reserve should fail while in progress")
+	}
+	if c, hit := s.Get("k"); !hit || !c.Pending {
+		t.Errorf("Get = %+v, %v; want pending", c, hit)
+	}
+	s.Set("k", true, "msg-1")
+	s.Release("k") // a stored result is kept
+	if c, hit := s.Get("k"); !hit || c.Pending || c.MessageID != "msg-1" {
+		t.Errorf("Get after Set = %+v, %v", c, hit)
+	}
+
+	s.Reserve("other", "", time.Minute)
+	s.Release("other")
+	if _, hit := s.Get("other"); hit {
+		t.Error("released key should be gone")
+	}
+	if !s.Reserve("expired", "", time.Millisecond) {
+		t.Fatal("Reserve expired")
+	}
+	time.Sleep(5 * time.Millisecond)
+	if !s.Reserve("expired", "", time.Minute) {
+		t.Error("an expired marker should not block Reserve")
+	}
+}
+
+func TestCached_Conflicts(t *testing.T) {
+	for _, tc := range []struct {
+		stored, fp string
+		want       bool
+	}{
+		{"a", "a", false},
+		{"a", "b", true},
+		{"", "b", false}, // stored without fingerprint
+		{"a", "", false}, // caller without fingerprint
+	} {
+		if got := (Cached{Fingerprint: tc.stored}).Conflicts(tc.fp); got != tc.want {
+			t.Errorf("Conflicts(%q vs %q) = %v, want %v", tc.stored, tc.fp, got, tc.want)
+		}
+	}
+	s := NewStore(300)
+	s.Put("k", Cached{OK: true, MessageID: "m", Fingerprint: "fp", Pending: true})
+	if c, _ := s.Get("k"); c.Pending || c.Fingerprint != "fp" {
+		t.Errorf("Put = %+v; a stored result is never pending", c)
+	}
+}
@@ -0,0 +1,125 @@
+package idempotency
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisStore keeps results in Redis so that a retry reaching another replica still finds
+// them. Redis expires entries after the TTL. When Redis cannot be reached, Get reports a
+// miss and Set is skipped: sends keep working, at the risk of a duplicate.
+type RedisStore struct {
+	client  redis.UniversalClient
+	prefix  string
+	ttl     time.Duration
+	timeout time.Duration
+	// OnError, when set, is called with the failed operation ("get", "set", "reserve" or
+	// "release") and error.
+	OnError func(op string, err error)
+}
+
+// NewRedisStore creates a store on client. Keys are prefixed with prefix; ttlSec <= 0
+// means 300 and timeout <= 0 bounds each Redis call to one second.
+func NewRedisStore(client redis.UniversalClient, prefix string, ttlSec int, timeout time.Duration) *RedisStore {
+	if ttlSec <= 0 {
+		ttlSec = 300
+	}
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	return &RedisStore{client: client, prefix: prefix, ttl: time.Duration(ttlSec) * time.Second, timeout: timeout}
+}
+
+// NewRedisClient connects to the Redis server at url (redis://[user:pass@]host:port/db,
+// or rediss:// for TLS).
+func NewRedisClient(url string) (*redis.Client, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return redis.NewClient(opts), nil
+}
+
+// Ping checks that Redis is reachable.
+func (s *RedisStore) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx).Err()
+}
+
+// Get returns the cached result for key. ok=false means miss.
+func (s *RedisStore) Get(key string) (Cached, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	raw, err := s.client.Get(ctx, s.prefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return Cached{}, false
+	}
+	if err != nil {
+		s.fail("get", err)
+		return Cached{}, false
+	}
+	var c Cached
+	if err := json.Unmarshal(raw, &c); err != nil {
+		s.fail("get", err)
+		return Cached{}, false
+	}
+	return c, true
+}
+
+// Set stores a result without fingerprint; see Put.
+func (s *RedisStore) Set(key string, ok bool, messageID string) {
+	s.Put(key, Cached{OK: ok, MessageID: messageID})
+}
+
+// Put stores the result for key with the store TTL.
+func (s *RedisStore) Put(key string, c Cached) {
+	c.Pending = false
+	raw, _ := json.Marshal(c)
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	if err := s.client.Set(ctx, s.prefix+key, raw, s.ttl).Err(); err != nil {
+		s.fail("set", err)
+	}
+}
+
+// releaseScript deletes a key only while it still holds an in-progress marker.
+var releaseScript = redis.NewScript(`local v = redis.call("GET", KEYS[1])
+if v and string.find(v, '"pending":true', 1, true) then return redis.call("DEL", KEYS[1]) end
+return 0`)
+
+// Reserve marks key in progress for ttl with SET NX. When Redis cannot be reached it
+// reports true, so the request goes ahead without deduplication.
+func (s *RedisStore) Reserve(key, fingerprint string, ttl time.Duration) bool {
+	raw, _ := json.Marshal(Cached{Pending: true, Fingerprint: fingerprint})
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	ok, err := s.client.SetNX(ctx, s.prefix+key, raw, ttl).Result()
+	if err != nil {
+		s.fail("reserve", err)
+		return true
+	}
+	return ok
+}
+
+// Release removes the in-progress marker of key.
+func (s *RedisStore) Release(key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	if err := releaseScript.Run(ctx, s.client, []string{s.prefix + key}).Err(); err != nil && !errors.Is(err, redis.Nil) {
+		s.fail("release", err)
+	}
+}
+
+// Close closes the Redis client.
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
+
+func (s *RedisStore) fail(op string, err error) {
+	if s.OnError != nil {
+		s.OnError(op, err)
+	}
+}
@@ -0,0 +1,117 @@
+package idempotency
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestRedisStore(t *testing.T, ttlSec int) (*RedisStore, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+	return NewRedisStore(client, "test:", ttlSec, time.Second), mr
+}
+
+func TestRedisStore_SetAndGet(t *testing.T) {
+	s, mr := newTestRedisStore(t, 300)
+	if _, hit := s.Get("k"); hit {
+		t.Fatal("expected miss before Set")
+	}
+	s.Set("k", true, "msg-1")
+	c, hit := s.Get("k")
+	if !hit || !c.OK || c.MessageID != "msg-1" {
+		t.Fatalf("Get = %+v, %v", c, hit)
+	}
+	if !mr.Exists("test:k") {
+		t.Error("key not stored under prefix")
+	}
+	if ttl := mr.TTL("test:k"); ttl != 300*time.Second {
+		t.Errorf("TTL = %v, want 5m", ttl)
+	}
+}
+
+func TestRedisStore_Expiry(t *testing.T) {
+	s, mr := newTestRedisStore(t, 1)
+	s.Set("k", false, "")
+	if c, hit := s.Get("k"); !hit || c.OK {
+		t.Fatalf("Get = %+v, %v; want cached failure", c, hit)
+	}
+	mr.FastForward(2 * time.Second)
+	if _, hit := s.Get("k"); hit {
+		t.Error("expected miss after TTL")
+	}
+}
+
+func TestRedisStore_SharedBetweenReplicas(t *testing.T) {
+	a, mr := newTestRedisStore(t, 300)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer func() { _ = client.Close() }()
+	b := NewRedisStore(client, "test:", 300, time.Second)
+	a.Set("k", true, "msg-1")
+	if c, hit := b.Get("k"); !hit || c.MessageID != "msg-1" {
+		t.Errorf("other replica Get = %+v, %v", c, hit)
+	}
+}
+
+func TestRedisStore_Unavailable(t *testing.T) {
+	s, mr := newTestRedisStore(t, 300)
+	var ops []string
+	s.OnError = func(op string, err error) { ops = append(ops, op) }
+	mr.Close()
+	s.Set("k", true, "msg-1")
+	if _, hit := s.Get("k"); hit {
+		t.Error("Get with Redis down should miss")
+	}
+	if len(ops) != 2 || ops[0] != "set" || ops[1] != "get" {
+		t.Errorf("OnError ops = %v, want [set get]", ops)
+	}
+	if err := s.Ping(context.Background()); err == nil {
+		t.Error("Ping with Redis down should fail")
+	}
+}
+
+func TestNewRedisClient(t *testing.T) {
+	c, err := NewRedisClient("redis://:pw@localhost:6380/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	if o := c.Options(); o.Addr != "localhost:6380" || o.DB != 2 || o.Password != "pw" {
+		t.Errorf("options = %s db=%d", o.Addr, o.DB)
+	}
+	if _, err := NewRedisClient("http://nope"); err == nil {
+		t.Error("invalid URL should fail")
+	}
+}
+
+func TestRedisStore_ReserveAndRelease(t *testing.T) {
+	s, mr := newTestRedisStore(t, 300)
+	if !s.Reserve("k", "", time.Minute) || s.Reserve("k", "", time.Minute) {
+		t.Fatal("Reserve should succeed exactly once")
+	}
+	if c, hit := s.Get("k"); !hit || !c.Pending {
+		t.Errorf("Get = %+v, %v; want pending", c, hit)
+	}
+	if ttl := mr.TTL("test:k"); ttl != time.Minute {
+		t.Errorf("marker TTL = %v", ttl)
+	}
+	s.Set("k", true, "msg-1")
+	s.Release("k")
+	if c, hit := s.Get("k"); !hit || c.MessageID != "msg-1" {
+		t.Errorf("Release removed a stored result: %+v, %v", c, hit)
+	}
+	s.Reserve("other", "", time.Minute)
+	s.Release("other")
+	if mr.Exists("test:other") {
+		t.Error("released marker still in Redis")
+	}
+	mr.Close()
+	if !s.Reserve("down", "", time.Minute) {
+		t.Error("Reserve with Redis down should let the request through")
+	}
+}
@@ -0,0 +1,125 @@
+package idempotency
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// snapshotEntry is one stored result in a snapshot file.
+type snapshotEntry struct {
+	Key       string    `json:"key"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Cached
+}
+
+// snapshot is the file format written by Snapshot: entries oldest first, so loading them
+// in order restores the LRU order.
+type snapshot struct {
+	Version int             `json:"version"`
+	SavedAt time.Time       `json:"saved_at"`
+	Entries []snapshotEntry `json:"entries"`
+}
+
+// Snapshot writes the unexpired stored results to path, replacing the previous snapshot
+// atomically. In-progress markers are not written: their requests do not survive a restart.
+func (s *MemoryStore) Snapshot(path string) error {
+	now := time.Now()
+	snap := snapshot{Version: 1, SavedAt: now}
+	s.mu.Lock()
+	for el := s.lru.Back(); el != nil; el = el.Prev() {
+		e := el.Value.(*entry)
+		if e.c.Pending || now.After(e.expiresAt) {
+			continue
+		}
+		snap.Entries = append(snap.Entries, snapshotEntry{Key: e.key, ExpiresAt: e.expiresAt, Cached: e.c})
+	}
+	s.mu.Unlock()
+
+	b, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Load restores the results saved by Snapshot at path, dropping expired ones, and returns
+// how many it restored. A missing file is not an error.
+func (s *MemoryStore) Load(path string) (int, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var snap snapshot
+	if err := json.Unmarshal(b, &snap); err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, se := range snap.Entries {
+		if se.Key == "" || se.Pending || now.After(se.ExpiresAt) {
+			continue
+		}
+		s.put(&entry{key: se.Key, c: se.Cached, expiresAt: se.ExpiresAt})
+		n++
+	}
+	return n, nil
+}
+
+// StartSnapshots writes a snapshot to path every interval until Close, which writes a
+// last one. onError, when set, receives failed periodic writes.
+func (s *MemoryStore) StartSnapshots(path string, interval time.Duration, onError func(error)) {
+	if path == "" {
+		return
+	}
+	s.mu.Lock()
+	s.snapshotPath = path
+	s.mu.Unlock()
+	if interval <= 0 {
+		return
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-t.C:
+				if err := s.Snapshot(path); err != nil && onError != nil {
+					onError(err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,118 @@
+package idempotency
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshot_RoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "idem", "snapshot.json")
+	s := NewStore(300)
+	s.Put("a", Cached{OK: true, MessageID: "m-a", Status: 200, Provider: "smtp", Fingerprint: "fa"})
+	s.Put("b", Cached{OK: false, Status: 500, ErrorCode: "send_failed", ErrorMessage: "550 no such user"})
+	if !s.Reserve("c", "fc", time.Minute) {
+		t.Fatal("Reserve(c) = false")
+	}
+	if err := s.Snapshot(path); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+
+	r := NewStore(300)
+	n, err := r.Load(path)
+	if err != nil || n != 2 {
+		t.Fatalf("Load = %d, %v; want 2, nil", n, err)
+	}
+	if c, ok := r.Get("a"); !ok || c.MessageID != "m-a" || c.Fingerprint != "fa" || c.Status != 200 {
+		t.Errorf("a = %+v, %v", c, ok)
+	}
+	if c, ok := r.Get("b"); !ok || c.OK || c.ErrorCode != "send_failed" || c.Status != 500 {
+		t.Errorf("b = %+v, %v", c, ok)
+	}
+	if _, ok := r.Get("c"); ok {
+		t.Error("in-progress marker c restored from snapshot")
+	}
+}
+
+func TestSnapshot_KeepsRecencyAndExpiry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	s := NewStore(300)
+	s.Set("old", true, "m-old")
+	s.Set("new", true, "m-new")
+	if err := s.Snapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	// A smaller store keeps the most recently used entries.
+	r := NewMemoryStore(300, 1)
+	if _, err := r.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.Get("new"); !ok {
+		t.Error("most recent entry missing after load")
+	}
+	if _, ok := r.Get("old"); ok {
+		t.Error("least recent entry kept beyond max entries")
+	}
+
+	// Entries that expired while the service was down are dropped.
+	b, _ := json.Marshal(snapshot{Version: 1, Entries: []snapshotEntry{
+		{Key: "gone", ExpiresAt: time.Now().Add(-time.Second), Cached: Cached{OK: true}},
+		{Key: "live", ExpiresAt: time.Now().Add(time.Minute), Cached: Cached{OK: true}},
+	}})
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	e := NewStore(300)
+	if n, err := e.Load(path); err != nil || n != 1 {
+		t.Fatalf("Load = %d, %v; want 1, nil", n, err)
+	}
+	if _, ok := e.Get("gone"); ok {
+		t.Error("expired entry restored")
+	}
+}
+
+func TestSnapshot_LoadMissingAndCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	s := NewStore(300)
+	if n, err := s.Load(filepath.Join(dir, "missing.json")); err != nil || n != 0 {
+		t.Errorf("Load(missing) = %d, %v; want 0, nil", n, err)
+	}
+	bad := filepath.Join(dir, "bad.json")
+	if err := os.WriteFile(bad, []byte("{not json"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Load(bad); err == nil {
+		t.Error("Load(corrupt) should fail")
+	}
+}
+
+func TestSnapshot_PeriodicAndOnClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	s := NewStore(300)
+	s.Set("first", true, "m-1")
+	s.StartSnapshots(path, 10*time.Millisecond, func(err error) { t.Errorf("snapshot: %v", err) })
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no periodic snapshot written")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	s.Set("last", true, "m-2")
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	r := NewStore(300)
+	if n, err := r.Load(path); err != nil || n != 2 {
+		t.Fatalf("Load after Close = %d, %v; want 2, nil", n, err)
+	}
+	if c, ok := r.Get("last"); !ok || c.MessageID != "m-2" {
+		t.Errorf("last = %+v, %v; want entry written on Close", c, ok)
+	}
+}
@@ -0,0 +1,103 @@
+package ipallow
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Policy restricts requests to allowed source networks. Behind a reverse proxy the source
+// is taken from X-Forwarded-For, but only when the connection comes from a trusted proxy.
+type Policy struct {
+	allowed []netip.Prefix
+	proxies []netip.Prefix
+}
+
+// New parses allowed and trustedProxies, each a list of CIDRs or single addresses.
+func New(allowed, trustedProxies []string) (*Policy, error) {
+	p := &Policy{}
+	var err error
+	if p.allowed, err = parsePrefixes(allowed); err != nil {
+		return nil, err
+	}
+	if p.proxies, err = parsePrefixes(trustedProxies); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q: %w", s, err)
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", s, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// ClientIP returns the source of a request that arrived from remote. When remote is a
+// trusted proxy, the X-Forwarded-For values are walked from the right, skipping trusted
+// proxies, and the first other address is the client; an unparsable entry yields the
+// zero Addr, which no policy allows.
+func (p *Policy) ClientIP(remote netip.Addr, forwardedFor []string) netip.Addr {
+	client := remote.Unmap()
+	if p == nil || !contains(p.proxies, client) {
+		return client
+	}
+	for i := len(forwardedFor) - 1; i >= 0; i-- {
+		hops := strings.Split(forwardedFor[i], ",")
+		for j := len(hops) - 1; j >= 0; j-- {
+			hop := strings.TrimSpace(hops[j])
+			if hop == "" {
+				continue
+			}
+			addr, err := netip.ParseAddr(hop)
+			if err != nil {
+				return netip.Addr{}
+			}
+			client = addr.Unmap()
+			if !contains(p.proxies, client) {
+				return client
+			}
+		}
+	}
+	return client
+}
+
+// Allows reports whether ip is in an allowed network. A nil Policy or one without
+// allowed networks allows every address.
+func (p *Policy) Allows(ip netip.Addr) bool {
+	if p == nil || len(p.allowed) == 0 {
+		return true
+	}
+	return contains(p.allowed, ip.Unmap())
+}
+
+// Enabled reports whether p restricts source networks.
+func (p *Policy) Enabled() bool {
+	return p != nil && len(p.allowed) > 0
+}
+
+func contains(prefixes []netip.Prefix, ip netip.Addr) bool {
+	if !ip.IsValid() {
+		return false
+	}
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
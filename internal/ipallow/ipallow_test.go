@@ -0,0 +1,75 @@
+package ipallow
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestPolicy_ClientIP(t *testing.T) {
+	p, err := New(nil, []string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := netip.MustParseAddr
+	cases := []struct {
+		name      string
+		remote    string
+		forwarded []string
+		want      string
+	}{
+		{"direct", "203.0.113.7", nil, "203.0.113.7"},
+		{"untrusted remote ignores header", "203.0.113.7", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"one proxy", "10.1.2.3", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"proxy chain", "10.1.2.3", []string{"198.51.100.1, 192.168.1.1", "10.9.9.9"}, "198.51.100.1"},
+		{"spoofed left entry", "10.1.2.3", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"only proxies", "10.1.2.3", []string{"10.0.0.1"}, "10.0.0.1"},
+		{"no header", "10.1.2.3", nil, "10.1.2.3"},
+		{"IPv4-mapped remote", "::ffff:10.1.2.3", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"garbage", "10.1.2.3", []string{"unknown"}, "invalid IP"},
+	}
+	for _, tc := range cases {
+		if got := p.ClientIP(addr(tc.remote), tc.forwarded).String(); got != tc.want {
+			t.Errorf("%s: ClientIP = %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestPolicy_Allows(t *testing.T) {
+	p, err := New([]string{"10.0.0.0/8", "2001:db8::/32", "203.0.113.7"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]bool{
+		"10.20.30.40":     true,
+		"::ffff:10.0.0.1": true,
+		"2001:db8::1":     true,
+		"203.0.113.7":     true,
+		"203.0.113.8":     false,
+		"192.168.0.1":     false,
+	} {
+		if got := p.Allows(netip.MustParseAddr(ip)); got != want {
+			t.Errorf("Allows(%s) = %v, want %v", ip, got, want)
+		}
+	}
+	if p.Allows(netip.Addr{}) {
+		t.Error("invalid address allowed")
+	}
+	var open *Policy
+	if !open.Allows(netip.MustParseAddr("192.168.0.1")) || open.Enabled() {
+		t.Error("nil policy restricts")
+	}
+	if !p.Enabled() {
+		t.Error("policy with allowed networks not enabled")
+	}
+}
+
+func TestNew_Invalid(t *testing.T) {
+	for _, bad := range []string{"10.0.0.0/33", "not-an-ip", "10.0.0/8"} {
+		if _, err := New([]string{bad}, nil); err == nil {
+			t.Errorf("New accepted allowed %q", bad)
+		}
+		if _, err := New(nil, []string{bad}); err == nil {
+			t.Errorf("New accepted trusted proxy %q", bad)
+		}
+	}
+}
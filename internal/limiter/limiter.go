@@ -0,0 +1,116 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrBusy is returned when every session is in use and the wait queue is full or the
+// wait timed out.
+var ErrBusy = errors.New("too many concurrent SMTP sessions")
+
+// Stats is a snapshot of limiter utilization.
+type Stats struct {
+	InUse      int   `json:"in_use"`
+	Limit      int   `json:"limit"`
+	Waiting    int   `json:"waiting"`
+	MaxWaiting int   `json:"max_waiting"`
+	Rejected   int64 `json:"rejected"`
+}
+
+// Limiter caps concurrent SMTP sessions. Callers beyond the limit wait in a bounded queue.
+type Limiter struct {
+	slots      chan struct{}
+	maxWaiting int
+	maxWait    time.Duration
+	waiting    atomic.Int64 // callers in the bounded queue
+	background atomic.Int64 // callers in Wait
+	rejected   atomic.Int64
+}
+
+// New creates a limiter allowing limit concurrent sessions, with at most maxWaiting callers
+// waiting up to maxWait each. limit <= 0 means 1; maxWait <= 0 waits until the context ends.
+func New(limit, maxWaiting int, maxWait time.Duration) *Limiter {
+	if limit <= 0 {
+		limit = 1
+	}
+	if maxWaiting < 0 {
+		maxWaiting = 0
+	}
+	return &Limiter{slots: make(chan struct{}, limit), maxWaiting: maxWaiting, maxWait: maxWait}
+}
+
+// Acquire takes a session slot, waiting in the bounded queue when none is free. It returns
+// ErrBusy when the queue is full or the wait times out, and ctx.Err() when ctx ends first.
+// release must be called once the session is over.
+func (l *Limiter) Acquire(ctx context.Context) (release func(), err error) {
+	select {
+	case l.slots <- struct{}{}:
+		return l.release, nil
+	default:
+	}
+	if n := l.waiting.Add(1); n > int64(l.maxWaiting) {
+		l.waiting.Add(-1)
+		l.rejected.Add(1)
+		return nil, ErrBusy
+	}
+	defer l.waiting.Add(-1)
+	var timeout <-chan time.Time
+	if l.maxWait > 0 {
+		t := time.NewTimer(l.maxWait)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return l.release, nil
+	case <-timeout:
+		l.rejected.Add(1)
+		return nil, ErrBusy
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Wait takes a session slot, waiting as long as ctx allows. It bypasses the wait queue
+// bound and is meant for background workers, whose number is already limited.
+func (l *Limiter) Wait(ctx context.Context) (release func(), err error) {
+	select {
+	case l.slots <- struct{}{}:
+		return l.release, nil
+	default:
+	}
+	l.background.Add(1)
+	defer l.background.Add(-1)
+	select {
+	case l.slots <- struct{}{}:
+		return l.release, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Stats returns current utilization.
+func (l *Limiter) Stats() Stats {
+	return Stats{
+		InUse:      len(l.slots),
+		Limit:      cap(l.slots),
+		Waiting:    int(l.waiting.Load() + l.background.Load()),
+		MaxWaiting: l.maxWaiting,
+		Rejected:   l.rejected.Load(),
+	}
+}
+
+// RetryAfter suggests how long a rejected caller should wait before trying again.
+func (l *Limiter) RetryAfter() time.Duration {
+	if l.maxWait > time.Second {
+		return l.maxWait
+	}
+	return time.Second
+}
+
+func (l *Limiter) release() {
+	<-l.slots
+}
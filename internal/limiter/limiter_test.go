@@ -0,0 +1,66 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLimiter_AcquireRelease(t *testing.T) {
+	l := New(2, 0, 0)
+	r1, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, _ := l.Acquire(context.Background())
+	if st := l.Stats(); st.InUse != 2 || st.Limit != 2 {
+		t.Errorf("Stats = %+v, want 2/2 in use", st)
+	}
+	if _, err := l.Acquire(context.Background()); !errors.Is(err, ErrBusy) {
+		t.Errorf("Acquire with no wait queue err = %v, want ErrBusy", err)
+	}
+	r1()
+	r2()
+	if st := l.Stats(); st.InUse != 0 || st.Rejected != 1 {
+		t.Errorf("Stats = %+v, want 0 in use, 1 rejected", st)
+	}
+}
+
+func TestLimiter_WaitQueue(t *testing.T) {
+	l := New(1, 1, time.Second)
+	release, _ := l.Acquire(context.Background())
+	got := make(chan error, 1)
+	go func() {
+		r, err := l.Acquire(context.Background())
+		if err == nil {
+			r()
+		}
+		got <- err
+	}()
+	deadline := time.Now().Add(time.Second)
+	for l.Stats().Waiting != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := l.Acquire(context.Background()); !errors.Is(err, ErrBusy) {
+		t.Errorf("Acquire with full wait queue err = %v, want ErrBusy", err)
+	}
+	release()
+	if err := <-got; err != nil {
+		t.Errorf("queued Acquire err = %v, want slot after release", err)
+	}
+}
+
+func TestLimiter_WaitTimeoutAndContext(t *testing.T) {
+	l := New(1, 5, 10*time.Millisecond)
+	release, _ := l.Acquire(context.Background())
+	defer release()
+	if _, err := l.Acquire(context.Background()); !errors.Is(err, ErrBusy) {
+		t.Errorf("timed out wait err = %v, want ErrBusy", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := l.Wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Wait with cancelled ctx err = %v, want context.Canceled", err)
+	}
+}
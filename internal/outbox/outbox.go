@@ -0,0 +1,249 @@
+package outbox
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/soulteary/herald-smtp/internal/queue"
+)
+
+// ErrFull is returned by Put when persisting the job would exceed the disk cap.
+var ErrFull = errors.New("outbox full")
+
+const fileName = "outbox.log"
+
+// record is one line of the append-only log.
+type record struct {
+	Op  string     `json:"op"` // "put" or "done"
+	ID  string     `json:"id,omitempty"`
+	Job *queue.Job `json:"job,omitempty"`
+}
+
+// Outbox persists accepted jobs to an append-only file until they are marked done,
+// so that queued messages survive a crash or restart (at-least-once delivery).
+type Outbox struct {
+	mu       sync.Mutex
+	path     string
+	f        *os.File
+	size     int64
+	maxBytes int64
+	pending  map[string]*queue.Job
+	order    []string // insertion order of pending IDs (may contain done IDs until compaction)
+	dead     int      // records in the file that no longer describe a pending job
+}
+
+// Open opens or creates the outbox in dir, replaying existing records. maxBytes caps the
+// log size (0 means 64 MiB). The log is compacted on open.
+func Open(dir string, maxBytes int64) (*Outbox, error) {
+	if maxBytes <= 0 {
+		maxBytes = 64 << 20
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	o := &Outbox{
+		path:     filepath.Join(dir, fileName),
+		maxBytes: maxBytes,
+		pending:  make(map[string]*queue.Job),
+	}
+	if err := o.load(); err != nil {
+		return nil, err
+	}
+	if err := o.compactLocked(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *Outbox) load() error {
+	f, err := os.Open(o.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 16<<20)
+	for sc.Scan() {
+		var r record
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			// A torn write at the tail after a crash; everything before it is intact.
+			break
+		}
+		switch r.Op {
+		case "put":
+			if r.Job != nil {
+				if _, ok := o.pending[r.Job.ID]; !ok {
+					o.order = append(o.order, r.Job.ID)
+				}
+				o.pending[r.Job.ID] = r.Job
+			}
+		case "done":
+			delete(o.pending, r.ID)
+		}
+	}
+	return sc.Err()
+}
+
+// Put durably records job before it is acknowledged. Returns ErrFull when the log
+// would exceed the size cap even after compaction.
+func (o *Outbox) Put(job *queue.Job) error {
+	line, err := json.Marshal(record{Op: "put", Job: job})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.size+int64(len(line)) > o.maxBytes {
+		if o.dead > 0 {
+			if err := o.compactLocked(); err != nil {
+				return err
+			}
+		}
+		if o.size+int64(len(line)) > o.maxBytes {
+			return fmt.Errorf("%w: %d of %d bytes used", ErrFull, o.size, o.maxBytes)
+		}
+	}
+	if err := o.appendLocked(line, true); err != nil {
+		return err
+	}
+	o.pending[job.ID] = job
+	o.order = append(o.order, job.ID)
+	return nil
+}
+
+// Done marks the job as finished (delivered, or given up on) so it is not replayed.
+func (o *Outbox) Done(id string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, ok := o.pending[id]; !ok {
+		return nil
+	}
+	line, err := json.Marshal(record{Op: "done", ID: id})
+	if err != nil {
+		return err
+	}
+	if err := o.appendLocked(append(line, '\n'), false); err != nil {
+		return err
+	}
+	delete(o.pending, id)
+	// The put and done records are both dead now.
+	o.dead += 2
+	if o.dead > 1000 && o.dead > 2*len(o.pending) {
+		return o.compactLocked()
+	}
+	return nil
+}
+
+// Pending returns jobs not yet marked done, oldest first.
+func (o *Outbox) Pending() []*queue.Job {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	jobs := make([]*queue.Job, 0, len(o.pending))
+	for _, id := range o.order {
+		if job, ok := o.pending[id]; ok {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs
+}
+
+// Len returns the number of pending jobs.
+func (o *Outbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.pending)
+}
+
+// Size returns the current log size in bytes.
+func (o *Outbox) Size() int64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.size
+}
+
+// Close closes the log file.
+func (o *Outbox) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.f == nil {
+		return nil
+	}
+	err := o.f.Close()
+	o.f = nil
+	return err
+}
+
+func (o *Outbox) appendLocked(line []byte, sync bool) error {
+	if o.f == nil {
+		return errors.New("outbox closed")
+	}
+	n, err := o.f.Write(line)
+	o.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if sync {
+		return o.f.Sync()
+	}
+	return nil
+}
+
+// compactLocked rewrites the log with only pending jobs and swaps it in atomically.
+func (o *Outbox) compactLocked() error {
+	tmp := o.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	var size int64
+	order := make([]string, 0, len(o.pending))
+	for _, id := range o.order {
+		job, ok := o.pending[id]
+		if !ok {
+			continue
+		}
+		line, err := json.Marshal(record{Op: "put", Job: job})
+		if err != nil {
+			_ = f.Close()
+			return err
+		}
+		n, _ := w.Write(append(line, '\n'))
+		size += int64(n)
+		order = append(order, id)
+	}
+	if err := w.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, o.path); err != nil {
+		return err
+	}
+	if o.f != nil {
+		_ = o.f.Close()
+	}
+	o.f, err = os.OpenFile(o.path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	o.size = size
+	o.order = order
+	o.dead = 0
+	return nil
+}
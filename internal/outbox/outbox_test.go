@@ -0,0 +1,121 @@
+package outbox
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/soulteary/herald-smtp/internal/queue"
+	"github.com/soulteary/provider-kit"
+)
+
+func job(id string) *queue.Job {
+	return &queue.Job{ID: id, Request: provider.HTTPSendRequest{To: id + "@example.com", Body: "hi"}, EnqueuedAt: time.Now()}
+}
+
+func TestOutbox_ReplayAfterReopen(t *testing.T) {
+	dir := t.TempDir()
+	o, err := Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		if err := o.Put(job(id)); err != nil {
+			t.Fatalf("Put(%s): %v", id, err)
+		}
+	}
+	if err := o.Done("b"); err != nil {
+		t.Fatal(err)
+	}
+	_ = o.Close()
+
+	o2, err := Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = o2.Close() }()
+	pending := o2.Pending()
+	if len(pending) != 2 || pending[0].ID != "a" || pending[1].ID != "c" {
+		t.Fatalf("pending = %v, want [a c]", ids(pending))
+	}
+	if pending[0].Request.To != "a@example.com" {
+		t.Errorf("replayed request to = %q", pending[0].Request.To)
+	}
+}
+
+func TestOutbox_TornTailIgnored(t *testing.T) {
+	dir := t.TempDir()
+	o, _ := Open(dir, 0)
+	_ = o.Put(job("a"))
+	_ = o.Close()
+	f, _ := os.OpenFile(filepath.Join(dir, fileName), os.O_APPEND|os.O_WRONLY, 0o600)
+	_, _ = f.WriteString(`{"op":"put","job":{"id":"b"`)
+	_ = f.Close()
+
+	o2, err := Open(dir, 0)
+	if err != nil {
+		t.Fatalf("Open with torn tail: %v", err)
+	}
+	defer func() { _ = o2.Close() }()
+	if got := ids(o2.Pending()); len(got) != 1 || got[0] != "a" {
+		t.Errorf("pending = %v, want [a]", got)
+	}
+}
+
+func TestOutbox_FullRejects(t *testing.T) {
+	o, err := Open(t.TempDir(), 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = o.Close() }()
+	var full error
+	for i := 0; i < 10 && full == nil; i++ {
+		full = o.Put(job(string(rune('a' + i))))
+	}
+	if !errors.Is(full, ErrFull) {
+		t.Fatalf("err = %v, want ErrFull", full)
+	}
+	// Finishing jobs frees space through compaction.
+	for _, j := range o.Pending() {
+		_ = o.Done(j.ID)
+	}
+	if err := o.Put(job("z")); err != nil {
+		t.Errorf("Put after Done: %v", err)
+	}
+}
+
+func TestOutbox_CompactionShrinksLog(t *testing.T) {
+	o, _ := Open(t.TempDir(), 0)
+	defer func() { _ = o.Close() }()
+	for i := 0; i < 600; i++ {
+		j := job(fmt.Sprintf("j%d", i))
+		_ = o.Put(j)
+		_ = o.Done(j.ID)
+	}
+	_ = o.Put(job("keep"))
+	if o.Len() != 1 {
+		t.Fatalf("Len = %d, want 1", o.Len())
+	}
+	if o.Size() > 100*1024 {
+		t.Errorf("Size = %d, log was not compacted", o.Size())
+	}
+}
+
+func TestOutbox_DoneUnknownIsNoop(t *testing.T) {
+	o, _ := Open(t.TempDir(), 0)
+	defer func() { _ = o.Close() }()
+	if err := o.Done("missing"); err != nil {
+		t.Errorf("Done(missing) = %v", err)
+	}
+}
+
+func ids(jobs []*queue.Job) []string {
+	out := make([]string, 0, len(jobs))
+	for _, j := range jobs {
+		out = append(out, j.ID)
+	}
+	return out
+}
@@ -0,0 +1,294 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/soulteary/provider-kit"
+)
+
+var (
+	// ErrFull is returned by Enqueue when the queue has no free slot.
+	ErrFull = errors.New("queue full")
+	// ErrClosed is returned by Enqueue after Close has been called.
+	ErrClosed = errors.New("queue closed")
+)
+
+// Job is one accepted send request waiting for delivery.
+type Job struct {
+	ID         string                   `json:"id"`
+	Request    provider.HTTPSendRequest `json:"request"`
+	EnqueuedAt time.Time                `json:"enqueued_at"`
+	// SendAt, when set, holds the job in the Scheduler until that time.
+	SendAt time.Time `json:"send_at,omitzero"`
+	// Priority selects the lane; unknown or empty priorities use the default lane.
+	Priority string `json:"priority,omitempty"`
+	// APIKey is the name of the API key that submitted the job, for logs and status.
+	APIKey string `json:"api_key,omitempty"`
+}
+
+// Lane is a priority lane with its own buffer and workers, so a backlog in one lane
+// never delays jobs in another.
+type Lane struct {
+	Name    string
+	Size    int
+	Workers int
+}
+
+// DeliverFunc delivers a job. It is called from worker goroutines.
+type DeliverFunc func(ctx context.Context, job *Job)
+
+// Queue is a bounded in-memory job queue drained by a fixed worker pool per lane.
+type Queue struct {
+	lanes   map[string]*lane
+	order   []string // lane names as configured; the first is the default
+	deliver DeliverFunc
+
+	mu        sync.RWMutex
+	closed    bool
+	done      chan struct{}  // closed by Close; wakes Submit calls waiting for a slot
+	submits   sync.WaitGroup // Submit calls that may still send on a lane
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+	ctx       context.Context
+	cancel    context.CancelFunc
+
+	// waiting tracks jobs in the channel; true marks a job cancelled before a worker took it.
+	wmu     sync.Mutex
+	waiting map[string]bool
+}
+
+type lane struct {
+	jobs    chan *Job
+	workers int
+}
+
+// New creates a single-lane queue holding up to size jobs, delivered by workers goroutines.
+// Call Start to launch the workers.
+func New(size, workers int, deliver DeliverFunc) *Queue {
+	return NewLanes([]Lane{{Size: size, Workers: workers}}, deliver)
+}
+
+// NewLanes creates a queue with one buffer and worker pool per lane. The first lane is
+// the default for jobs whose Priority matches no lane. Size <= 0 means 1000 and
+// Workers <= 0 means 4.
+func NewLanes(lanes []Lane, deliver DeliverFunc) *Queue {
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &Queue{
+		lanes:   make(map[string]*lane, len(lanes)),
+		deliver: deliver,
+		done:    make(chan struct{}),
+		ctx:     ctx,
+		cancel:  cancel,
+		waiting: make(map[string]bool),
+	}
+	for _, l := range lanes {
+		if _, dup := q.lanes[l.Name]; dup {
+			continue
+		}
+		if l.Size <= 0 {
+			l.Size = 1000
+		}
+		if l.Workers <= 0 {
+			l.Workers = 4
+		}
+		q.lanes[l.Name] = &lane{jobs: make(chan *Job, l.Size), workers: l.Workers}
+		q.order = append(q.order, l.Name)
+	}
+	if len(q.order) == 0 {
+		q.lanes[""] = &lane{jobs: make(chan *Job, 1000), workers: 4}
+		q.order = []string{""}
+	}
+	return q
+}
+
+// Start launches the worker pools.
+func (q *Queue) Start() {
+	for _, l := range q.lanes {
+		for i := 0; i < l.workers; i++ {
+			q.wg.Add(1)
+			go q.work(l.jobs)
+		}
+	}
+}
+
+// lane returns the lane for priority, or the default lane.
+func (q *Queue) lane(priority string) *lane {
+	if l, ok := q.lanes[priority]; ok {
+		return l
+	}
+	return q.lanes[q.order[0]]
+}
+
+func (q *Queue) work(jobs <-chan *Job) {
+	defer q.wg.Done()
+	for job := range jobs {
+		q.wmu.Lock()
+		cancelled := q.waiting[job.ID]
+		delete(q.waiting, job.ID)
+		q.wmu.Unlock()
+		if !cancelled {
+			q.deliver(q.ctx, job)
+		}
+	}
+}
+
+func (q *Queue) track(id string) {
+	q.wmu.Lock()
+	q.waiting[id] = false
+	q.wmu.Unlock()
+}
+
+func (q *Queue) untrack(id string) {
+	q.wmu.Lock()
+	delete(q.waiting, id)
+	q.wmu.Unlock()
+}
+
+// Cancel drops a job that is still waiting for a worker. It returns false when the job
+// is unknown or a worker has already taken it.
+func (q *Queue) Cancel(id string) bool {
+	q.wmu.Lock()
+	defer q.wmu.Unlock()
+	cancelled, ok := q.waiting[id]
+	if !ok || cancelled {
+		return false
+	}
+	q.waiting[id] = true
+	return true
+}
+
+// Waiting reports whether the job is queued and not yet taken by a worker.
+func (q *Queue) Waiting(id string) bool {
+	q.wmu.Lock()
+	defer q.wmu.Unlock()
+	cancelled, ok := q.waiting[id]
+	return ok && !cancelled
+}
+
+// Enqueue adds job without blocking. Returns ErrFull or ErrClosed when it cannot.
+func (q *Queue) Enqueue(job *Job) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return ErrClosed
+	}
+	q.track(job.ID)
+	select {
+	case q.lane(job.Priority).jobs <- job:
+		return nil
+	default:
+		q.untrack(job.ID)
+		return ErrFull
+	}
+}
+
+// Submit adds job, waiting for a free slot until ctx is done or the queue is closed.
+// Used to replay persisted jobs at startup, where dropping work is not an option.
+func (q *Queue) Submit(ctx context.Context, job *Job) error {
+	q.mu.RLock()
+	if q.closed {
+		q.mu.RUnlock()
+		return ErrClosed
+	}
+	// The wait happens without the lock, so Close is never blocked by a full lane; it
+	// waits for submits to return before closing the lanes.
+	q.submits.Add(1)
+	defer q.submits.Done()
+	q.track(job.ID)
+	jobs := q.lane(job.Priority).jobs
+	q.mu.RUnlock()
+	select {
+	case jobs <- job:
+		return nil
+	case <-q.done:
+		q.untrack(job.ID)
+		return ErrClosed
+	case <-ctx.Done():
+		q.untrack(job.ID)
+		return ctx.Err()
+	}
+}
+
+// Len returns the number of jobs waiting for a worker, across lanes.
+func (q *Queue) Len() int {
+	n := 0
+	for _, l := range q.lanes {
+		n += len(l.jobs)
+	}
+	return n
+}
+
+// Cap returns the maximum number of waiting jobs, across lanes.
+func (q *Queue) Cap() int {
+	n := 0
+	for _, l := range q.lanes {
+		n += cap(l.jobs)
+	}
+	return n
+}
+
+// LaneLen returns the number of jobs waiting in the lane that priority maps to.
+func (q *Queue) LaneLen(priority string) int {
+	return len(q.lane(priority).jobs)
+}
+
+// Close stops accepting jobs and waits for workers to drain the queue.
+// If ctx ends first, in-flight deliveries are cancelled and ctx.Err() is returned.
+func (q *Queue) Close(ctx context.Context) error {
+	q.closeOnce.Do(func() {
+		q.mu.Lock()
+		q.closed = true
+		q.mu.Unlock()
+		close(q.done)
+		q.submits.Wait()
+		for _, l := range q.lanes {
+			close(l.jobs)
+		}
+	})
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		q.cancel()
+		return nil
+	case <-ctx.Done():
+		q.cancel()
+		return ctx.Err()
+	}
+}
+
+// Drain removes and returns the jobs still waiting for a worker, skipping cancelled ones.
+// Call it after Close returned at its deadline, so the caller can keep jobs the workers
+// never started.
+func (q *Queue) Drain() []*Job {
+	var jobs []*Job
+	for _, name := range q.order {
+		l := q.lanes[name]
+	lane:
+		for {
+			select {
+			case job, ok := <-l.jobs:
+				if !ok {
+					break lane
+				}
+				q.wmu.Lock()
+				cancelled := q.waiting[job.ID]
+				delete(q.waiting, job.ID)
+				q.wmu.Unlock()
+				if !cancelled {
+					jobs = append(jobs, job)
+				}
+			default:
+				break lane
+			}
+		}
+	}
+	return jobs
+}
@@ -0,0 +1,322 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/soulteary/provider-kit"
+)
+
+func newJob(id string) *Job {
+	return &Job{ID: id, Request: provider.HTTPSendRequest{To: "u@example.com"}, EnqueuedAt: time.Now()}
+}
+
+func TestQueue_DeliversAllJobs(t *testing.T) {
+	var delivered int32
+	var wg sync.WaitGroup
+	q := New(10, 3, func(ctx context.Context, job *Job) {
+		atomic.AddInt32(&delivered, 1)
+		wg.Done()
+	})
+	q.Start()
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		if err := q.Enqueue(newJob("j")); err != nil {
+			t.Fatalf("Enqueue: %v", err)
+		}
+	}
+	wg.Wait()
+	if got := atomic.LoadInt32(&delivered); got != 10 {
+		t.Errorf("delivered = %d, want 10", got)
+	}
+	if err := q.Close(context.Background()); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+}
+
+func TestQueue_Full(t *testing.T) {
+	q := New(1, 1, func(ctx context.Context, job *Job) {})
+	// Workers not started: the single slot fills up.
+	if err := q.Enqueue(newJob("a")); err != nil {
+		t.Fatalf("first Enqueue: %v", err)
+	}
+	if err := q.Enqueue(newJob("b")); !errors.Is(err, ErrFull) {
+		t.Errorf("second Enqueue err = %v, want ErrFull", err)
+	}
+	if q.Len() != 1 || q.Cap() != 1 {
+		t.Errorf("Len=%d Cap=%d, want 1/1", q.Len(), q.Cap())
+	}
+}
+
+func TestQueue_EnqueueAfterClose(t *testing.T) {
+	q := New(1, 1, func(ctx context.Context, job *Job) {})
+	q.Start()
+	_ = q.Close(context.Background())
+	if err := q.Enqueue(newJob("a")); !errors.Is(err, ErrClosed) {
+		t.Errorf("Enqueue after Close err = %v, want ErrClosed", err)
+	}
+	// Close is idempotent.
+	if err := q.Close(context.Background()); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
+
+func TestQueue_CloseDrainsPendingJobs(t *testing.T) {
+	var delivered int32
+	q := New(5, 1, func(ctx context.Context, job *Job) {
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&delivered, 1)
+	})
+	for i := 0; i < 5; i++ {
+		_ = q.Enqueue(newJob("j"))
+	}
+	q.Start()
+	if err := q.Close(context.Background()); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if got := atomic.LoadInt32(&delivered); got != 5 {
+		t.Errorf("delivered = %d after Close, want 5", got)
+	}
+}
+
+func TestQueue_CloseDeadline(t *testing.T) {
+	release := make(chan struct{})
+	q := New(1, 1, func(ctx context.Context, job *Job) {
+		select {
+		case <-ctx.Done():
+		case <-release:
+		}
+	})
+	q.Start()
+	_ = q.Enqueue(newJob("slow"))
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := q.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Close err = %v, want DeadlineExceeded", err)
+	}
+	close(release)
+}
+
+func TestQueue_DrainAfterDeadline(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{}, 1)
+	q := New(3, 1, func(ctx context.Context, job *Job) {
+		started <- struct{}{}
+		<-release // a relay that ignores cancellation
+	})
+	q.Start()
+	for _, id := range []string{"a", "b", "c", "d"} {
+		if err := q.Enqueue(newJob(id)); err != nil {
+			t.Fatal(err)
+		}
+		if id == "a" {
+			<-started
+		}
+	}
+	q.Cancel("c")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := q.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Close err = %v, want DeadlineExceeded", err)
+	}
+	left := q.Drain()
+	if len(left) != 2 || left[0].ID != "b" || left[1].ID != "d" {
+		t.Errorf("Drain = %v, want jobs b and d", left)
+	}
+	if q.Len() != 0 {
+		t.Errorf("Len after Drain = %d, want 0", q.Len())
+	}
+}
+
+func TestQueue_CloseWakesBlockedSubmit(t *testing.T) {
+	q := New(1, 1, func(ctx context.Context, job *Job) {}) // not started: the lane stays full
+	_ = q.Enqueue(newJob("a"))
+	submitted := make(chan error, 1)
+	go func() { submitted <- q.Submit(context.Background(), newJob("b")) }()
+	time.Sleep(20 * time.Millisecond) // let Submit wait for a slot
+
+	closed := make(chan struct{})
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_ = q.Close(ctx)
+		close(closed)
+	}()
+	select {
+	case err := <-submitted:
+		if !errors.Is(err, ErrClosed) {
+			t.Errorf("Submit = %v, want ErrClosed", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Submit still blocked after Close")
+	}
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close blocked by a waiting Submit")
+	}
+	if err := q.Submit(context.Background(), newJob("c")); !errors.Is(err, ErrClosed) {
+		t.Errorf("Submit after Close = %v, want ErrClosed", err)
+	}
+}
+
+func TestNew_Defaults(t *testing.T) {
+	q := New(0, 0, func(ctx context.Context, job *Job) {})
+	if w := q.lane("").workers; q.Cap() != 1000 || w != 4 {
+		t.Errorf("Cap=%d workers=%d, want 1000/4", q.Cap(), w)
+	}
+}
+
+func TestQueue_Cancel(t *testing.T) {
+	var delivered int32
+	q := New(2, 1, func(ctx context.Context, job *Job) { atomic.AddInt32(&delivered, 1) })
+	_ = q.Enqueue(newJob("a"))
+	_ = q.Enqueue(newJob("b"))
+	if !q.Cancel("a") {
+		t.Fatal("Cancel(a) = false, want true")
+	}
+	if q.Cancel("a") || q.Cancel("missing") {
+		t.Error("second Cancel / unknown Cancel should be false")
+	}
+	q.Start()
+	_ = q.Close(context.Background())
+	if got := atomic.LoadInt32(&delivered); got != 1 {
+		t.Errorf("delivered = %d, want 1 (cancelled job skipped)", got)
+	}
+}
+
+func TestScheduler_DispatchesWhenDue(t *testing.T) {
+	got := make(chan string, 2)
+	q := New(10, 1, func(ctx context.Context, job *Job) { got <- job.ID })
+	q.Start()
+	defer func() { _ = q.Close(context.Background()) }()
+	s := NewScheduler(q, 10)
+	s.Start()
+	defer s.Stop()
+
+	later, soon := newJob("later"), newJob("soon")
+	later.SendAt = time.Now().Add(150 * time.Millisecond)
+	soon.SendAt = time.Now().Add(20 * time.Millisecond)
+	_ = s.Schedule(later)
+	_ = s.Schedule(soon)
+	if !s.Scheduled("soon") || s.Len() != 2 {
+		t.Fatalf("Scheduled/Len = %v/%d", s.Scheduled("soon"), s.Len())
+	}
+	for _, want := range []string{"soon", "later"} {
+		select {
+		case id := <-got:
+			if id != want {
+				t.Errorf("delivered %q, want %q", id, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+	if s.Len() != 0 {
+		t.Errorf("Len = %d after dispatch, want 0", s.Len())
+	}
+}
+
+func TestScheduler_CancelAndFull(t *testing.T) {
+	q := New(1, 1, func(ctx context.Context, job *Job) {})
+	s := NewScheduler(q, 1)
+	job := newJob("a")
+	job.SendAt = time.Now().Add(time.Hour)
+	if err := s.Schedule(job); err != nil {
+		t.Fatalf("Schedule: %v", err)
+	}
+	if err := s.Schedule(newJob("b")); !errors.Is(err, ErrFull) {
+		t.Errorf("Schedule over max err = %v, want ErrFull", err)
+	}
+	if !s.Cancel("a") || s.Cancel("a") {
+		t.Error("Cancel should succeed once")
+	}
+	if s.Len() != 0 {
+		t.Errorf("Len = %d, want 0", s.Len())
+	}
+	// Stop without Start must not block.
+	s.Stop()
+}
+
+func TestScheduler_PendingAfterStop(t *testing.T) {
+	q := New(1, 1, func(ctx context.Context, job *Job) {})
+	s := NewScheduler(q, 10)
+	s.Start()
+	for i, id := range []string{"late", "early"} {
+		job := newJob(id)
+		job.SendAt = time.Now().Add(time.Duration(2-i) * time.Hour)
+		_ = s.Schedule(job)
+	}
+	s.Stop()
+	held := s.Pending()
+	if len(held) != 2 || held[0].ID != "early" || held[1].ID != "late" {
+		t.Errorf("Pending = %v, want early, late", held)
+	}
+}
+
+func TestScheduler_PendingKeepsUnsubmittedJobs(t *testing.T) {
+	q := New(1, 1, func(ctx context.Context, job *Job) {}) // not started: the queue fills up
+	s := NewScheduler(q, 10)
+	for _, id := range []string{"a", "b", "c"} {
+		_ = s.Schedule(newJob(id)) // all due now
+	}
+	s.Start()
+	deadline := time.Now().Add(2 * time.Second)
+	for q.Len() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond) // let Submit block on the full queue
+	s.Stop()
+	if held := s.Pending(); q.Len() != 1 || len(held) != 2 || s.Len() != 2 {
+		t.Errorf("queued %d, pending %v (Len %d), want 1 queued and 2 pending", q.Len(), held, s.Len())
+	}
+}
+
+func TestQueue_LanesAreIndependent(t *testing.T) {
+	release := make(chan struct{})
+	got := make(chan string, 4)
+	q := NewLanes([]Lane{{Name: "normal", Size: 2, Workers: 1}, {Name: "critical", Size: 1, Workers: 1}},
+		func(ctx context.Context, job *Job) {
+			if job.Priority != "critical" {
+				<-release
+			}
+			got <- job.ID
+		})
+	q.Start()
+	defer func() {
+		close(release)
+		_ = q.Close(context.Background())
+	}()
+	for _, id := range []string{"n1", "n2"} {
+		job := newJob(id)
+		job.Priority = "bulk" // unknown priority: default (first) lane
+		if err := q.Enqueue(job); err != nil {
+			t.Fatalf("Enqueue %s: %v", id, err)
+		}
+	}
+	crit := newJob("c1")
+	crit.Priority = "critical"
+	if err := q.Enqueue(crit); err != nil {
+		t.Fatalf("Enqueue critical: %v", err)
+	}
+	select {
+	case id := <-got:
+		if id != "c1" {
+			t.Errorf("first delivered = %q, want c1", id)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("critical job blocked behind the default lane")
+	}
+	deadline := time.Now().Add(time.Second)
+	for q.LaneLen("normal") != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond) // until the normal worker has taken n1
+	}
+	if q.LaneLen("normal") != 1 || q.LaneLen("critical") != 0 || q.Cap() != 3 {
+		t.Errorf("LaneLen normal=%d critical=%d Cap=%d", q.LaneLen("normal"), q.LaneLen("critical"), q.Cap())
+	}
+}
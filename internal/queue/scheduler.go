@@ -0,0 +1,193 @@
+package queue
+
+import (
+	"container/heap"
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Scheduler holds jobs until their SendAt time and then submits them to the queue.
+type Scheduler struct {
+	q       *Queue
+	max     int
+	started atomic.Bool
+
+	mu    sync.Mutex
+	jobs  jobHeap
+	index map[string]*Job
+	wake  chan struct{}
+	done  chan struct{}
+	// ctx is cancelled by Stop so that a Submit blocked on a full queue returns.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewScheduler creates a scheduler feeding q that holds at most max jobs (0 means 10000).
+// Call Start to run it.
+func NewScheduler(q *Queue, max int) *Scheduler {
+	if max <= 0 {
+		max = 10000
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Scheduler{
+		q:      q,
+		max:    max,
+		index:  make(map[string]*Job),
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Schedule holds job until job.SendAt. Returns ErrFull when max jobs are already held.
+func (s *Scheduler) Schedule(job *Job) error {
+	s.mu.Lock()
+	if len(s.index) >= s.max {
+		s.mu.Unlock()
+		return ErrFull
+	}
+	heap.Push(&s.jobs, job)
+	s.index[job.ID] = job
+	s.mu.Unlock()
+	s.notify()
+	return nil
+}
+
+// Cancel removes a job that has not been handed to the queue yet.
+func (s *Scheduler) Cancel(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.index[id]
+	if !ok {
+		return false
+	}
+	delete(s.index, id)
+	for i, j := range s.jobs {
+		if j == job {
+			heap.Remove(&s.jobs, i)
+			break
+		}
+	}
+	return true
+}
+
+// Scheduled reports whether the job is held by the scheduler.
+func (s *Scheduler) Scheduled(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.index[id]
+	return ok
+}
+
+// Pending returns the held jobs, earliest first. After Stop these are the jobs that were
+// never handed to the queue.
+func (s *Scheduler) Pending() []*Job {
+	s.mu.Lock()
+	jobs := make([]*Job, len(s.jobs))
+	copy(jobs, s.jobs)
+	s.mu.Unlock()
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].SendAt.Before(jobs[j].SendAt) })
+	return jobs
+}
+
+// Len returns the number of held jobs.
+func (s *Scheduler) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.index)
+}
+
+// Start runs the dispatch loop.
+func (s *Scheduler) Start() {
+	if s.started.CompareAndSwap(false, true) {
+		go s.run()
+	}
+}
+
+// Stop ends the dispatch loop. Held jobs are dropped from memory; with an outbox they
+// are replayed on the next start.
+func (s *Scheduler) Stop() {
+	s.cancel()
+	if s.started.Load() {
+		<-s.done
+	}
+}
+
+func (s *Scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Scheduler) run() {
+	defer close(s.done)
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		due, next := s.popDue(time.Now())
+		for i, job := range due {
+			if err := s.q.Submit(s.ctx, job); err != nil {
+				// Keep the jobs not handed over, so Pending still reports them.
+				s.restore(due[i:])
+				return
+			}
+		}
+		wait := time.Hour
+		if !next.IsZero() {
+			wait = time.Until(next)
+		}
+		timer.Reset(wait)
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-s.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// popDue removes and returns jobs due at now and the SendAt of the next held job.
+func (s *Scheduler) popDue(now time.Time) ([]*Job, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due []*Job
+	for len(s.jobs) > 0 && !s.jobs[0].SendAt.After(now) {
+		job := heap.Pop(&s.jobs).(*Job)
+		delete(s.index, job.ID)
+		due = append(due, job)
+	}
+	if len(s.jobs) == 0 {
+		return due, time.Time{}
+	}
+	return due, s.jobs[0].SendAt
+}
+
+// restore puts jobs taken by popDue back.
+func (s *Scheduler) restore(jobs []*Job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, job := range jobs {
+		heap.Push(&s.jobs, job)
+		s.index[job.ID] = job
+	}
+}
+
+// jobHeap orders jobs by SendAt.
+type jobHeap []*Job
+
+func (h jobHeap) Len() int           { return len(h) }
+func (h jobHeap) Less(i, j int) bool { return h[i].SendAt.Before(h[j].SendAt) }
+func (h jobHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *jobHeap) Push(x any)        { *h = append(*h, x.(*Job)) }
+func (h *jobHeap) Pop() any {
+	old := *h
+	n := len(old)
+	job := old[n-1]
+	*h = old[:n-1]
+	return job
+}
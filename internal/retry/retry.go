@@ -0,0 +1,77 @@
+package retry
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+)
+
+// Policy controls retries of transient failures. MaxAttempts <= 1 disables retrying.
+type Policy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	// Jitter is the fraction (0..1) of each delay that is randomized.
+	Jitter float64
+	// MaxElapsed bounds the total time spent, including attempts; 0 means no bound.
+	MaxElapsed time.Duration
+}
+
+// Delay returns the backoff before attempt n+1 (n starts at 1): BaseDelay * 2^(n-1),
+// capped at MaxDelay, with up to Jitter of it randomized.
+func (p Policy) Delay(n int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < n && (p.MaxDelay <= 0 || d < p.MaxDelay); i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if p.Jitter > 0 && d > 0 {
+		j := p.Jitter
+		if j > 1 {
+			j = 1
+		}
+		spread := time.Duration(float64(d) * j)
+		d = d - spread + time.Duration(rand.Int64N(int64(2*spread)+1))
+	}
+	return d
+}
+
+// Func is one attempt; it reports whether a failure is worth retrying.
+type Func func(ctx context.Context, attempt int) (retryable bool, err error)
+
+// Do calls fn until it succeeds, fails permanently, or the policy, MaxElapsed or the ctx
+// deadline leaves no room for another attempt. It returns the number of attempts made and
+// the last error. onRetry (optional) is called before each wait.
+func Do(ctx context.Context, p Policy, fn Func, onRetry func(attempt int, err error, wait time.Duration)) (int, error) {
+	start := time.Now()
+	maxAttempts := p.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	for attempt := 1; ; attempt++ {
+		retryable, err := fn(ctx, attempt)
+		if err == nil || !retryable || attempt >= maxAttempts {
+			return attempt, err
+		}
+		wait := p.Delay(attempt)
+		next := time.Now().Add(wait)
+		if p.MaxElapsed > 0 && next.Sub(start) >= p.MaxElapsed {
+			return attempt, err
+		}
+		if deadline, ok := ctx.Deadline(); ok && !next.Before(deadline) {
+			return attempt, err
+		}
+		if onRetry != nil {
+			onRetry(attempt, err, wait)
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return attempt, err
+		case <-t.C:
+		}
+	}
+}
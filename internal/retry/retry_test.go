@@ -0,0 +1,97 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var errTemp = errors.New("temporary")
+
+func TestPolicy_Delay(t *testing.T) {
+	p := Policy{BaseDelay: 100 * time.Millisecond, MaxDelay: 350 * time.Millisecond}
+	want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 350 * time.Millisecond, 350 * time.Millisecond}
+	for i, w := range want {
+		if got := p.Delay(i + 1); got != w {
+			t.Errorf("Delay(%d) = %v, want %v", i+1, got, w)
+		}
+	}
+}
+
+func TestPolicy_DelayJitter(t *testing.T) {
+	p := Policy{BaseDelay: 100 * time.Millisecond, Jitter: 0.5}
+	for i := 0; i < 50; i++ {
+		d := p.Delay(1)
+		if d < 50*time.Millisecond || d > 150*time.Millisecond {
+			t.Fatalf("Delay(1) = %v, want within [50ms,150ms]", d)
+		}
+	}
+}
+
+func TestDo_SucceedsAfterTransientFailures(t *testing.T) {
+	p := Policy{MaxAttempts: 5, BaseDelay: time.Millisecond}
+	var retries int
+	attempts, err := Do(context.Background(), p, func(ctx context.Context, attempt int) (bool, error) {
+		if attempt < 3 {
+			return true, errTemp
+		}
+		return false, nil
+	}, func(int, error, time.Duration) { retries++ })
+	if err != nil || attempts != 3 || retries != 2 {
+		t.Errorf("attempts=%d retries=%d err=%v, want 3/2/nil", attempts, retries, err)
+	}
+}
+
+func TestDo_StopsOnPermanentFailure(t *testing.T) {
+	p := Policy{MaxAttempts: 5, BaseDelay: time.Millisecond}
+	attempts, err := Do(context.Background(), p, func(ctx context.Context, attempt int) (bool, error) {
+		return false, errTemp
+	}, nil)
+	if attempts != 1 || !errors.Is(err, errTemp) {
+		t.Errorf("attempts=%d err=%v, want 1/errTemp", attempts, err)
+	}
+}
+
+func TestDo_MaxAttempts(t *testing.T) {
+	p := Policy{MaxAttempts: 3, BaseDelay: time.Millisecond}
+	attempts, err := Do(context.Background(), p, func(ctx context.Context, attempt int) (bool, error) {
+		return true, errTemp
+	}, nil)
+	if attempts != 3 || err == nil {
+		t.Errorf("attempts=%d err=%v, want 3/error", attempts, err)
+	}
+}
+
+func TestDo_ZeroPolicyIsSingleAttempt(t *testing.T) {
+	attempts, _ := Do(context.Background(), Policy{}, func(ctx context.Context, attempt int) (bool, error) {
+		return true, errTemp
+	}, nil)
+	if attempts != 1 {
+		t.Errorf("attempts = %d, want 1", attempts)
+	}
+}
+
+func TestDo_MaxElapsed(t *testing.T) {
+	p := Policy{MaxAttempts: 10, BaseDelay: 50 * time.Millisecond, MaxElapsed: 80 * time.Millisecond}
+	attempts, _ := Do(context.Background(), p, func(ctx context.Context, attempt int) (bool, error) {
+		return true, errTemp
+	}, nil)
+	// 1st attempt, wait 50ms, 2nd attempt; the next wait (100ms) would pass MaxElapsed.
+	if attempts != 2 {
+		t.Errorf("attempts = %d, want 2", attempts)
+	}
+}
+
+func TestDo_RespectsContextDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	p := Policy{MaxAttempts: 10, BaseDelay: time.Second}
+	start := time.Now()
+	attempts, _ := Do(ctx, p, func(ctx context.Context, attempt int) (bool, error) {
+		return true, errTemp
+	}, nil)
+	if attempts != 1 || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("attempts=%d elapsed=%v, want a single attempt without waiting past the deadline", attempts, time.Since(start))
+	}
+}
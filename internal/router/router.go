@@ -2,13 +2,27 @@ package router
 
 import (
 	"context"
+	"crypto/x509"
+	"io"
+	"sync/atomic"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/soulteary/health-kit"
+	"github.com/soulteary/herald-smtp/internal/auth"
+	"github.com/soulteary/herald-smtp/internal/breaker"
 	"github.com/soulteary/herald-smtp/internal/config"
+	"github.com/soulteary/herald-smtp/internal/deadletter"
+	"github.com/soulteary/herald-smtp/internal/dedup"
 	"github.com/soulteary/herald-smtp/internal/handler"
 	"github.com/soulteary/herald-smtp/internal/idempotency"
+	"github.com/soulteary/herald-smtp/internal/ipallow"
+	"github.com/soulteary/herald-smtp/internal/limiter"
+	"github.com/soulteary/herald-smtp/internal/outbox"
+	"github.com/soulteary/herald-smtp/internal/queue"
+	"github.com/soulteary/herald-smtp/internal/retry"
 	"github.com/soulteary/herald-smtp/internal/smtp"
+	"github.com/soulteary/herald-smtp/internal/status"
 	"github.com/soulteary/logger-kit"
 	"github.com/soulteary/provider-kit"
 )
@@ -18,14 +32,130 @@ type sendClient interface {
 	Send(ctx context.Context, msg *provider.Message) (*provider.SendResult, error)
 }
 
+// Lifecycle is returned by Setup and drives graceful shutdown: BeginDrain fails readiness,
+// StopAccepting rejects new sends, WaitIdle waits for in-flight sends and Close stops the
+// background workers once the HTTP server has shut down.
+type Lifecycle struct {
+	h        *handler.Handler
+	log      *logger.Logger
+	draining atomic.Bool
+	stopped  atomic.Bool
+	inflight atomic.Int64
+	// stopReplay ends an outbox replay still waiting for queue slots.
+	stopReplay context.CancelFunc
+}
+
+// BeginDrain makes /readyz fail so load balancers stop routing here; sends are still served.
+func (l *Lifecycle) BeginDrain() {
+	l.draining.Store(true)
+}
+
+// StopAccepting makes POST /v1/send respond 503 provider_down.
+func (l *Lifecycle) StopAccepting() {
+	l.draining.Store(true)
+	l.stopped.Store(true)
+}
+
+// ReloadKeys re-reads API_KEYS_FILE, JWT_JWKS_FILE and TLS_CLIENT_IDENTITIES_FILE; on
+// error the current keys stay valid.
+func (l *Lifecycle) ReloadKeys() error {
+	if err := l.h.Keys.Reload(); err != nil {
+		return err
+	}
+	l.log.Info().Int("keys", l.h.Keys.Len()).Msg("API keys reloaded")
+	if l.h.JWT != nil {
+		if err := l.h.JWT.Reload(); err != nil {
+			return err
+		}
+		l.log.Info().Int("keys", l.h.JWT.Len()).Msg("JWKS reloaded")
+	}
+	if l.h.Certs != nil {
+		if err := l.h.Certs.Reload(); err != nil {
+			return err
+		}
+		l.log.Info().Int("identities", l.h.Certs.Len()).Msg("client certificate identities reloaded")
+	}
+	return nil
+}
+
+// VerifyClientCert is the TLS handshake allowlist of TLS_CLIENT_IDENTITIES_FILE: it
+// rejects client certificates that match no identity.
+func (l *Lifecycle) VerifyClientCert(cert *x509.Certificate) error {
+	return l.h.Certs.Verify(cert)
+}
+
+// InFlight returns the number of sends being handled.
+func (l *Lifecycle) InFlight() int {
+	return int(l.inflight.Load())
+}
+
+// WaitIdle waits until no send is being handled, or returns ctx.Err().
+func (l *Lifecycle) WaitIdle(ctx context.Context) error {
+	tick := time.NewTicker(20 * time.Millisecond)
+	defer tick.Stop()
+	for l.inflight.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tick.C:
+		}
+	}
+	return nil
+}
+
+// Close stops the scheduler and waits for queue workers until ctx ends. Messages that
+// were not delivered, including those still queued when ctx ends, stay in the outbox, or
+// are moved to the dead letters without one.
+func (l *Lifecycle) Close(ctx context.Context) error {
+	h, log := l.h, l.log
+	if l.stopReplay != nil {
+		l.stopReplay()
+	}
+	if c, ok := h.Idem.(io.Closer); ok {
+		defer func() {
+			if err := c.Close(); err != nil {
+				log.Warn().Err(err).Msg("closing idempotency store")
+			}
+		}()
+	}
+	if h.Breaker != nil {
+		h.Breaker.Stop()
+	}
+	h.JWT.Close()
+	if h.Queue == nil {
+		return nil
+	}
+	h.Scheduler.Stop()
+	if held := h.Scheduler.Pending(); len(held) > 0 {
+		log.Info().Int("count", len(held)).Msg("scheduled messages not yet due at shutdown")
+		for _, job := range held {
+			h.Shelve(job, nil)
+		}
+	}
+	err := h.Queue.Close(ctx)
+	if left := h.Queue.Drain(); len(left) > 0 {
+		log.Warn().Int("count", len(left)).Msg("queued messages not started before shutdown deadline")
+		for _, job := range left {
+			h.Shelve(job, nil)
+		}
+	}
+	if h.Outbox != nil {
+		if n := h.Outbox.Len(); n > 0 {
+			log.Info().Int("pending", n).Msg("undelivered messages kept in outbox for replay")
+		}
+		_ = h.Outbox.Close()
+	}
+	return err
+}
+
 // Setup mounts routes. smtpClient can be nil if config invalid (send will return 503).
-func Setup(app *fiber.App, log *logger.Logger) {
-	setupWith(app, log, nil)
+func Setup(app *fiber.App, log *logger.Logger) *Lifecycle {
+	return setupWith(app, log, nil)
 }
 
 // setupWith mounts routes; if inject is non-nil it is used as the send client (for tests).
-func setupWith(app *fiber.App, log *logger.Logger, inject sendClient) {
-	idemStore := idempotency.NewStore(config.IdemTTLSec)
+func setupWith(app *fiber.App, log *logger.Logger, inject sendClient) *Lifecycle {
+	idemStore := newIdemStore(log)
 	var smtpClient sendClient
 	if inject != nil {
 		smtpClient = inject
@@ -37,15 +167,346 @@ func setupWith(app *fiber.App, log *logger.Logger, inject sendClient) {
 			smtpClient = client
 		}
 	}
-	v1 := app.Group("/v1")
-	v1.Post("/send", func(c *fiber.Ctx) error {
-		if smtpClient == nil {
-			log.Warn().Msg("send 503: SMTP not configured")
-			return c.Status(fiber.StatusServiceUnavailable).JSON(provider.HTTPSendResponse{
-				OK: false, ErrorCode: "provider_down", ErrorMessage: "SMTP not configured",
-			})
+	h := &handler.Handler{Sender: smtpClient, Idem: idemStore, Keys: apiKeys(log), JWT: jwtVerifier(log), Certs: certIdentities(log), Retry: retryPolicy(), Log: log}
+	lc := &Lifecycle{h: h, log: log}
+	dl, err := deadletter.Open(config.DeadLetterDir, config.DeadLetterMaxEntries)
+	if err != nil {
+		log.Error().Err(err).Str("dir", config.DeadLetterDir).Msg("failed to open dead letter dir; keeping dead letters in memory")
+		dl, _ = deadletter.Open("", config.DeadLetterMaxEntries)
+	}
+	h.DeadLetters = dl
+	h.Status = status.NewTracker(config.StatusMaxEntries, time.Duration(config.StatusTTLSec)*time.Second)
+	h.Networks = networks(log)
+	if config.DedupWindowSec > 0 {
+		h.Dedup = dedup.New(time.Duration(config.DedupWindowSec)*time.Second, config.DedupMaxEntries)
+	}
+	if smtpClient != nil && config.BreakerEnabled {
+		h.Breaker = newBreaker(smtpClient, log)
+	}
+	if smtpClient != nil && config.SMTPMaxSessions > 0 {
+		h.Sessions = limiter.New(config.SMTPMaxSessions, config.SMTPMaxSessionWaiters,
+			time.Duration(config.SMTPSessionWaitMs)*time.Millisecond)
+	}
+	if smtpClient != nil {
+		h.LaneSessions = laneSessions()
+		h.Queue = queue.NewLanes([]queue.Lane{
+			{Name: handler.PriorityNormal, Size: config.QueueSize, Workers: config.QueueWorkers},
+			{Name: handler.PriorityCritical, Size: config.QueueSizeCritical, Workers: config.QueueWorkersCritical},
+			{Name: handler.PriorityBulk, Size: config.QueueSizeBulk, Workers: config.QueueWorkersBulk},
+		}, h.Deliver)
+		h.Queue.Start()
+		h.Scheduler = queue.NewScheduler(h.Queue, config.ScheduleMaxJobs)
+		h.Scheduler.Start()
+		if config.OutboxDir != "" {
+			ob, err := outbox.Open(config.OutboxDir, config.OutboxMaxBytes)
+			if err != nil {
+				log.Error().Err(err).Str("dir", config.OutboxDir).Msg("failed to open outbox; queued messages will not survive restarts")
+			} else {
+				h.Outbox = ob
+				var ctx context.Context
+				ctx, lc.stopReplay = context.WithCancel(context.Background())
+				replay(ctx, h.Queue, h.Scheduler, ob, h.Status, log)
+			}
+		} else {
+			log.Info().Msg("OUTBOX_DIR not set; queued and scheduled messages are held in memory only and lost on a crash")
 		}
-		return handler.SendHandler(c, smtpClient, idemStore, log)
+	}
+	v1 := app.Group("/v1", h.RequireNetwork())
+	// sending rejects sends while shutting down or unconfigured and counts them in flight.
+	// The count goes up before stopped is checked, so a send that passes the check is
+	// always seen by a drain that starts after StopAccepting.
+	sending := func(next fiber.Handler) fiber.Handler {
+		return func(c *fiber.Ctx) error {
+			lc.inflight.Add(1)
+			defer lc.inflight.Add(-1)
+			if lc.stopped.Load() {
+				log.Warn().Msg("send 503: shutting down")
+				return c.Status(fiber.StatusServiceUnavailable).JSON(provider.HTTPSendResponse{
+					OK: false, ErrorCode: "provider_down", ErrorMessage: "service is shutting down",
+				})
+			}
+			if smtpClient == nil {
+				log.Warn().Msg("send 503: SMTP not configured")
+				return c.Status(fiber.StatusServiceUnavailable).JSON(provider.HTTPSendResponse{
+					OK: false, ErrorCode: "provider_down", ErrorMessage: "SMTP not configured",
+				})
+			}
+			return next(c)
+		}
+	}
+	v1.Post("/send", sending(h.Send))
+	v1.Post("/send/batch", sending(h.SendBatch))
+	v1.Get("/messages/:id", h.RequireScope(auth.ScopeSend), h.GetMessage)
+	v1.Delete("/messages/:id", h.RequireScope(auth.ScopeSend), h.CancelMessage)
+	admin := v1.Group("/admin", h.RequireScope(auth.ScopeAdmin))
+	admin.Get("/dead-letters", h.ListDeadLetters)
+	admin.Delete("/dead-letters", h.PurgeDeadLetters)
+	admin.Get("/dead-letters/:id", h.GetDeadLetter)
+	admin.Delete("/dead-letters/:id", h.DeleteDeadLetter)
+	admin.Post("/dead-letters/:id/replay", h.ReplayDeadLetter)
+	app.Get("/healthz", health.FiberHandler(healthChecks(h.Breaker, h.Sessions, h.Idem)))
+	app.Get("/readyz", health.FiberReadinessHandler(readiness(lc)))
+	return lc
+}
+
+// readiness fails while the service drains, so load balancers stop sending traffic.
+func readiness(lc *Lifecycle) *health.Aggregator {
+	cfg := health.DefaultConfig().WithServiceName("herald-smtp").WithCriticalChecks([]string{"accepting"})
+	return health.NewAggregator(cfg).AddChecker(health.NewCheckerFunc("accepting", func(ctx context.Context) health.CheckResult {
+		res := health.CheckResult{Name: "accepting", Status: health.StatusHealthy, Timestamp: time.Now(),
+			Metadata: map[string]any{"in_flight": lc.InFlight()}}
+		if lc.draining.Load() {
+			res.Status = health.StatusUnhealthy
+			res.Message = "draining"
+		}
+		return res
+	}))
+}
+
+// apiKeys loads the API key registry: the keys of API_KEYS_FILE plus the shared API_KEY.
+// An unreadable or invalid keys file is fatal rather than leaving the API unauthenticated.
+func apiKeys(log *logger.Logger) *auth.Registry {
+	keys, err := auth.Open(config.APIKeysFile, auth.SharedKey(config.APIKey)...)
+	if err != nil {
+		log.Fatal().Err(err).Str("path", config.APIKeysFile).Msg("failed to load API keys")
+	}
+	if keys.Len() == 0 && config.JWTJWKSFile == "" && config.TLSClientIdentitiesFile == "" {
+		log.Warn().Msg("no API keys configured; endpoints are unauthenticated")
+	}
+	if config.RequestSigning != "off" {
+		keys.EnableSignatures(time.Duration(config.SignatureMaxSkewSec)*time.Second, config.SignatureMaxNonces)
+	}
+	return keys
+}
+
+// jwtVerifier loads JWT_JWKS_FILE for bearer token authentication and watches it for
+// changes, or returns nil when it is not set. An unreadable or invalid JWKS is fatal.
+func jwtVerifier(log *logger.Logger) *auth.JWTVerifier {
+	path := config.JWTJWKSFile
+	if path == "" {
+		return nil
+	}
+	v, err := auth.OpenJWKS(auth.JWTConfig{
+		JWKSFile:       path,
+		Issuer:         config.JWTIssuer,
+		Audience:       config.JWTAudience,
+		Leeway:         time.Duration(config.JWTLeewaySec) * time.Second,
+		Subjects:       config.JWTSubjects(),
+		TemplatesClaim: config.JWTTemplatesClaim,
+		SendersClaim:   config.JWTSendersClaim,
 	})
-	app.Get("/healthz", health.SimpleFiberHandler("herald-smtp"))
+	if err != nil {
+		log.Fatal().Err(err).Str("path", path).Msg("failed to load JWKS")
+	}
+	if config.JWTIssuer == "" || config.JWTAudience == "" {
+		log.Warn().Msg("JWT_ISSUER or JWT_AUDIENCE not set; bearer tokens for other services are accepted")
+	}
+	v.Watch(time.Duration(config.JWTJWKSReloadSec)*time.Second, func(err error) {
+		if err != nil {
+			log.Error().Err(err).Str("path", path).Msg("JWKS reload failed; keeping current keys")
+			return
+		}
+		log.Info().Int("keys", v.Len()).Str("path", path).Msg("JWKS reloaded")
+	})
+	return v
+}
+
+// networks builds the source network policy of ALLOWED_CIDRS and TRUSTED_PROXIES, or
+// returns nil when neither is set. An invalid network is fatal rather than leaving the
+// API open.
+func networks(log *logger.Logger) *ipallow.Policy {
+	allowed, proxies := config.AllowedNetworks(), config.TrustedProxyNetworks()
+	if len(allowed) == 0 && len(proxies) == 0 {
+		return nil
+	}
+	p, err := ipallow.New(allowed, proxies)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid ALLOWED_CIDRS or TRUSTED_PROXIES")
+	}
+	log.Info().Strs("allowed", allowed).Strs("trusted_proxies", proxies).Msg("source network policy enabled")
+	return p
+}
+
+// certIdentities loads TLS_CLIENT_IDENTITIES_FILE, or returns nil when it is not set. An
+// unreadable or invalid file is fatal.
+func certIdentities(log *logger.Logger) *auth.CertIdentities {
+	path := config.TLSClientIdentitiesFile
+	if path == "" {
+		return nil
+	}
+	ci, err := auth.OpenCertIdentities(path)
+	if err != nil {
+		log.Fatal().Err(err).Str("path", path).Msg("failed to load client certificate identities")
+	}
+	if config.TLSClientCAFile == "" || config.TLSClientAuth == "none" {
+		log.Warn().Msg("TLS_CLIENT_IDENTITIES_FILE set without client certificates (TLS_CLIENT_CA_FILE); it has no effect")
+	}
+	return ci
+}
+
+// newIdemStore builds the idempotency store selected by config. A Redis URL that cannot
+// be parsed falls back to the in-memory store; an unreachable server is only logged, as
+// the store fails open.
+func newIdemStore(log *logger.Logger) idempotency.Store {
+	if config.IdemStore != "redis" {
+		return newMemoryIdemStore(log)
+	}
+	client, err := idempotency.NewRedisClient(config.IdemRedisURL)
+	if err != nil {
+		log.Error().Err(err).Msg("invalid IDEMPOTENCY_REDIS_URL; using in-memory idempotency store")
+		return newMemoryIdemStore(log)
+	}
+	timeout := time.Duration(config.IdemRedisTimeoutMs) * time.Millisecond
+	store := idempotency.NewRedisStore(client, config.IdemRedisPrefix, config.IdemTTLSec, timeout)
+	store.OnError = func(op string, err error) {
+		log.Warn().Err(err).Str("op", op).Msg("idempotency store unavailable; request not deduplicated")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := store.Ping(ctx); err != nil {
+		log.Warn().Err(err).Str("addr", client.Options().Addr).Msg("idempotency Redis not reachable yet")
+	} else {
+		log.Info().Str("addr", client.Options().Addr).Msg("using Redis idempotency store")
+	}
+	return store
+}
+
+// newMemoryIdemStore builds the bounded in-memory idempotency store and starts its janitor.
+// With IDEMPOTENCY_SNAPSHOT_FILE it restores the last snapshot and keeps writing new ones.
+func newMemoryIdemStore(log *logger.Logger) *idempotency.MemoryStore {
+	store := idempotency.NewMemoryStore(config.IdemTTLSec, config.IdemMaxEntries)
+	store.StartJanitor(time.Duration(config.IdemSweepSec) * time.Second)
+	if path := config.IdemSnapshotFile; path != "" {
+		if n, err := store.Load(path); err != nil {
+			log.Warn().Err(err).Str("path", path).Msg("idempotency snapshot not loaded")
+		} else {
+			log.Info().Int("entries", n).Str("path", path).Msg("idempotency snapshot loaded")
+		}
+		store.StartSnapshots(path, time.Duration(config.IdemSnapshotSec)*time.Second, func(err error) {
+			log.Warn().Err(err).Str("path", path).Msg("idempotency snapshot not written")
+		})
+	}
+	return store
+}
+
+// retryPolicy builds the SMTP retry policy from config.
+func retryPolicy() retry.Policy {
+	return retry.Policy{
+		MaxAttempts: config.RetryMaxAttempts,
+		BaseDelay:   time.Duration(config.RetryBaseDelayMs) * time.Millisecond,
+		MaxDelay:    time.Duration(config.RetryMaxDelayMs) * time.Millisecond,
+		Jitter:      config.RetryJitter,
+		MaxElapsed:  time.Duration(config.RetryMaxElapsedSec) * time.Second,
+	}
+}
+
+// prober is implemented by *smtp.Client.
+type prober interface {
+	Probe(ctx context.Context) error
+}
+
+// newBreaker builds the relay circuit breaker from config; state changes are logged.
+func newBreaker(client sendClient, log *logger.Logger) *breaker.Breaker {
+	cfg := breaker.Config{
+		Window:       config.BreakerWindow,
+		MinRequests:  config.BreakerMinRequests,
+		FailureRatio: config.BreakerFailureRatio,
+		OpenFor:      time.Duration(config.BreakerOpenSec) * time.Second,
+		HalfOpenMax:  config.BreakerHalfOpenMax,
+		OnStateChange: func(from, to breaker.State) {
+			switch {
+			case from == to:
+				log.Warn().Str("relay", config.SMTPHost).Msg("SMTP relay probe failed; circuit stays open")
+			case to == breaker.Open:
+				log.Warn().Str("relay", config.SMTPHost).Str("from", string(from)).Msg("SMTP circuit breaker opened; failing fast")
+			default:
+				log.Info().Str("relay", config.SMTPHost).Str("from", string(from)).Str("to", string(to)).Msg("SMTP circuit breaker state changed")
+			}
+		},
+	}
+	if p, ok := client.(prober); ok && config.BreakerProbe == "noop" {
+		cfg.Probe = p.Probe
+		cfg.ProbeTimeout = config.SMTPTimeout()
+	}
+	return breaker.New(cfg)
+}
+
+// laneSessions gives critical and bulk messages their own SMTP session budgets, so bulk
+// mail cannot use up the sessions verification codes need.
+func laneSessions() map[string]*limiter.Limiter {
+	wait := time.Duration(config.SMTPSessionWaitMs) * time.Millisecond
+	lanes := make(map[string]*limiter.Limiter)
+	if config.SMTPMaxSessionsCritical > 0 {
+		lanes[handler.PriorityCritical] = limiter.New(config.SMTPMaxSessionsCritical, config.SMTPMaxSessionWaiters, wait)
+	}
+	if config.SMTPMaxSessionsBulk > 0 {
+		lanes[handler.PriorityBulk] = limiter.New(config.SMTPMaxSessionsBulk, config.SMTPMaxSessionWaiters, wait)
+	}
+	return lanes
+}
+
+// healthChecks reports the relay circuit breaker (an open breaker makes the service degraded),
+// SMTP session utilization and the size of the in-memory idempotency store.
+func healthChecks(b *breaker.Breaker, sessions *limiter.Limiter, idem idempotency.Store) *health.Aggregator {
+	agg := health.NewAggregator(health.DefaultConfig().WithServiceName("herald-smtp"))
+	if mem, ok := idem.(*idempotency.MemoryStore); ok {
+		agg.AddChecker(health.NewCheckerFunc("idempotency", func(ctx context.Context) health.CheckResult {
+			st := mem.Stats()
+			return health.CheckResult{Name: "idempotency", Status: health.StatusHealthy, Timestamp: time.Now(),
+				Metadata: map[string]any{
+					"entries": st.Entries, "max_entries": st.MaxEntries, "expired": st.Expired, "evicted": st.Evicted,
+				}}
+		}))
+	}
+	if sessions != nil {
+		agg.AddChecker(health.NewCheckerFunc("smtp_sessions", func(ctx context.Context) health.CheckResult {
+			st := sessions.Stats()
+			return health.CheckResult{Name: "smtp_sessions", Status: health.StatusHealthy, Timestamp: time.Now(),
+				Metadata: map[string]any{
+					"in_use": st.InUse, "limit": st.Limit, "waiting": st.Waiting,
+					"max_waiting": st.MaxWaiting, "rejected": st.Rejected,
+				}}
+		}))
+	}
+	if b == nil {
+		return agg
+	}
+	return agg.AddChecker(health.NewCheckerFunc("smtp_relay", func(ctx context.Context) health.CheckResult {
+		st := b.State()
+		res := health.CheckResult{Name: "smtp_relay", Status: health.StatusHealthy, Timestamp: time.Now(),
+			Metadata: map[string]any{"breaker": string(st)}}
+		if st != breaker.Closed {
+			res.Status = health.StatusDegraded
+			res.Message = "circuit breaker " + string(st)
+		}
+		return res
+	}))
+}
+
+// replay re-queues messages left in the outbox by a previous run until ctx ends;
+// scheduled messages that are not yet due go back to the scheduler.
+func replay(ctx context.Context, q *queue.Queue, sched *queue.Scheduler, ob *outbox.Outbox, st *status.Tracker, log *logger.Logger) {
+	jobs := ob.Pending()
+	if len(jobs) == 0 {
+		return
+	}
+	for _, job := range jobs {
+		st.Begin(job.ID, job.Request.To, "async", job.APIKey)
+		st.Queue(job.ID, job.SendAt)
+	}
+	log.Info().Int("count", len(jobs)).Msg("replaying messages from outbox")
+	go func() {
+		for _, job := range jobs {
+			if job.SendAt.After(time.Now()) {
+				if err := sched.Schedule(job); err != nil {
+					log.Warn().Err(err).Str("message_id", job.ID).Msg("outbox replay: cannot reschedule message")
+				}
+				continue
+			}
+			if err := q.Submit(ctx, job); err != nil {
+				log.Warn().Err(err).Str("message_id", job.ID).Msg("outbox replay stopped")
+				return
+			}
+		}
+	}()
 }
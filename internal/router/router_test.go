@@ -7,9 +7,11 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/soulteary/herald-smtp/internal/config"
+	"github.com/soulteary/herald-smtp/internal/status"
 	"github.com/soulteary/logger-kit"
 	"github.com/soulteary/provider-kit"
 )
@@ -100,3 +102,99 @@ func TestRouter_Send_200WhenInjectClient(t *testing.T) {
 		t.Errorf("response OK=%v message_id=%q", out.OK, out.MessageID)
 	}
 }
+
+// TestRouter_Drain: readiness fails after BeginDrain, sends are rejected after StopAccepting.
+func TestRouter_Drain(t *testing.T) {
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	log := logger.New(logger.Config{Level: logger.InfoLevel, ServiceName: "test"})
+	lc := setupWith(app, log, &mockSendClient{})
+	status := func(method, path string) int {
+		t.Helper()
+		body, _ := json.Marshal(provider.HTTPSendRequest{To: "u@example.com"})
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	if got := status(http.MethodGet, "/readyz"); got != http.StatusOK {
+		t.Errorf("GET /readyz = %d, want 200", got)
+	}
+	lc.BeginDrain()
+	if got := status(http.MethodGet, "/readyz"); got != http.StatusServiceUnavailable {
+		t.Errorf("GET /readyz while draining = %d, want 503", got)
+	}
+	if got := status(http.MethodPost, "/v1/send"); got != http.StatusOK {
+		t.Errorf("send during pre-stop = %d, want 200", got)
+	}
+	lc.StopAccepting()
+	if got := status(http.MethodPost, "/v1/send"); got != http.StatusServiceUnavailable {
+		t.Errorf("send after StopAccepting = %d, want 503", got)
+	}
+	if got := status(http.MethodGet, "/healthz"); got != http.StatusOK {
+		t.Errorf("GET /healthz while draining = %d, want 200 (liveness)", got)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := lc.WaitIdle(ctx); err != nil {
+		t.Errorf("WaitIdle: %v", err)
+	}
+	if err := lc.Close(ctx); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+}
+
+func TestLifecycle_CloseShelvesQueuedJobs(t *testing.T) {
+	oldWorkers := config.QueueWorkers
+	defer func() { config.QueueWorkers = oldWorkers }()
+	config.QueueWorkers = 1
+
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{}, 1)
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	log := logger.New(logger.Config{Level: logger.InfoLevel, ServiceName: "test"})
+	lc := setupWith(app, log, &mockSendClient{
+		sendFunc: func(ctx context.Context, msg *provider.Message) (*provider.SendResult, error) {
+			started <- struct{}{}
+			<-release // a relay that never answers
+			return nil, ctx.Err()
+		},
+	})
+	send := func(body string) string {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out provider.HTTPSendResponse
+		_ = json.NewDecoder(resp.Body).Decode(&out)
+		if resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("async send = %d, want 202", resp.StatusCode)
+		}
+		return out.MessageID
+	}
+	send(`{"to":"a@example.com","async":true}`)
+	<-started
+	queued := []string{send(`{"to":"b@example.com","async":true}`), send(`{"to":"c@example.com","async":true}`)}
+
+	lc.StopAccepting()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := lc.Close(ctx); err == nil {
+		t.Fatal("Close returned nil with a blocked relay")
+	}
+	for _, id := range queued {
+		if _, err := lc.h.DeadLetters.Get(id); err != nil {
+			t.Errorf("queued message %s not in dead letters: %v", id, err)
+		}
+		if r, ok := lc.h.Status.Get(id); !ok || r.Status != status.Failed {
+			t.Errorf("queued message %s status = %q, want failed", id, r.Status)
+		}
+	}
+}
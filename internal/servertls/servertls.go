@@ -0,0 +1,210 @@
+package servertls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Client certificate modes.
+const (
+	ClientAuthNone     = "none"     // no client certificate is requested
+	ClientAuthOptional = "optional" // a certificate, when sent, must verify
+	ClientAuthRequire  = "require"  // every connection needs a verified certificate
+)
+
+// Config configures the listener. ClientCAFile enables client certificates, verified
+// according to ClientAuth. VerifyPeer, when set, runs on each verified client certificate
+// and fails the handshake when it returns an error (see auth.CertIdentities.Verify).
+type Config struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+	ClientAuth   string
+	MinVersion   string // "1.2" (default) or "1.3"
+	VerifyPeer   func(cert *x509.Certificate) error
+}
+
+// Server builds the TLS configuration of the HTTP listener: a server certificate and,
+// optionally, a client CA bundle for mutual TLS, both reloaded from disk without a restart.
+type Server struct {
+	cfg        Config
+	minVersion uint16
+	clientAuth tls.ClientAuthType
+
+	mu      sync.RWMutex
+	current *tls.Config
+	stamps  []fileStamp
+
+	stop      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// fileStamp identifies a version of a file.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// New validates cfg and loads its files.
+func New(cfg Config) (*Server, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, errors.New("certificate and key files are required")
+	}
+	s := &Server{cfg: cfg, stop: make(chan struct{})}
+	switch cfg.MinVersion {
+	case "", "1.2":
+		s.minVersion = tls.VersionTLS12
+	case "1.3":
+		s.minVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("unsupported minimum TLS version %q", cfg.MinVersion)
+	}
+	switch {
+	case cfg.ClientCAFile == "" || cfg.ClientAuth == ClientAuthNone:
+		s.clientAuth = tls.NoClientCert
+	case cfg.ClientAuth == ClientAuthOptional:
+		s.clientAuth = tls.VerifyClientCertIfGiven
+	case cfg.ClientAuth == ClientAuthRequire || cfg.ClientAuth == "":
+		s.clientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown client auth mode %q", cfg.ClientAuth)
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// TLSConfig returns the configuration for the listener. Every handshake uses the
+// certificate and client CAs loaded last.
+func (s *Server) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: s.minVersion,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			s.mu.RLock()
+			defer s.mu.RUnlock()
+			return s.current, nil
+		},
+	}
+}
+
+// MutualTLS reports whether client certificates are requested.
+func (s *Server) MutualTLS() bool {
+	return s.clientAuth != tls.NoClientCert
+}
+
+// Reload re-reads the certificate, key and client CA bundle. On error the current ones
+// are kept.
+func (s *Server) Reload() error {
+	stamps, err := s.stat()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(s.cfg.CertFile, s.cfg.KeyFile)
+	if err != nil {
+		return err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   s.minVersion,
+		ClientAuth:   s.clientAuth,
+	}
+	if s.clientAuth != tls.NoClientCert {
+		pem, err := os.ReadFile(s.cfg.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%s: no CA certificates", s.cfg.ClientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.VerifyConnection = s.verifyConnection
+	}
+	s.mu.Lock()
+	s.current, s.stamps = cfg, stamps
+	s.mu.Unlock()
+	return nil
+}
+
+// verifyConnection applies VerifyPeer to a verified client certificate.
+func (s *Server) verifyConnection(cs tls.ConnectionState) error {
+	if s.cfg.VerifyPeer == nil || len(cs.VerifiedChains) == 0 {
+		return nil
+	}
+	return s.cfg.VerifyPeer(cs.PeerCertificates[0])
+}
+
+// stat returns the stamps of the certificate, key and client CA files.
+func (s *Server) stat() ([]fileStamp, error) {
+	files := []string{s.cfg.CertFile, s.cfg.KeyFile}
+	if s.clientAuth != tls.NoClientCert {
+		files = append(files, s.cfg.ClientCAFile)
+	}
+	stamps := make([]fileStamp, len(files))
+	for i, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		stamps[i] = fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+	}
+	return stamps, nil
+}
+
+// Watch reloads the files every interval when one of them changed, until Close. onReload,
+// when set, receives the outcome of each reload.
+func (s *Server) Watch(interval time.Duration, onReload func(error)) {
+	if interval <= 0 {
+		return
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-t.C:
+				if !s.changed() {
+					continue
+				}
+				err := s.Reload()
+				if onReload != nil {
+					onReload(err)
+				}
+			}
+		}
+	}()
+}
+
+// changed reports whether a file differs from the version loaded last. Files that cannot
+// be read count as unchanged, so a certificate being replaced is picked up once complete.
+func (s *Server) changed() bool {
+	stamps, err := s.stat()
+	if err != nil {
+		return false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for i := range stamps {
+		if stamps[i] != s.stamps[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// Close stops Watch.
+func (s *Server) Close() {
+	s.closeOnce.Do(func() { close(s.stop) })
+	s.wg.Wait()
+}
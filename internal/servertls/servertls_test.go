@@ -0,0 +1,243 @@
+package servertls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+var serial int64
+
+func newCA(t *testing.T) *testCA {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	serial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial), Subject: pkix.Name{CommonName: "test CA"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour),
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a PEM certificate and key for cn signed by ca.
+func (ca *testCA) issue(t *testing.T, cn string, usage x509.ExtKeyUsage) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	serial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial), Subject: pkix.Name{CommonName: cn},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour),
+		KeyUsage: x509.KeyUsageDigitalSignature, ExtKeyUsage: []x509.ExtKeyUsage{usage},
+		DNSNames: []string{cn}, IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, _ := x509.MarshalECPrivateKey(key)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb})
+}
+
+func writeFile(t *testing.T, path string, b []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// Move the modification time so coarse-grained file systems still see a change.
+	future := time.Now().Add(time.Duration(serial) * time.Second)
+	_ = os.Chtimes(path, future, future)
+}
+
+// serve accepts TLS connections with srv until the test ends, completing each handshake.
+func serve(t *testing.T, srv *Server) string {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", srv.TLSConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_ = conn.(*tls.Conn).Handshake()
+				_, _ = conn.Read(make([]byte, 1))
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// dial completes a handshake and a round trip, so client certificate rejections
+// (reported after the TLS 1.3 handshake) surface, and returns the server leaf.
+func dial(addr string, roots *x509.CertPool, client *tls.Certificate) (*x509.Certificate, error) {
+	cfg := &tls.Config{RootCAs: roots, ServerName: "herald-smtp"}
+	if client != nil {
+		cfg.Certificates = []tls.Certificate{*client}
+	}
+	conn, err := tls.Dial("tcp", addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte{0}); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return conn.ConnectionState().PeerCertificates[0], nil
+}
+
+func TestServer_MutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	serverCA, clientCA, otherCA := newCA(t), newCA(t), newCA(t)
+	certPEM, keyPEM := serverCA.issue(t, "herald-smtp", x509.ExtKeyUsageServerAuth)
+	paths := map[string]string{"cert": filepath.Join(dir, "tls.crt"), "key": filepath.Join(dir, "tls.key"), "ca": filepath.Join(dir, "ca.crt")}
+	writeFile(t, paths["cert"], certPEM)
+	writeFile(t, paths["key"], keyPEM)
+	writeFile(t, paths["ca"], clientCA.pem)
+
+	srv, err := New(Config{
+		CertFile: paths["cert"], KeyFile: paths["key"], ClientCAFile: paths["ca"], ClientAuth: ClientAuthRequire,
+		VerifyPeer: func(cert *x509.Certificate) error {
+			if cert.Subject.CommonName != "herald" {
+				return errors.New("not allowed")
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !srv.MutualTLS() {
+		t.Error("MutualTLS = false with a client CA")
+	}
+	addr := serve(t, srv)
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCA.cert)
+	clientCert := func(ca *testCA, cn string) *tls.Certificate {
+		c, k := ca.issue(t, cn, x509.ExtKeyUsageClientAuth)
+		pair, err := tls.X509KeyPair(c, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &pair
+	}
+
+	if _, err := dial(addr, roots, clientCert(clientCA, "herald")); err != nil {
+		t.Errorf("allowed client certificate rejected: %v", err)
+	}
+	if _, err := dial(addr, roots, nil); err == nil {
+		t.Error("connection without a client certificate accepted")
+	}
+	if _, err := dial(addr, roots, clientCert(otherCA, "herald")); err == nil {
+		t.Error("client certificate from another CA accepted")
+	}
+	if _, err := dial(addr, roots, clientCert(clientCA, "billing")); err == nil {
+		t.Error("client certificate rejected by VerifyPeer accepted")
+	}
+}
+
+func TestServer_Reload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCA(t)
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	c1, k1 := ca.issue(t, "herald-smtp", x509.ExtKeyUsageServerAuth)
+	writeFile(t, certFile, c1)
+	writeFile(t, keyFile, k1)
+	srv, err := New(Config{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.MutualTLS() {
+		t.Error("MutualTLS = true without a client CA")
+	}
+	srv.Watch(10*time.Millisecond, nil)
+	defer srv.Close()
+	addr := serve(t, srv)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	first, err := dial(addr, roots, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c2, k2 := ca.issue(t, "herald-smtp", x509.ExtKeyUsageServerAuth)
+	writeFile(t, keyFile, k2)
+	writeFile(t, certFile, c2)
+	deadline := time.After(2 * time.Second)
+	for {
+		leaf, err := dial(addr, roots, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if leaf.SerialNumber.Cmp(first.SerialNumber) != 0 {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatal("renewed certificate not served")
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+
+	// A broken key keeps the current certificate.
+	writeFile(t, keyFile, []byte("not a key"))
+	if err := srv.Reload(); err == nil {
+		t.Error("Reload accepted an invalid key")
+	}
+	if _, err := dial(addr, roots, nil); err != nil {
+		t.Errorf("certificate lost after failed reload: %v", err)
+	}
+}
+
+func TestNew_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCA(t)
+	c, k := ca.issue(t, "herald-smtp", x509.ExtKeyUsageServerAuth)
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeFile(t, certFile, c)
+	writeFile(t, keyFile, k)
+	for name, cfg := range map[string]Config{
+		"no key":         {CertFile: certFile},
+		"min version":    {CertFile: certFile, KeyFile: keyFile, MinVersion: "1.1"},
+		"client auth":    {CertFile: certFile, KeyFile: keyFile, ClientCAFile: certFile, ClientAuth: "maybe"},
+		"missing CA":     {CertFile: certFile, KeyFile: keyFile, ClientCAFile: filepath.Join(dir, "none.crt")},
+		"CA without PEM": {CertFile: certFile, KeyFile: keyFile, ClientCAFile: keyFile},
+	} {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("%s: New accepted %+v", name, cfg)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package smtp
 
 import (
 	"context"
+	"net"
 
 	"github.com/soulteary/herald-smtp/internal/config"
 	"github.com/soulteary/provider-kit"
@@ -10,13 +11,29 @@ import (
 // Client wraps provider-kit SMTP provider for sending email via HTTP /v1/send.
 type Client struct {
 	provider provider.Provider
+	// dialer, host and port are used by Probe.
+	dialer contextDialer
+	host   string
+	port   int
+	// batch opens the connections of sessions; nil unless connections are dialed by
+	// herald-smtp itself, so batches use the same client as single sends.
+	batch *transport
 }
 
 // NewClient creates a client from config. Returns nil if config is invalid.
+// When a proxy or source IP is configured, connections are dialed by herald-smtp itself.
 func NewClient() (*Client, error) {
 	if !config.Valid() {
 		return nil, nil
 	}
+	if config.CustomDial() {
+		d, err := newDialer(config.SMTPProxyURL, config.SMTPSourceIP, config.SMTPTimeout())
+		if err != nil {
+			return nil, err
+		}
+		t := newTransport(d)
+		return &Client{dialer: d, host: config.SMTPHost, port: config.SMTPPort, provider: t, batch: t}, nil
+	}
 	cfg := &provider.SMTPConfig{
 		Host:        config.SMTPHost,
 		Port:        config.SMTPPort,
@@ -30,7 +47,26 @@ func NewClient() (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Client{provider: p}, nil
+	return &Client{
+		provider: p,
+		dialer:   &net.Dialer{Timeout: config.SMTPTimeout()},
+		host:     config.SMTPHost,
+		port:     config.SMTPPort,
+	}, nil
+}
+
+// newTransport builds a transport from config that dials with d.
+func newTransport(d contextDialer) *transport {
+	return &transport{
+		host:        config.SMTPHost,
+		port:        config.SMTPPort,
+		username:    config.SMTPUser,
+		password:    config.SMTPPass,
+		from:        config.SMTPFrom,
+		useStartTLS: config.UseStartTLS,
+		timeout:     config.SMTPTimeout(),
+		dialer:      d,
+	}
 }
 
 // Send sends an email using provider-kit Message; returns provider-kit SendResult and error.
@@ -40,3 +76,21 @@ func (c *Client) Send(ctx context.Context, msg *provider.Message) (*provider.Sen
 	}
 	return c.provider.Send(ctx, msg)
 }
+
+// Probe checks that the relay is reachable: it connects, reads the greeting and sends NOOP.
+func (c *Client) Probe(ctx context.Context) error {
+	if c == nil || c.dialer == nil {
+		return nil
+	}
+	return probe(ctx, c.dialer, c.host, c.port)
+}
+
+// NewSession returns a session that sends several messages over one connection, used for
+// batches. It returns nil when the client is not configured or sends through the
+// provider-kit provider, which opens a connection per message.
+func (c *Client) NewSession() *Session {
+	if c == nil || c.batch == nil {
+		return nil
+	}
+	return &Session{t: c.batch, maxMessages: config.SMTPSessionMaxMessages}
+}
@@ -0,0 +1,259 @@
+package smtp
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// contextDialer opens outbound TCP connections; *net.Dialer implements it.
+type contextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// newDialer builds the dialer used for SMTP connections. sourceIP (optional) binds the
+// local address; proxyURL (optional) tunnels through a SOCKS5 or HTTP CONNECT proxy.
+func newDialer(proxyURL, sourceIP string, timeout time.Duration) (contextDialer, error) {
+	d := &net.Dialer{Timeout: timeout}
+	if sourceIP != "" {
+		ip := net.ParseIP(sourceIP)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid SMTP_SOURCE_IP %q", sourceIP)
+		}
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	if proxyURL == "" {
+		return d, nil
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP_PROXY_URL: %w", err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid SMTP_PROXY_URL %q: missing host", proxyURL)
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		return &socks5Dialer{proxy: u.Host, user: u.User, forward: d}, nil
+	case "http":
+		return &connectDialer{proxy: u.Host, user: u.User, forward: d}, nil
+	default:
+		return nil, fmt.Errorf("unsupported SMTP_PROXY_URL scheme %q (want socks5 or http)", u.Scheme)
+	}
+}
+
+// socks5Dialer connects through a SOCKS5 proxy (RFC 1928) with optional
+// username/password authentication (RFC 1929). The target host is resolved by the proxy.
+type socks5Dialer struct {
+	proxy   string
+	user    *url.Userinfo
+	forward contextDialer
+}
+
+const (
+	socks5Version      = 0x05
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+	socks5AuthNoAccept = 0xff
+	socks5CmdConnect   = 0x01
+	socks5AtypIPv4     = 0x01
+	socks5AtypDomain   = 0x03
+	socks5AtypIPv6     = 0x04
+)
+
+func (s *socks5Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := s.forward.DialContext(ctx, network, s.proxy)
+	if err != nil {
+		return nil, fmt.Errorf("socks5 proxy dial: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if err := s.handshake(conn, addr); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (s *socks5Dialer) handshake(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("socks5: invalid port %q", portStr)
+	}
+
+	methods := []byte{socks5AuthNone}
+	if s.user != nil {
+		methods = append(methods, socks5AuthPassword)
+	}
+	if _, err := conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return fmt.Errorf("socks5 greeting: %w", err)
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("socks5 greeting: %w", err)
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("socks5: unexpected version %d", reply[0])
+	}
+	switch reply[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if s.user == nil {
+			return errors.New("socks5: proxy requires authentication")
+		}
+		if err := s.authenticate(conn); err != nil {
+			return err
+		}
+	case socks5AuthNoAccept:
+		return errors.New("socks5: no acceptable authentication method")
+	default:
+		return fmt.Errorf("socks5: unsupported authentication method %d", reply[1])
+	}
+
+	req := []byte{socks5Version, socks5CmdConnect, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(req, socks5AtypIPv4)
+			req = append(req, ip4...)
+		} else {
+			req = append(req, socks5AtypIPv6)
+			req = append(req, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return errors.New("socks5: host name too long")
+		}
+		req = append(req, socks5AtypDomain, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return fmt.Errorf("socks5 connect: %w", err)
+	}
+
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return fmt.Errorf("socks5 connect: %w", err)
+	}
+	if head[1] != 0x00 {
+		return fmt.Errorf("socks5: connect to %s failed (reply code %d)", addr, head[1])
+	}
+	var skip int
+	switch head[3] {
+	case socks5AtypIPv4:
+		skip = net.IPv4len
+	case socks5AtypIPv6:
+		skip = net.IPv6len
+	case socks5AtypDomain:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return fmt.Errorf("socks5 connect: %w", err)
+		}
+		skip = int(l[0])
+	default:
+		return fmt.Errorf("socks5: unknown bound address type %d", head[3])
+	}
+	// Bound address and port are not needed.
+	if _, err := io.CopyN(io.Discard, conn, int64(skip+2)); err != nil {
+		return fmt.Errorf("socks5 connect: %w", err)
+	}
+	return nil
+}
+
+func (s *socks5Dialer) authenticate(conn net.Conn) error {
+	user := s.user.Username()
+	pass, _ := s.user.Password()
+	if len(user) > 255 || len(pass) > 255 {
+		return errors.New("socks5: username or password too long")
+	}
+	req := []byte{0x01, byte(len(user))}
+	req = append(req, user...)
+	req = append(req, byte(len(pass)))
+	req = append(req, pass...)
+	if _, err := conn.Write(req); err != nil {
+		return fmt.Errorf("socks5 auth: %w", err)
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("socks5 auth: %w", err)
+	}
+	if reply[1] != 0x00 {
+		return errors.New("socks5: authentication failed")
+	}
+	return nil
+}
+
+// connectDialer connects through an HTTP proxy using the CONNECT method,
+// sending Basic Proxy-Authorization when credentials are set.
+type connectDialer struct {
+	proxy   string
+	user    *url.Userinfo
+	forward contextDialer
+}
+
+func (h *connectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := h.forward.DialContext(ctx, network, h.proxy)
+	if err != nil {
+		return nil, fmt.Errorf("http proxy dial: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if h.user != nil {
+		pass, _ := h.user.Password()
+		cred := base64.StdEncoding.EncodeToString([]byte(h.user.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+cred)
+	}
+	if err := req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("http proxy connect: %w", err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("http proxy connect: %w", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("http proxy connect to %s: %s", addr, resp.Status)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		// The SMTP greeting may arrive together with the proxy response.
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn drains bytes already read into r before reading from the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,223 @@
+package smtp
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/soulteary/provider-kit"
+)
+
+// startProxy runs handle for every connection accepted on a local listener.
+func startProxy(t *testing.T, handle func(net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// pipe copies bytes both ways until either side closes.
+func pipe(a, b net.Conn) {
+	go func() { _, _ = io.Copy(a, b); _ = a.Close() }()
+	_, _ = io.Copy(b, a)
+	_ = b.Close()
+}
+
+// fakeSOCKS5 is a SOCKS5 proxy that requires user/pass when wantUser is set.
+func fakeSOCKS5(t *testing.T, wantUser, wantPass string, authFailures *int32) string {
+	return startProxy(t, func(c net.Conn) {
+		defer func() { _ = c.Close() }()
+		head := make([]byte, 2)
+		if _, err := io.ReadFull(c, head); err != nil {
+			return
+		}
+		methods := make([]byte, head[1])
+		if _, err := io.ReadFull(c, methods); err != nil {
+			return
+		}
+		if wantUser == "" {
+			_, _ = c.Write([]byte{0x05, 0x00})
+		} else {
+			_, _ = c.Write([]byte{0x05, 0x02})
+			ver := make([]byte, 2)
+			if _, err := io.ReadFull(c, ver); err != nil {
+				return
+			}
+			user := make([]byte, ver[1])
+			_, _ = io.ReadFull(c, user)
+			pl := make([]byte, 1)
+			_, _ = io.ReadFull(c, pl)
+			pass := make([]byte, pl[0])
+			_, _ = io.ReadFull(c, pass)
+			if string(user) != wantUser || string(pass) != wantPass {
+				atomic.AddInt32(authFailures, 1)
+				_, _ = c.Write([]byte{0x01, 0x01})
+				return
+			}
+			_, _ = c.Write([]byte{0x01, 0x00})
+		}
+		req := make([]byte, 4)
+		if _, err := io.ReadFull(c, req); err != nil {
+			return
+		}
+		var host string
+		switch req[3] {
+		case 0x01:
+			ip := make([]byte, 4)
+			_, _ = io.ReadFull(c, ip)
+			host = net.IP(ip).String()
+		case 0x03:
+			l := make([]byte, 1)
+			_, _ = io.ReadFull(c, l)
+			name := make([]byte, l[0])
+			_, _ = io.ReadFull(c, name)
+			host = string(name)
+		}
+		pb := make([]byte, 2)
+		_, _ = io.ReadFull(c, pb)
+		target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(pb)))))
+		if err != nil {
+			_, _ = c.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		_, _ = c.Write([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+		pipe(c, target)
+	})
+}
+
+// fakeConnectProxy is an HTTP CONNECT proxy that requires wantAuth in Proxy-Authorization when set.
+func fakeConnectProxy(t *testing.T, wantAuth string) string {
+	return startProxy(t, func(c net.Conn) {
+		br := bufio.NewReader(c)
+		req, err := http.ReadRequest(br)
+		if err != nil || req.Method != http.MethodConnect {
+			_ = c.Close()
+			return
+		}
+		if wantAuth != "" && req.Header.Get("Proxy-Authorization") != wantAuth {
+			_, _ = c.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+			_ = c.Close()
+			return
+		}
+		target, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			_, _ = c.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+			_ = c.Close()
+			return
+		}
+		_, _ = c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		pipe(c, target)
+	})
+}
+
+func sendVia(t *testing.T, proxyURL string) (*fakeSMTPServer, error) {
+	t.Helper()
+	srv := newFakeSMTPServer(t)
+	host, port := srv.hostPort()
+	d, err := newDialer(proxyURL, "", 5*time.Second)
+	if err != nil {
+		t.Fatalf("newDialer(%q): %v", proxyURL, err)
+	}
+	tr := newTestTransport(host, port, d)
+	_, err = tr.Send(context.Background(), provider.NewMessage("u@example.com").WithBody("via proxy"))
+	return srv, err
+}
+
+func TestNewDialer_Direct(t *testing.T) {
+	d, err := newDialer("", "127.0.0.1", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, ok := d.(*net.Dialer)
+	if !ok || nd.LocalAddr == nil {
+		t.Fatalf("dialer = %#v, want *net.Dialer with LocalAddr", d)
+	}
+}
+
+func TestNewDialer_InvalidConfig(t *testing.T) {
+	for _, tc := range []struct{ proxy, source string }{
+		{"", "not-an-ip"},
+		{"ftp://proxy:21", ""},
+		{"socks5://", ""},
+		{"://bad", ""},
+	} {
+		if _, err := newDialer(tc.proxy, tc.source, time.Second); err == nil {
+			t.Errorf("newDialer(%q, %q) err = nil, want error", tc.proxy, tc.source)
+		}
+	}
+}
+
+func TestSOCKS5_NoAuth(t *testing.T) {
+	var failures int32
+	proxyAddr := fakeSOCKS5(t, "", "", &failures)
+	srv, err := sendVia(t, "socks5://"+proxyAddr)
+	if err != nil {
+		t.Fatalf("send via socks5: %v", err)
+	}
+	if n := len(srv.delivered()); n != 1 {
+		t.Errorf("delivered %d messages, want 1", n)
+	}
+}
+
+func TestSOCKS5_UserPass(t *testing.T) {
+	var failures int32
+	proxyAddr := fakeSOCKS5(t, "alice", "s3cret", &failures)
+	if _, err := sendVia(t, "socks5://alice:s3cret@"+proxyAddr); err != nil {
+		t.Fatalf("send via socks5 with auth: %v", err)
+	}
+	if _, err := sendVia(t, "socks5://alice:wrong@"+proxyAddr); err == nil {
+		t.Error("send with wrong socks5 password err = nil, want error")
+	}
+	if atomic.LoadInt32(&failures) != 1 {
+		t.Errorf("auth failures = %d, want 1", failures)
+	}
+}
+
+func TestSOCKS5_AuthRequiredWithoutCredentials(t *testing.T) {
+	var failures int32
+	proxyAddr := fakeSOCKS5(t, "alice", "s3cret", &failures)
+	if _, err := sendVia(t, "socks5://"+proxyAddr); err == nil {
+		t.Error("err = nil, want authentication required error")
+	}
+}
+
+func TestHTTPConnect(t *testing.T) {
+	proxyAddr := fakeConnectProxy(t, "")
+	srv, err := sendVia(t, "http://"+proxyAddr)
+	if err != nil {
+		t.Fatalf("send via http connect: %v", err)
+	}
+	if n := len(srv.delivered()); n != 1 {
+		t.Errorf("delivered %d messages, want 1", n)
+	}
+}
+
+func TestHTTPConnect_Auth(t *testing.T) {
+	// base64("bob:pw")
+	proxyAddr := fakeConnectProxy(t, "Basic Ym9iOnB3")
+	if _, err := sendVia(t, "http://bob:pw@"+proxyAddr); err != nil {
+		t.Fatalf("send via http connect with auth: %v", err)
+	}
+	if _, err := sendVia(t, "http://"+proxyAddr); err == nil {
+		t.Error("send without proxy credentials err = nil, want 407 error")
+	}
+}
@@ -0,0 +1,65 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"syscall"
+)
+
+// transientCodes are SMTP replies that mean "try again later" (RFC 5321 4yz) and are
+// worth retrying against the same relay.
+var transientCodes = map[int]bool{421: true, 450: true, 451: true, 452: true}
+
+// replyCode matches an SMTP reply code at the start of a message, e.g. "451 4.3.0 ...".
+var replyCode = regexp.MustCompile(`^([2-5][0-9]{2})[ -]`)
+
+// ReplyCode returns the code of the SMTP reply in err, or 0 when err is not a reply (a
+// network or local error). Only *textproto.Error carries a reply: numbers in other error
+// messages, such as ports or addresses, are not reply codes.
+func ReplyCode(err error) int {
+	var tp *textproto.Error
+	if errors.As(err, &tp) {
+		return tp.Code
+	}
+	return 0
+}
+
+// MessageReplyCode extracts the SMTP reply code a failure message starts with, or 0. It is
+// for failures reported only as text, such as a provider-kit SendResult.
+func MessageReplyCode(msg string) int {
+	m := replyCode.FindStringSubmatch(msg)
+	if m == nil {
+		return 0
+	}
+	code, _ := strconv.Atoi(m[1])
+	return code
+}
+
+// IsTransient reports whether err is a temporary failure: a 421/450/451/452 reply or a
+// dropped/refused connection. Permanent 5xx replies, caller cancellation and local
+// errors are not.
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if code := ReplyCode(err); code != 0 {
+		return transientCodes[code]
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne)
+}
+
+// IsTransientMessage reports whether a failure message carries a transient reply code.
+func IsTransientMessage(msg string) bool {
+	return transientCodes[MessageReplyCode(msg)]
+}
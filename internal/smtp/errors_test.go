@@ -0,0 +1,58 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"testing"
+)
+
+func TestIsTransient(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{&textproto.Error{Code: 421, Msg: "service not available"}, true},
+		{&textproto.Error{Code: 451, Msg: "4.3.0 try again"}, true},
+		{fmt.Errorf("rcpt: %w", &textproto.Error{Code: 452, Msg: "too many recipients"}), true},
+		{&textproto.Error{Code: 550, Msg: "5.1.1 no such user"}, false},
+		{&textproto.Error{Code: 535, Msg: "auth failed"}, false},
+		{errors.New("450 4.2.1 mailbox busy"), false}, // text, not a reply
+		{fmt.Errorf("dial tcp 10.0.0.1:451: %w", errors.New("no route to host")), false},
+		{io.EOF, true},
+		{fmt.Errorf("read: %w", io.ErrUnexpectedEOF), true},
+		{context.DeadlineExceeded, true},
+		{context.Canceled, false},
+		{errors.New("invalid address"), false},
+	}
+	for _, tc := range cases {
+		if got := IsTransient(tc.err); got != tc.want {
+			t.Errorf("IsTransient(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestReplyCode(t *testing.T) {
+	if got := ReplyCode(fmt.Errorf("rcpt: %w", &textproto.Error{Code: 451})); got != 451 {
+		t.Errorf("ReplyCode(textproto 451) = %d", got)
+	}
+	for _, err := range []error{nil, errors.New("550 5.1.1 no such user"), errors.New("dial tcp 192.0.2.1:451: i/o timeout")} {
+		if got := ReplyCode(err); got != 0 {
+			t.Errorf("ReplyCode(%v) = %d, want 0", err, got)
+		}
+	}
+	if got := MessageReplyCode("421 4.7.0 closing"); got != 421 {
+		t.Errorf("MessageReplyCode = %d, want 421", got)
+	}
+	for _, msg := range []string{"port 5870 refused", "dial tcp 10.0.0.1:451: connection refused", "user 550 unknown"} {
+		if got := MessageReplyCode(msg); got != 0 {
+			t.Errorf("MessageReplyCode(%q) = %d, want 0", msg, got)
+		}
+	}
+	if !IsTransientMessage("452 4.3.1 insufficient storage") || IsTransientMessage("550 no") {
+		t.Error("IsTransientMessage classification wrong")
+	}
+}
@@ -0,0 +1,97 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"time"
+
+	"github.com/soulteary/provider-kit"
+)
+
+// Session sends several messages over one SMTP connection, saving the connect, TLS and
+// AUTH round trips per message. It connects lazily, resets the transaction after a
+// rejected message, reconnects after connection errors and after maxMessages messages.
+// A Session is not safe for concurrent use.
+type Session struct {
+	t           *transport
+	maxMessages int
+
+	c    *smtp.Client
+	conn net.Conn
+	sent int
+}
+
+// Send delivers msg on the session connection, opening one when needed.
+func (s *Session) Send(ctx context.Context, msg *provider.Message) (*provider.SendResult, error) {
+	if s == nil || s.t == nil {
+		return nil, nil
+	}
+	if msg == nil {
+		return nil, fmt.Errorf("smtp: nil message")
+	}
+	if s.t.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.t.timeout)
+		defer cancel()
+	}
+	if s.c != nil && s.maxMessages > 0 && s.sent >= s.maxMessages {
+		s.quit()
+	}
+	if s.c == nil {
+		c, conn, err := s.t.connect(ctx)
+		if err != nil {
+			return nil, err
+		}
+		s.c, s.conn, s.sent = c, conn, 0
+	} else if deadline, ok := ctx.Deadline(); ok {
+		_ = s.conn.SetDeadline(deadline)
+	} else {
+		_ = s.conn.SetDeadline(time.Time{})
+	}
+	result, err := s.t.deliver(s.c, msg)
+	if err != nil {
+		// A rejected transaction leaves the connection usable once reset; anything else
+		// (timeouts, dropped connections) needs a fresh one.
+		var reply *textproto.Error
+		if !errors.As(err, &reply) || s.c.Reset() != nil {
+			s.drop()
+		}
+		return nil, err
+	}
+	s.sent++
+	return result, nil
+}
+
+// Connected reports whether the session holds an open connection.
+func (s *Session) Connected() bool {
+	return s != nil && s.c != nil
+}
+
+// Close ends the session with QUIT.
+func (s *Session) Close() error {
+	if s == nil {
+		return nil
+	}
+	s.quit()
+	return nil
+}
+
+func (s *Session) quit() {
+	if s.c == nil {
+		return
+	}
+	_ = s.conn.SetDeadline(time.Now().Add(time.Second))
+	_ = s.c.Quit()
+	s.drop()
+}
+
+func (s *Session) drop() {
+	if s.c != nil {
+		_ = s.c.Close()
+	}
+	s.c, s.conn, s.sent = nil, nil, 0
+}
@@ -0,0 +1,93 @@
+package smtp
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/soulteary/provider-kit"
+)
+
+func TestSession_ReusesConnection(t *testing.T) {
+	srv := newFakeSMTPServer(t)
+	host, port := srv.hostPort()
+	s := &Session{t: newTestTransport(host, port, &net.Dialer{}), maxMessages: 3}
+	for i := 0; i < 5; i++ {
+		result, err := s.Send(context.Background(), provider.NewMessage("u@example.com").WithBody("x"))
+		if err != nil || result == nil || !result.OK {
+			t.Fatalf("Send %d: result=%+v err=%v", i, result, err)
+		}
+	}
+	_ = s.Close()
+	if got := len(srv.delivered()); got != 5 {
+		t.Errorf("delivered %d messages, want 5", got)
+	}
+	if got := srv.connections(); got != 2 {
+		t.Errorf("connections = %d, want 2 (3 messages per connection)", got)
+	}
+}
+
+func TestSession_RejectedMessageKeepsConnection(t *testing.T) {
+	srv := newFakeSMTPServer(t)
+	host, port := srv.hostPort()
+	s := &Session{t: newTestTransport(host, port, &net.Dialer{})}
+	defer func() { _ = s.Close() }()
+
+	srv.mu.Lock()
+	srv.rcptReply = "550 5.1.1 no such user"
+	srv.mu.Unlock()
+	if _, err := s.Send(context.Background(), provider.NewMessage("nobody@example.com")); err == nil || !strings.Contains(err.Error(), "550") {
+		t.Fatalf("err = %v, want 550 reply", err)
+	}
+	srv.mu.Lock()
+	srv.rcptReply = ""
+	srv.mu.Unlock()
+	if _, err := s.Send(context.Background(), provider.NewMessage("u@example.com")); err != nil {
+		t.Fatalf("Send after rejection: %v", err)
+	}
+	if got := srv.connections(); got != 1 {
+		t.Errorf("connections = %d, want 1", got)
+	}
+}
+
+func TestSession_ReconnectsAfterDrop(t *testing.T) {
+	srv := newFakeSMTPServer(t)
+	host, port := srv.hostPort()
+	s := &Session{t: newTestTransport(host, port, &net.Dialer{})}
+	defer func() { _ = s.Close() }()
+	if _, err := s.Send(context.Background(), provider.NewMessage("u@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	_ = s.conn.Close() // the relay hung up
+	if _, err := s.Send(context.Background(), provider.NewMessage("u@example.com")); err == nil {
+		t.Fatal("Send on a dropped connection should fail")
+	}
+	if s.Connected() {
+		t.Error("Connected = true after the connection dropped")
+	}
+	if _, err := s.Send(context.Background(), provider.NewMessage("u@example.com")); err != nil {
+		t.Fatalf("Send after drop: %v", err)
+	}
+	if got := srv.connections(); got != 2 {
+		t.Errorf("connections = %d, want 2", got)
+	}
+}
+
+func TestSession_Nil(t *testing.T) {
+	var s *Session
+	if r, err := s.Send(context.Background(), provider.NewMessage("u@example.com")); r != nil || err != nil {
+		t.Errorf("nil session Send = %v, %v", r, err)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("nil session Close = %v", err)
+	}
+	var c *Client
+	if c.NewSession() != nil {
+		t.Error("nil client NewSession should be nil")
+	}
+	// Without a custom dialer sends go through provider-kit, one connection each.
+	if (&Client{}).NewSession() != nil {
+		t.Error("NewSession without a transport should be nil")
+	}
+}
@@ -0,0 +1,178 @@
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/soulteary/provider-kit"
+)
+
+// transport sends mail over connections opened by its own dialer. It is used instead of
+// the provider-kit SMTP provider when outbound connections need a proxy or a bound source IP.
+type transport struct {
+	host        string
+	port        int
+	username    string
+	password    string
+	from        string
+	useStartTLS bool
+	timeout     time.Duration
+	dialer      contextDialer
+}
+
+// Send implements provider.Provider.
+func (t *transport) Send(ctx context.Context, msg *provider.Message) (*provider.SendResult, error) {
+	if msg == nil {
+		return nil, fmt.Errorf("smtp: nil message")
+	}
+	if t.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+		defer cancel()
+	}
+	c, _, err := t.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = c.Close() }()
+	result, err := t.deliver(c, msg)
+	if err != nil {
+		return nil, err
+	}
+	_ = c.Quit()
+	return result, nil
+}
+
+// connect dials the relay and gets the connection ready for mail: greeting, STARTTLS
+// and AUTH. The connection deadline follows ctx.
+func (t *transport) connect(ctx context.Context) (*smtp.Client, net.Conn, error) {
+	addr := net.JoinHostPort(t.host, strconv.Itoa(t.port))
+	conn, err := t.dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	// Implicit TLS (SMTPS) on 465; other ports use plaintext with optional STARTTLS.
+	if t.port == 465 {
+		conn = tls.Client(conn, &tls.Config{ServerName: t.host})
+	}
+	c, err := smtp.NewClient(conn, t.host)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	// STARTTLS and AUTH are never skipped when configured: a relay that stops advertising
+	// them (or a proxy stripping them) must not get credentials or mail in plaintext.
+	if t.useStartTLS && t.port != 465 {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			_ = c.Close()
+			return nil, nil, errors.New("smtp: relay does not advertise STARTTLS")
+		}
+		if err := c.StartTLS(&tls.Config{ServerName: t.host}); err != nil {
+			_ = c.Close()
+			return nil, nil, err
+		}
+	}
+	if t.username != "" {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			_ = c.Close()
+			return nil, nil, errors.New("smtp: relay does not advertise AUTH")
+		}
+		if err := c.Auth(smtp.PlainAuth("", t.username, t.password, t.host)); err != nil {
+			_ = c.Close()
+			return nil, nil, err
+		}
+	}
+	return c, conn, nil
+}
+
+// deliver runs one mail transaction (MAIL, RCPT, DATA) on a ready connection.
+func (t *transport) deliver(c *smtp.Client, msg *provider.Message) (*provider.SendResult, error) {
+	messageID := newMessageID()
+	if err := c.Mail(t.from); err != nil {
+		return nil, err
+	}
+	if err := c.Rcpt(msg.To); err != nil {
+		return nil, err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(t.buildMessage(msg, messageID)); err != nil {
+		_ = w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return provider.NewSuccessResult("smtp", provider.ChannelEmail, messageID), nil
+}
+
+// probe connects to the relay, waits for its greeting and sends NOOP. It checks that the
+// relay is reachable without sending mail.
+func probe(ctx context.Context, d contextDialer, host string, port int) error {
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if port == 465 {
+		conn = tls.Client(conn, &tls.Config{ServerName: host})
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer func() { _ = c.Close() }()
+	if err := c.Noop(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// buildMessage renders msg as a plain-text RFC 5322 message.
+func (t *transport) buildMessage(msg *provider.Message, messageID string) []byte {
+	var b bytes.Buffer
+	domain := t.host
+	if at := strings.LastIndex(t.from, "@"); at >= 0 {
+		domain = t.from[at+1:]
+	}
+	fmt.Fprintf(&b, "From: %s\r\n", t.from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", messageID, domain)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qp := quotedprintable.NewWriter(&b)
+	_, _ = qp.Write([]byte(msg.Body))
+	_ = qp.Close()
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+// newMessageID returns a random hex identifier.
+func newMessageID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,298 @@
+package smtp
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/soulteary/provider-kit"
+)
+
+// fakeSMTPServer is a minimal SMTP server for tests. It accepts every command and
+// records the envelope and data of each delivered message.
+type fakeSMTPServer struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	messages []string
+	conns    int
+	// rcptReply overrides the RCPT TO reply (e.g. "451 4.3.0 try again").
+	rcptReply string
+	// extensions are advertised in the EHLO reply (e.g. "AUTH PLAIN").
+	extensions []string
+}
+
+func newFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTPServer{ln: ln}
+	go s.serve()
+	t.Cleanup(func() { _ = ln.Close() })
+	return s
+}
+
+func (s *fakeSMTPServer) hostPort() (string, int) {
+	addr := s.ln.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+func (s *fakeSMTPServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeSMTPServer) handle(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	s.mu.Lock()
+	s.conns++
+	s.mu.Unlock()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { _, _ = conn.Write([]byte(line + "\r\n")) }
+	reply("220 fake ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			s.mu.Lock()
+			extensions := s.extensions
+			s.mu.Unlock()
+			for _, ext := range extensions {
+				reply("250-" + ext)
+			}
+			reply("250 fake")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			s.mu.Lock()
+			override := s.rcptReply
+			s.mu.Unlock()
+			if override != "" {
+				reply(override)
+			} else {
+				reply("250 ok")
+			}
+		case cmd == "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, data.String())
+			s.mu.Unlock()
+			reply("250 queued")
+		case cmd == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func (s *fakeSMTPServer) delivered() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.messages...)
+}
+
+func (s *fakeSMTPServer) connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns
+}
+
+func newTestTransport(host string, port int, d contextDialer) *transport {
+	return &transport{
+		host:    host,
+		port:    port,
+		from:    "noreply@example.com",
+		timeout: 5 * time.Second,
+		dialer:  d,
+	}
+}
+
+func TestTransport_Send(t *testing.T) {
+	srv := newFakeSMTPServer(t)
+	host, port := srv.hostPort()
+	tr := newTestTransport(host, port, &net.Dialer{})
+
+	msg := provider.NewMessage("u@example.com").WithSubject("Code").WithBody("Your code is 123456")
+	result, err := tr.Send(context.Background(), msg)
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if result == nil || !result.OK || result.MessageID == "" {
+		t.Fatalf("result = %+v, want OK with message id", result)
+	}
+	got := srv.delivered()
+	if len(got) != 1 {
+		t.Fatalf("delivered %d messages, want 1", len(got))
+	}
+	if !strings.Contains(got[0], "To: u@example.com") || !strings.Contains(got[0], "123456") {
+		t.Errorf("unexpected message:\n%s", got[0])
+	}
+	if !strings.Contains(got[0], "Message-ID: <"+result.MessageID+"@example.com>") {
+		t.Errorf("message id header missing:\n%s", got[0])
+	}
+}
+
+func TestTransport_Send_NilMessage(t *testing.T) {
+	tr := newTestTransport("127.0.0.1", 25, &net.Dialer{})
+	if _, err := tr.Send(context.Background(), nil); err == nil {
+		t.Error("Send(nil) err = nil, want error")
+	}
+}
+
+func TestTransport_Send_RcptRejected(t *testing.T) {
+	srv := newFakeSMTPServer(t)
+	srv.rcptReply = "550 5.1.1 no such user"
+	host, port := srv.hostPort()
+	tr := newTestTransport(host, port, &net.Dialer{})
+
+	_, err := tr.Send(context.Background(), provider.NewMessage("nobody@example.com").WithBody("x"))
+	if err == nil || !strings.Contains(err.Error(), "550") {
+		t.Errorf("err = %v, want 550 reply", err)
+	}
+}
+
+func TestTransport_Send_DialError(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	port := ln.Addr().(*net.TCPAddr).Port
+	_ = ln.Close()
+	tr := newTestTransport("127.0.0.1", port, &net.Dialer{})
+	if _, err := tr.Send(context.Background(), provider.NewMessage("u@example.com")); err == nil {
+		t.Error("Send to closed port err = nil, want error")
+	}
+}
+
+func TestTransport_Send_RequiresAdvertisedExtensions(t *testing.T) {
+	srv := newFakeSMTPServer(t)
+	host, port := srv.hostPort()
+	startTLS := newTestTransport(host, port, &net.Dialer{})
+	startTLS.useStartTLS = true
+	withAuth := newTestTransport(host, port, &net.Dialer{})
+	withAuth.username, withAuth.password = "user", "pass"
+	for name, tr := range map[string]*transport{"STARTTLS": startTLS, "AUTH": withAuth} {
+		_, err := tr.Send(context.Background(), provider.NewMessage("u@example.com").WithBody("x"))
+		if err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("%s configured but not advertised: err = %v, want error", name, err)
+		}
+	}
+	if got := srv.delivered(); len(got) != 0 {
+		t.Errorf("delivered %d messages without the configured extensions", len(got))
+	}
+}
+
+// parsedMessage is the part of a delivered message a recipient sees.
+type parsedMessage struct {
+	from, to, subject, contentType, body string
+}
+
+func parseDelivered(t *testing.T, raw string) parsedMessage {
+	t.Helper()
+	m, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatalf("parse message: %v\n%s", err, raw)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body io.Reader = m.Body
+	switch strings.ToLower(m.Header.Get("Content-Transfer-Encoding")) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	b, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, _ := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	return parsedMessage{
+		from: m.Header.Get("From"), to: m.Header.Get("To"), subject: subject,
+		contentType: mediaType + "; charset=" + strings.ToLower(params["charset"]),
+		body:        strings.TrimRight(string(b), "\r\n"),
+	}
+}
+
+// The transport is used instead of the provider-kit provider when a proxy or source IP is
+// configured; both must deliver the same message.
+func TestTransport_MatchesProvider(t *testing.T) {
+	srv := newFakeSMTPServer(t)
+	host, port := srv.hostPort()
+	p, err := provider.NewSMTPProvider(&provider.SMTPConfig{Host: host, Port: port, From: "noreply@example.com", Timeout: 5 * time.Second})
+	if err != nil {
+		t.Skipf("provider-kit SMTP provider unavailable: %v", err)
+	}
+	msg := provider.NewMessage("u@example.com").WithSubject("验证码 / code").WithBody("Your code is 123456.\nIt expires in 5 minutes = 300 s.")
+	if _, err := p.Send(context.Background(), msg); err != nil {
+		t.Fatalf("provider Send: %v", err)
+	}
+	if _, err := newTestTransport(host, port, &net.Dialer{}).Send(context.Background(), msg); err != nil {
+		t.Fatalf("transport Send: %v", err)
+	}
+	got := srv.delivered()
+	if len(got) != 2 {
+		t.Fatalf("delivered %d messages, want 2", len(got))
+	}
+	if want, have := parseDelivered(t, got[0]), parseDelivered(t, got[1]); want != have {
+		t.Errorf("transport message differs from provider-kit:\n got  %+v\n want %+v", have, want)
+	}
+}
+
+func TestBuildMessage_EncodesSubject(t *testing.T) {
+	tr := newTestTransport("smtp.example.com", 587, nil)
+	raw := string(tr.buildMessage(provider.NewMessage("u@example.com").WithSubject("验证码").WithBody("x"), "id"))
+	if !strings.Contains(raw, "Subject: =?utf-8?q?") {
+		t.Errorf("subject not encoded:\n%s", raw)
+	}
+	if !strings.Contains(raw, "Message-ID: <id@example.com>") {
+		t.Errorf("message id should use sender domain:\n%s", raw)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	srv := newFakeSMTPServer(t)
+	host, port := srv.hostPort()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := probe(ctx, &net.Dialer{}, host, port); err != nil {
+		t.Fatalf("probe: %v", err)
+	}
+	if len(srv.delivered()) != 0 {
+		t.Error("probe must not deliver mail")
+	}
+	_ = srv.ln.Close()
+	if err := probe(ctx, &net.Dialer{}, host, port); err == nil {
+		t.Error("probe of a closed relay should fail")
+	}
+}
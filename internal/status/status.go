@@ -0,0 +1,224 @@
+package status
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/soulteary/herald-smtp/internal/deadletter"
+)
+
+// Status is a step in the lifecycle of a message.
+type Status string
+
+const (
+	Accepted   Status = "accepted"   // request validated
+	Queued     Status = "queued"     // waiting in the queue or scheduler
+	Attempting Status = "attempting" // SMTP exchange in progress
+	Relayed    Status = "relayed"    // accepted by the relay
+	Bounced    Status = "bounced"    // permanently rejected by the relay (5xx)
+	Failed     Status = "failed"     // gave up after transient errors or retries
+	Cancelled  Status = "cancelled"  // cancelled before delivery
+)
+
+// Final reports whether no further transitions are expected.
+func (s Status) Final() bool {
+	return s == Relayed || s == Bounced || s == Failed || s == Cancelled
+}
+
+// Event is a status transition.
+type Event struct {
+	Status Status    `json:"status"`
+	At     time.Time `json:"at"`
+}
+
+// Record is the lifecycle of one message.
+type Record struct {
+	ID             string               `json:"message_id"`
+	Status         Status               `json:"status"`
+	Mode           string               `json:"mode"` // "sync" or "async"
+	To             string               `json:"to"`
+	APIKey         string               `json:"api_key,omitempty"` // name of the key that sent it
+	SendAt         time.Time            `json:"send_at,omitzero"`
+	RelayMessageID string               `json:"relay_message_id,omitempty"`
+	RelayReply     int                  `json:"relay_reply_code,omitempty"`
+	LastError      string               `json:"last_error,omitempty"`
+	Attempts       []deadletter.Attempt `json:"attempts,omitempty"`
+	Events         []Event              `json:"events"`
+	CreatedAt      time.Time            `json:"created_at"`
+	UpdatedAt      time.Time            `json:"updated_at"`
+}
+
+// Tracker keeps message records in memory. At most maxEntries are kept (oldest first out)
+// and finished records are dropped ttl after their last update. A nil Tracker ignores
+// updates and finds nothing, so callers need not check whether tracking is enabled.
+type Tracker struct {
+	mu         sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	records    map[string]*list.Element
+	order      *list.List // *Record, oldest first
+}
+
+// NewTracker creates a tracker; maxEntries <= 0 means 10000 and ttl <= 0 means 24h.
+func NewTracker(maxEntries int, ttl time.Duration) *Tracker {
+	if maxEntries <= 0 {
+		maxEntries = 10000
+	}
+	if ttl <= 0 {
+		ttl = 24 * time.Hour
+	}
+	return &Tracker{maxEntries: maxEntries, ttl: ttl, records: make(map[string]*list.Element), order: list.New()}
+}
+
+// Begin starts a record in the accepted state, replacing any record with the same ID.
+// apiKey is the name of the API key of the request, if any.
+func (t *Tracker) Begin(id, to, mode, apiKey string) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	r := &Record{ID: id, Status: Accepted, Mode: mode, To: to, APIKey: apiKey, CreatedAt: now, UpdatedAt: now,
+		Events: []Event{{Status: Accepted, At: now}}}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if el, ok := t.records[id]; ok {
+		t.order.Remove(el)
+	}
+	t.records[id] = t.order.PushBack(r)
+	for t.order.Len() > t.maxEntries {
+		t.removeLocked(t.order.Front())
+	}
+}
+
+// Queue marks the record queued; sendAt is the scheduled time, or zero.
+func (t *Tracker) Queue(id string, sendAt time.Time) {
+	t.update(id, Queued, func(r *Record) { r.SendAt = sendAt })
+}
+
+// Attempting marks the start of an SMTP attempt.
+func (t *Tracker) Attempting(id string) {
+	t.update(id, Attempting, nil)
+}
+
+// Attempt records the outcome of an attempt without changing the status.
+func (t *Tracker) Attempt(id string, a deadletter.Attempt) {
+	t.update(id, "", func(r *Record) { r.Attempts = append(r.Attempts, a) })
+}
+
+// Relay marks the record relayed with the relay's message ID and reply code.
+func (t *Tracker) Relay(id, relayID string, replyCode int) {
+	t.update(id, Relayed, func(r *Record) {
+		r.RelayMessageID = relayID
+		r.RelayReply = replyCode
+		r.LastError = ""
+	})
+}
+
+// Fail marks the record bounced when the last reply was a permanent 5xx, failed otherwise.
+func (t *Tracker) Fail(id, errMsg string, replyCode int) {
+	st := Failed
+	if replyCode >= 500 && replyCode < 600 {
+		st = Bounced
+	}
+	t.update(id, st, func(r *Record) {
+		r.LastError = errMsg
+		r.RelayReply = replyCode
+	})
+}
+
+// Cancel marks the record cancelled.
+func (t *Tracker) Cancel(id string) {
+	t.update(id, Cancelled, nil)
+}
+
+// Rename moves a record to a new ID, e.g. the relay message ID returned to the caller.
+func (t *Tracker) Rename(from, to string) {
+	if t == nil || from == to {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	el, ok := t.records[from]
+	if !ok {
+		return
+	}
+	delete(t.records, from)
+	if old, ok := t.records[to]; ok {
+		t.removeLocked(old)
+	}
+	el.Value.(*Record).ID = to
+	t.records[to] = el
+}
+
+// Forget drops the record with id, e.g. when the message was not accepted after all.
+func (t *Tracker) Forget(id string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if el, ok := t.records[id]; ok {
+		t.removeLocked(el)
+	}
+}
+
+// Get returns a copy of the record with id.
+func (t *Tracker) Get(id string) (Record, bool) {
+	if t == nil {
+		return Record{}, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	el, ok := t.records[id]
+	if !ok {
+		return Record{}, false
+	}
+	r := el.Value.(*Record)
+	if r.Status.Final() && time.Since(r.UpdatedAt) > t.ttl {
+		t.removeLocked(el)
+		return Record{}, false
+	}
+	cp := *r
+	cp.Attempts = append([]deadletter.Attempt(nil), r.Attempts...)
+	cp.Events = append([]Event(nil), r.Events...)
+	return cp, true
+}
+
+// Len returns the number of records.
+func (t *Tracker) Len() int {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.order.Len()
+}
+
+// update applies fn to the record and, when st is set, moves it to st. Unknown IDs are ignored.
+func (t *Tracker) update(id string, st Status, fn func(*Record)) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	el, ok := t.records[id]
+	if !ok {
+		return
+	}
+	r := el.Value.(*Record)
+	now := time.Now()
+	if fn != nil {
+		fn(r)
+	}
+	if st != "" {
+		r.Status = st
+		r.Events = append(r.Events, Event{Status: st, At: now})
+	}
+	r.UpdatedAt = now
+}
+
+func (t *Tracker) removeLocked(el *list.Element) {
+	t.order.Remove(el)
+	delete(t.records, el.Value.(*Record).ID)
+}
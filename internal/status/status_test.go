@@ -0,0 +1,94 @@
+package status
+
+import (
+	"testing"
+	"time"
+
+	"github.com/soulteary/herald-smtp/internal/deadletter"
+)
+
+func TestTracker_Lifecycle(t *testing.T) {
+	tr := NewTracker(0, 0)
+	tr.Begin("m1", "u@example.com", "async", "")
+	tr.Queue("m1", time.Time{})
+	tr.Attempting("m1")
+	tr.Attempt("m1", deadletter.Attempt{At: time.Now(), Error: "451 try later", ReplyCode: 451})
+	tr.Attempting("m1")
+	tr.Attempt("m1", deadletter.Attempt{At: time.Now()})
+	tr.Relay("m1", "relay-1", 250)
+
+	r, ok := tr.Get("m1")
+	if !ok {
+		t.Fatal("record not found")
+	}
+	if r.Status != Relayed || r.RelayMessageID != "relay-1" || r.RelayReply != 250 {
+		t.Errorf("record = %+v", r)
+	}
+	if len(r.Attempts) != 2 {
+		t.Errorf("attempts = %d, want 2", len(r.Attempts))
+	}
+	want := []Status{Accepted, Queued, Attempting, Attempting, Relayed}
+	if len(r.Events) != len(want) {
+		t.Fatalf("events = %v, want %v", r.Events, want)
+	}
+	for i, st := range want {
+		if r.Events[i].Status != st {
+			t.Errorf("event %d = %s, want %s", i, r.Events[i].Status, st)
+		}
+	}
+}
+
+func TestTracker_FailClassification(t *testing.T) {
+	tr := NewTracker(0, 0)
+	tr.Begin("b", "u@example.com", "sync", "")
+	tr.Fail("b", "550 no such user", 550)
+	tr.Begin("f", "u@example.com", "sync", "")
+	tr.Fail("f", "connection refused", 0)
+	if r, _ := tr.Get("b"); r.Status != Bounced || r.LastError == "" {
+		t.Errorf("b = %+v, want bounced", r)
+	}
+	if r, _ := tr.Get("f"); r.Status != Failed {
+		t.Errorf("f status = %s, want failed", r.Status)
+	}
+}
+
+func TestTracker_EvictionAndTTL(t *testing.T) {
+	tr := NewTracker(2, time.Millisecond)
+	tr.Begin("a", "u@example.com", "async", "")
+	tr.Begin("b", "u@example.com", "async", "")
+	tr.Begin("c", "u@example.com", "async", "")
+	if _, ok := tr.Get("a"); ok || tr.Len() != 2 {
+		t.Errorf("oldest record should be evicted; Len = %d", tr.Len())
+	}
+	tr.Cancel("b")
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := tr.Get("b"); ok {
+		t.Error("finished record should expire after ttl")
+	}
+	if _, ok := tr.Get("c"); !ok {
+		t.Error("unfinished record must not expire")
+	}
+}
+
+func TestTracker_RenameForgetAndNil(t *testing.T) {
+	tr := NewTracker(0, 0)
+	tr.Begin("tmp", "u@example.com", "sync", "")
+	tr.Rename("tmp", "relay")
+	if _, ok := tr.Get("tmp"); ok {
+		t.Error("old ID still present")
+	}
+	if r, ok := tr.Get("relay"); !ok || r.ID != "relay" {
+		t.Errorf("renamed record = %+v, %v", r, ok)
+	}
+	tr.Forget("relay")
+	if tr.Len() != 0 {
+		t.Errorf("Len = %d after Forget", tr.Len())
+	}
+
+	var nilTracker *Tracker
+	nilTracker.Begin("x", "u@example.com", "sync", "")
+	nilTracker.Relay("x", "r", 250)
+	if _, ok := nilTracker.Get("x"); ok || nilTracker.Len() != 0 {
+		t.Error("nil tracker should find nothing")
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"net"
 	"os"
 	"os/signal"
 	"strings"
@@ -13,6 +15,7 @@ import (
 	"github.com/pterm/pterm/putils"
 	"github.com/soulteary/herald-smtp/internal/config"
 	"github.com/soulteary/herald-smtp/internal/router"
+	"github.com/soulteary/herald-smtp/internal/servertls"
 	"github.com/soulteary/logger-kit"
 	version "github.com/soulteary/version-kit"
 )
@@ -47,21 +50,108 @@ func main() {
 		log.Warn().Msg("SMTP not configured; /v1/send will return 503")
 	}
 	app := fiber.New(fiber.Config{DisableStartupMessage: false})
-	router.Setup(app, log)
+	lifecycle := router.Setup(app, log)
+	var tlsServer *servertls.Server
+	if config.TLSEnabled() {
+		tlsServer = newTLSServer(lifecycle, log)
+	}
 
 	go func() {
-		if err := app.Listen(port); err != nil {
+		if err := listen(app, port, tlsServer); err != nil {
 			log.Fatal().Err(err).Msg("listen failed")
 		}
 	}()
 
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := lifecycle.ReloadKeys(); err != nil {
+				log.Error().Err(err).Msg("API key reload failed; keeping current keys")
+			}
+			if tlsServer == nil {
+				continue
+			}
+			if err := tlsServer.Reload(); err != nil {
+				log.Error().Err(err).Msg("TLS reload failed; keeping current certificate")
+			} else {
+				log.Info().Msg("TLS certificate reloaded")
+			}
+		}
+	}()
+
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
 	<-quit
-	log.Info().Msg("shutting down")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	drain(app, lifecycle, quit, log)
+	if tlsServer != nil {
+		tlsServer.Close()
+	}
+}
+
+// newTLSServer loads the listener certificate and, with TLS_CLIENT_CA_FILE, the client CA
+// bundle, and watches them for changes. Invalid TLS settings are fatal rather than
+// falling back to plain HTTP.
+func newTLSServer(lifecycle *router.Lifecycle, log *logger.Logger) *servertls.Server {
+	srv, err := servertls.New(servertls.Config{
+		CertFile:     config.TLSCertFile,
+		KeyFile:      config.TLSKeyFile,
+		ClientCAFile: config.TLSClientCAFile,
+		ClientAuth:   config.TLSClientAuth,
+		MinVersion:   config.TLSMinVersion,
+		VerifyPeer:   lifecycle.VerifyClientCert,
+	})
+	if err != nil {
+		log.Fatal().Err(err).Str("cert", config.TLSCertFile).Msg("failed to load TLS configuration")
+	}
+	log.Info().Bool("mutual_tls", srv.MutualTLS()).Str("client_auth", config.TLSClientAuth).Msg("serving HTTPS")
+	srv.Watch(time.Duration(config.TLSReloadSec)*time.Second, func(err error) {
+		if err != nil {
+			log.Error().Err(err).Msg("TLS reload failed; keeping current certificate")
+			return
+		}
+		log.Info().Msg("TLS certificate reloaded")
+	})
+	return srv
+}
+
+// listen serves app on addr, over TLS when srv is set.
+func listen(app *fiber.App, addr string, srv *servertls.Server) error {
+	if srv == nil {
+		return app.Listen(addr)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return app.Listener(tls.NewListener(ln, srv.TLSConfig()))
+}
+
+// drain shuts down gracefully: readiness fails first and sends are still served for the
+// pre-stop delay (a second signal skips it), then new sends are rejected and in-flight
+// sends, queue workers and the HTTP server get until the shutdown deadline to finish.
+func drain(app *fiber.App, lifecycle *router.Lifecycle, quit <-chan os.Signal, log *logger.Logger) {
+	preStop := time.Duration(config.ShutdownPreStopSec) * time.Second
+	log.Info().Dur("pre_stop", preStop).Msg("shutting down: readiness failing")
+	lifecycle.BeginDrain()
+	if preStop > 0 {
+		select {
+		case <-time.After(preStop):
+		case <-quit:
+			log.Info().Msg("second signal: skipping pre-stop delay")
+		}
+	}
+	lifecycle.StopAccepting()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.ShutdownTimeoutSec)*time.Second)
 	defer cancel()
+	if err := lifecycle.WaitIdle(ctx); err != nil {
+		log.Warn().Int("in_flight", lifecycle.InFlight()).Msg("in-flight sends still running at shutdown deadline")
+	}
 	if err := app.ShutdownWithContext(ctx); err != nil {
 		log.Warn().Err(err).Msg("shutdown error")
 	}
+	if err := lifecycle.Close(ctx); err != nil {
+		log.Warn().Err(err).Msg("queue drain incomplete")
+	}
+	log.Info().Msg("shutdown complete")
 }